@@ -25,8 +25,10 @@ Here is a client example:
 	package main
 
 	import (
+		"context"
 		"fmt"
 		"hprose"
+		"time"
 	)
 
 	type testUser struct {
@@ -39,13 +41,14 @@ Here is a client example:
 
 	type testRemoteObject struct {
 		Hello               func(string) string
-		HelloWithError      func(string) (string, error)               `name:"hello"`
-		AsyncHello          func(string) <-chan string                 `name:"hello"`
-		AsyncHelloWithError func(string) (<-chan string, <-chan error) `name:"hello"`
+		HelloWithError      func(string) (string, error)                  `name:"hello"`
+		HelloWithContext    func(context.Context, string) (string, error) `name:"hello"`
+		AsyncHello          func(string) <-chan string                    `name:"hello"`
+		AsyncHelloWithError func(string) (<-chan string, <-chan error)    `name:"hello"`
 		Sum                 func(...int) int
-		SwapKeyAndValue     func(*map[string]string) map[string]string `byref:"true"`
-		SwapInt             func(int, int) (int, int)                  `name:"swap"`
-		SwapFloat           func(float64, float64) (float64, float64)  `name:"swap"`
+		SwapKeyAndValue     func(*map[string]string) map[string]string    `byref:"true"`
+		SwapInt             func(int, int) (int, int)                     `name:"swap"`
+		SwapFloat           func(float64, float64) (float64, float64)     `name:"swap"`
 		Swap                func(interface{}, interface{}) (interface{}, interface{})
 		GetUserList         func() []testUser
 	}
@@ -65,6 +68,15 @@ Here is a client example:
 			fmt.Println(err.Error())
 		}
 
+		// The call will be cancelled when the context is done
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		if result, err := ro.HelloWithContext(ctx, "World"); err == nil {
+			fmt.Println(result)
+		} else {
+			fmt.Println(err.Error())
+		}
+		cancel()
+
 		// If an error occurs, it will be ignored
 		result := ro.AsyncHello("World")
 		fmt.Println(<-result)
@@ -109,6 +121,7 @@ package hprose
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"net/url"
@@ -122,6 +135,25 @@ type InvokeOptions struct {
 	ResultMode ResultMode
 }
 
+// ClientContext is passed to the invoke handlers, it carries the context of
+// the invoking, the options and the results which will be returned to the
+// caller. An invoke handler can set the results without calling next, for
+// example, when the results are cached.
+type ClientContext struct {
+	context.Context
+	Options *InvokeOptions
+	Results []reflect.Value
+}
+
+// NextInvokeHandler is the rest of the invoke handler chain, the last one
+// sends the request and reads the response.
+type NextInvokeHandler func(name string, args []reflect.Value, context *ClientContext) error
+
+// InvokeHandler is a client middleware which wraps every invoking. It can
+// change the name, args and options before calling next, call next more than
+// once to retry, or return an error without calling next.
+type InvokeHandler func(name string, args []reflect.Value, context *ClientContext, next NextInvokeHandler) error
+
 type Client interface {
 	UseService(...interface{})
 	Invoke(string, []interface{}, *InvokeOptions, interface{}) <-chan error
@@ -129,6 +161,19 @@ type Client interface {
 	SetUri(string)
 }
 
+// ContextInvoker is implemented by the clients which can abort an invoking
+// when its context is done, such as the ones created by NewClient.
+type ContextInvoker interface {
+	InvokeContext(context.Context, string, []interface{}, *InvokeOptions, interface{}) <-chan error
+}
+
+// FunctionLister is implemented by the clients which can get the names of
+// the functions published by a service, such as the ones created by
+// NewClient.
+type FunctionLister interface {
+	FunctionList(context.Context) ([]string, error)
+}
+
 type Transporter interface {
 	GetInvokeContext(uri string) (interface{}, error)
 	SendData(context interface{}, data []byte, success bool) error
@@ -136,16 +181,31 @@ type Transporter interface {
 	EndInvoke(context interface{}, success bool) error
 }
 
+// ContextTransporter is implemented by the transporters which can abort an
+// invoking when its context is done. The BaseClient uses
+// GetInvokeContextWithContext instead of GetInvokeContext when the
+// transporter implements it. Otherwise the context is only checked between
+// the steps of the invoking.
+type ContextTransporter interface {
+	Transporter
+	GetInvokeContextWithContext(ctx context.Context, uri string) (interface{}, error)
+}
+
 type BaseClient struct {
 	Transporter
 	Filter
-	ByRef      bool
-	SimpleMode bool
-	uri        *url.URL
+	ByRef         bool
+	SimpleMode    bool
+	Limits        ReaderLimits
+	uri           *url.URL
+	handlers      []InvokeHandler
+	invokeHandler NextInvokeHandler
 }
 
 var clientFactories = make(map[string]func(string) Client)
 
+var contextType = reflect.TypeOf((*context.Context)(nil)).Elem()
+
 func NewBaseClient(trans Transporter) *BaseClient {
 	return &BaseClient{Transporter: trans}
 }
@@ -215,7 +275,31 @@ func (client *BaseClient) UseService(args ...interface{}) {
 	panic("Wrong arguments.")
 }
 
+// Use appends the invoke handlers to the chain, the first one is the
+// outermost. It should be called before invoking.
+func (client *BaseClient) Use(handlers ...InvokeHandler) {
+	client.handlers = append(client.handlers, handlers...)
+	next := NextInvokeHandler(client.doInvoke)
+	for i := len(client.handlers) - 1; i >= 0; i-- {
+		handler, n := client.handlers[i], next
+		next = func(name string, args []reflect.Value, context *ClientContext) error {
+			return handler(name, args, context, n)
+		}
+	}
+	client.invokeHandler = next
+}
+
 func (client *BaseClient) Invoke(name string, args []interface{}, options *InvokeOptions, result interface{}) <-chan error {
+	return client.InvokeContext(context.Background(), name, args, options, result)
+}
+
+// InvokeContext is like Invoke, but the call is aborted when ctx is done.
+// The transporter stops sending or receiving data and the returned error
+// chan receives ctx.Err().
+func (client *BaseClient) InvokeContext(ctx context.Context, name string, args []interface{}, options *InvokeOptions, result interface{}) <-chan error {
+	if ctx == nil {
+		panic("The argument ctx can't be nil")
+	}
 	if result == nil {
 		panic("The argument result can't be nil")
 	}
@@ -231,12 +315,24 @@ func (client *BaseClient) Invoke(name string, args []interface{}, options *Invok
 	for i := 0; i < count; i++ {
 		a[i] = v.Index(i).Elem()
 	}
-	return client.invoke(name, a, options, r)
+	return client.invoke(ctx, name, a, options, r)
+}
+
+// FunctionList returns the names of the functions published by the
+// service, which sends them in reply to a request without a call. The
+// request goes through the invoke handlers with an empty name.
+func (client *BaseClient) FunctionList(ctx context.Context) (names []string, err error) {
+	if ctx == nil {
+		panic("The argument ctx can't be nil")
+	}
+	result := []reflect.Value{reflect.ValueOf(&names).Elem()}
+	err = client.syncInvoke(ctx, "", nil, new(InvokeOptions), result)
+	return names, err
 }
 
 // private methods
 
-func (client *BaseClient) invoke(name string, args []reflect.Value, options *InvokeOptions, result []reflect.Value) <-chan error {
+func (client *BaseClient) invoke(ctx context.Context, name string, args []reflect.Value, options *InvokeOptions, result []reflect.Value) <-chan error {
 	if options == nil {
 		options = new(InvokeOptions)
 	}
@@ -257,30 +353,66 @@ func (client *BaseClient) invoke(name string, args []reflect.Value, options *Inv
 		panic("The elements in args must be pointer when options.ByRef is true.")
 	}
 	if async {
-		return client.asyncInvoke(name, args, options, result)
+		return client.asyncInvoke(ctx, name, args, options, result)
 	} else {
 		err := make(chan error, 1)
-		err <- client.syncInvoke(name, args, options, result)
+		err <- client.syncInvoke(ctx, name, args, options, result)
 		return err
 	}
 }
 
-func (client *BaseClient) syncInvoke(name string, args []reflect.Value, options *InvokeOptions, result []reflect.Value) (err error) {
-	context, err := client.GetInvokeContext(client.Uri())
+func (client *BaseClient) syncInvoke(ctx context.Context, name string, args []reflect.Value, options *InvokeOptions, result []reflect.Value) (err error) {
+	if err = ctx.Err(); err != nil {
+		return err
+	}
 	defer func() {
 		if e := recover(); e != nil && err == nil {
 			err = fmt.Errorf("%v", e)
 		}
+		if e := ctx.Err(); e != nil && err != nil {
+			err = e
+		}
 	}()
-	if err == nil {
-		if err = client.doOutput(context, name, args, options); err == nil {
-			err = client.doIntput(context, args, options, result)
+	context := &ClientContext{Context: ctx, Options: options, Results: result}
+	if client.invokeHandler != nil {
+		return client.invokeHandler(name, args, context)
+	}
+	return client.doInvoke(name, args, context)
+}
+
+func (client *BaseClient) doInvoke(name string, args []reflect.Value, context *ClientContext) (err error) {
+	if context.Options == nil {
+		context.Options = new(InvokeOptions)
+	}
+	ctx, options, result := context.Context, context.Options, context.Results
+	trans, cancelable := client.Transporter.(ContextTransporter)
+	var invokeContext interface{}
+	if cancelable {
+		invokeContext, err = trans.GetInvokeContextWithContext(ctx, client.Uri())
+	} else {
+		invokeContext, err = client.GetInvokeContext(client.Uri())
+	}
+	if err != nil {
+		return err
+	}
+	if !cancelable {
+		if err = ctx.Err(); err != nil {
+			client.EndInvoke(invokeContext, false)
+			return err
 		}
 	}
+	if err = client.doOutput(invokeContext, name, args, options); err != nil {
+		client.EndInvoke(invokeContext, false)
+		return err
+	}
+	err = client.doIntput(invokeContext, args, options, result)
+	if !cancelable && err == nil {
+		err = ctx.Err()
+	}
 	return err
 }
 
-func (client *BaseClient) asyncInvoke(name string, args []reflect.Value, options *InvokeOptions, result []reflect.Value) <-chan error {
+func (client *BaseClient) asyncInvoke(ctx context.Context, name string, args []reflect.Value, options *InvokeOptions, result []reflect.Value) <-chan error {
 	length := len(result)
 	sender := make([]reflect.Value, length)
 	out := make([]reflect.Value, length)
@@ -293,7 +425,7 @@ func (client *BaseClient) asyncInvoke(name string, args []reflect.Value, options
 	}
 	errChan := make(chan error, 1)
 	go func() {
-		err := client.syncInvoke(name, args, options, out)
+		err := client.syncInvoke(ctx, name, args, options, out)
 		for i := 0; i < length; i++ {
 			sender[i].Send(out[i])
 		}
@@ -328,6 +460,13 @@ func (client *BaseClient) doOutput(context interface{}, name string, args []refl
 	} else {
 		writer = NewWriter(buf)
 	}
+	// the request without a call asks for the function list.
+	if name == "" {
+		if err = writer.Stream().WriteByte(TagEnd); err == nil {
+			success = true
+		}
+		return err
+	}
 	if err = writer.Stream().WriteByte(TagCall); err != nil {
 		return err
 	}
@@ -370,10 +509,17 @@ func (client *BaseClient) doIntput(context interface{}, args []reflect.Value, op
 	resultMode := options.ResultMode
 	buf := new(bytes.Buffer)
 	reader := NewReader(istream)
-	expectTags := []byte{TagResult, TagArgument, TagError, TagEnd}
+	reader.(LimitSetter).SetLimits(client.Limits)
+	expectTags := []byte{TagResult, TagArgument, TagError, TagFunctions, TagEnd}
 	var tag byte
 	for tag, err = reader.CheckTags(expectTags); err == nil && tag != TagEnd; tag, err = reader.CheckTags(expectTags) {
 		switch tag {
+		case TagFunctions:
+			reader.Reset()
+			if err = reader.ReadValue(result[0]); err != nil {
+				success = false
+				return err
+			}
 		case TagResult:
 			switch resultMode {
 			case Normal:
@@ -384,6 +530,9 @@ func (client *BaseClient) doIntput(context interface{}, args []reflect.Value, op
 				} else if err = reader.CheckTag(TagList); err == nil {
 					var count int
 					if count, err = reader.ReadInteger(TagOpenbrace); err == nil {
+						err = client.Limits.checkCount(count)
+					}
+					if err == nil {
 						r := make([]reflect.Value, count)
 						if count <= length {
 							for i := 0; i < count; i++ {
@@ -430,6 +579,9 @@ func (client *BaseClient) doIntput(context interface{}, args []reflect.Value, op
 					length := len(args)
 					var count int
 					if count, err = reader.ReadInteger(TagOpenbrace); err == nil {
+						err = client.Limits.checkCount(count)
+					}
+					if err == nil {
 						a := make([]reflect.Value, count)
 						if count <= length {
 							for i := 0; i < count; i++ {
@@ -530,7 +682,15 @@ func (client *BaseClient) createRemoteObject(ro interface{}) {
 func (client *BaseClient) remoteMethod(t reflect.Type, sf reflect.StructField) func(in []reflect.Value) []reflect.Value {
 	name := getFuncName(sf)
 	options := &InvokeOptions{ByRef: getByRef(sf), SimpleMode: getSimpleMode(sf), ResultMode: getResultMode(sf)}
+	hasContext := t.NumIn() > 0 && t.In(0) == contextType
 	return func(in []reflect.Value) []reflect.Value {
+		ctx := context.Background()
+		if hasContext {
+			if c, ok := in[0].Interface().(context.Context); ok {
+				ctx = c
+			}
+			in = in[1:]
+		}
 		inlen := len(in)
 		varlen := 0
 		argc := inlen
@@ -558,7 +718,7 @@ func (client *BaseClient) remoteMethod(t reflect.Type, sf reflect.StructField) f
 		switch numout {
 		case 0:
 			var result interface{}
-			if err := <-client.invoke(name, args, options, []reflect.Value{reflect.ValueOf(&result).Elem()}); err == nil {
+			if err := <-client.invoke(ctx, name, args, options, []reflect.Value{reflect.ValueOf(&result).Elem()}); err == nil {
 				return out
 			} else {
 				panic(err.Error())
@@ -568,23 +728,23 @@ func (client *BaseClient) remoteMethod(t reflect.Type, sf reflect.StructField) f
 			if rt0.Kind() == reflect.Chan {
 				if rt0.Elem().Kind() == reflect.Interface && rt0.Elem().Name() == "error" {
 					var result chan interface{}
-					err := client.invoke(name, args, options, []reflect.Value{reflect.ValueOf(&result).Elem()})
+					err := client.invoke(ctx, name, args, options, []reflect.Value{reflect.ValueOf(&result).Elem()})
 					out[0] = reflect.ValueOf(&err).Elem()
 					return out
 				} else {
 					out[0] = reflect.New(rt0).Elem()
-					client.invoke(name, args, options, out)
+					client.invoke(ctx, name, args, options, out)
 					return out
 				}
 			} else {
 				if rt0.Kind() == reflect.Interface && rt0.Name() == "error" {
 					var result interface{}
-					err := <-client.invoke(name, args, options, []reflect.Value{reflect.ValueOf(&result).Elem()})
+					err := <-client.invoke(ctx, name, args, options, []reflect.Value{reflect.ValueOf(&result).Elem()})
 					out[0] = reflect.ValueOf(&err).Elem()
 					return out
 				} else {
 					out[0] = reflect.New(rt0).Elem()
-					if err := <-client.invoke(name, args, options, out); err == nil {
+					if err := <-client.invoke(ctx, name, args, options, out); err == nil {
 						return out
 					} else {
 						panic(err.Error())
@@ -600,22 +760,22 @@ func (client *BaseClient) remoteMethod(t reflect.Type, sf reflect.StructField) f
 			if rtlast.Kind() == reflect.Chan &&
 				rtlast.Elem().Kind() == reflect.Interface &&
 				rtlast.Elem().Name() == "error" {
-				err := client.invoke(name, args, options, out[:last])
+				err := client.invoke(ctx, name, args, options, out[:last])
 				out[last] = reflect.ValueOf(&err).Elem()
 				return out
 			}
 			if rtlast.Kind() == reflect.Interface &&
 				rtlast.Name() == "error" {
-				err := <-client.invoke(name, args, options, out[:last])
+				err := <-client.invoke(ctx, name, args, options, out[:last])
 				out[last] = reflect.ValueOf(&err).Elem()
 				return out
 			}
 			out[last] = reflect.New(t.Out(last)).Elem()
 			if t.Out(0).Kind() == reflect.Chan {
-				client.invoke(name, args, options, out)
+				client.invoke(ctx, name, args, options, out)
 				return out
 			} else {
-				if err := <-client.invoke(name, args, options, out); err == nil {
+				if err := <-client.invoke(ctx, name, args, options, out); err == nil {
 					return out
 				} else {
 					panic(err.Error())
@@ -725,5 +885,7 @@ func init() {
 	RegisterClientFactory("tcp", NewTcpClient)
 	RegisterClientFactory("tcp4", NewTcpClient)
 	RegisterClientFactory("tcp6", NewTcpClient)
-	//RegisterClientFactory("ws", NewWebSocketClient)
+	RegisterClientFactory("unix", NewUnixClient)
+	RegisterClientFactory("ws", NewWebSocketClient)
+	RegisterClientFactory("wss", NewWebSocketClient)
 }
@@ -0,0 +1,99 @@
+/**********************************************************\
+|                                                          |
+|                          hprose                          |
+|                                                          |
+| Official WebSite: http://www.hprose.com/                 |
+|                   http://www.hprose.net/                 |
+|                   http://www.hprose.org/                 |
+|                                                          |
+\**********************************************************/
+/**********************************************************\
+ *                                                        *
+ * hprose/cmd/hprose-stubgen/main.go                      *
+ *                                                        *
+ * hprose stub generator command for Go.                  *
+ *                                                        *
+\**********************************************************/
+
+// hprose-stubgen writes the remote object struct of a service, to be used
+// with Client.UseService. It reads the functions from a running service,
+// or with -d from a descriptor exported by stubgen.WriteDescriptor, which
+// has the types of the functions. It works with go generate:
+//
+//	//go:generate hprose-stubgen -type Hello -o hello_stub.go http://127.0.0.1:8080/
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"hprose"
+	"hprose/stubgen"
+	"io/ioutil"
+	"os"
+	"time"
+)
+
+func main() {
+	descriptor := flag.String("d", "", "read the functions from the descriptor file instead of a service")
+	typeName := flag.String("type", "Service", "the name of the remote object struct")
+	pkg := flag.String("package", os.Getenv("GOPACKAGE"), "the package name of the generated file")
+	output := flag.String("o", "", "the output file, the standard output by default")
+	withContext := flag.Bool("context", false, "add a context.Context parameter to the Err and Async variants")
+	timeout := flag.Duration("timeout", 30*time.Second, "the timeout of reading the functions from the service")
+	flag.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: hprose-stubgen [flags] (uri | -d descriptor)")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	d, err := readDescriptor(*descriptor, *timeout)
+	if err != nil {
+		fatal(err)
+	}
+	src, err := stubgen.Generate(d, stubgen.Options{Package: *pkg, Type: *typeName, Context: *withContext})
+	if err != nil {
+		fatal(err)
+	}
+	if *output == "" {
+		_, err = os.Stdout.Write(src)
+	} else {
+		err = ioutil.WriteFile(*output, src, 0644)
+	}
+	if err != nil {
+		fatal(err)
+	}
+}
+
+func readDescriptor(file string, timeout time.Duration) (d *stubgen.Descriptor, err error) {
+	if file != "" {
+		if flag.NArg() != 0 {
+			return nil, errors.New("a uri can't be used with -d")
+		}
+		f, err := os.Open(file)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		return stubgen.ReadDescriptor(f)
+	}
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	defer func() {
+		// NewClient panics for the schemes which are not supported.
+		if e := recover(); e != nil {
+			err = fmt.Errorf("%v", e)
+		}
+	}()
+	client := hprose.NewClient(flag.Arg(0))
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return stubgen.FromService(ctx, client)
+}
+
+func fatal(err error) {
+	fmt.Fprintln(os.Stderr, "hprose-stubgen:", err)
+	os.Exit(1)
+}
@@ -0,0 +1,184 @@
+/**********************************************************\
+|                                                          |
+|                          hprose                          |
+|                                                          |
+| Official WebSite: http://www.hprose.com/                 |
+|                   http://www.hprose.net/                 |
+|                   http://www.hprose.org/                 |
+|                                                          |
+\**********************************************************/
+/**********************************************************\
+ *                                                        *
+ * hprose/cmd/hprose/main.go                              *
+ *                                                        *
+ * hprose command line tool for Go.                       *
+ *                                                        *
+\**********************************************************/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"hprose"
+	"os"
+	"strings"
+	"time"
+)
+
+const usage = `usage: hprose [flags] uri [function [arg ...]]
+
+Without a function, hprose lists the functions published by the service at
+uri. Otherwise it invokes the function with the args and prints the result.
+The args are JSON values, or serialized hprose values with -hprose. An arg
+which is not a valid JSON value is passed as a string.
+
+flags:
+`
+
+var resultModes = map[string]hprose.ResultMode{
+	"normal":        hprose.Normal,
+	"serialized":    hprose.Serialized,
+	"raw":           hprose.Raw,
+	"rawwithendtag": hprose.RawWithEndTag,
+}
+
+func main() {
+	byref := flag.Bool("byref", false, "pass the args by reference and print them after the call")
+	simple := flag.Bool("simple", false, "serialize the args in simple mode, without references")
+	mode := flag.String("mode", "normal", "the result mode: normal, serialized, raw or rawwithendtag")
+	literal := flag.Bool("hprose", false, "the args are serialized hprose values")
+	format := flag.String("format", "json", "the output format: json, dump or hprose")
+	timeout := flag.Duration("timeout", 30*time.Second, "the timeout of the call")
+	flag.Usage = func() {
+		fmt.Fprint(os.Stderr, usage)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	resultMode, ok := resultModes[strings.ToLower(*mode)]
+	if !ok {
+		fatal(errors.New("unknown result mode " + *mode))
+	}
+	switch *format {
+	case "json", "dump", "hprose":
+	default:
+		fatal(errors.New("unknown output format " + *format))
+	}
+	client, err := newClient(flag.Arg(0))
+	if err != nil {
+		fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+	if flag.NArg() == 1 {
+		lister, ok := client.(hprose.FunctionLister)
+		if !ok {
+			fatal(errors.New("the client of " + flag.Arg(0) + " can't list the functions"))
+		}
+		names, err := lister.FunctionList(ctx)
+		if err != nil {
+			fatal(err)
+		}
+		for _, name := range names {
+			fmt.Println(name)
+		}
+		return
+	}
+	invoker, ok := client.(hprose.ContextInvoker)
+	if !ok {
+		fatal(errors.New("the client of " + flag.Arg(0) + " can't be cancelled"))
+	}
+	raws := make([]hprose.RawMessage, flag.NArg()-2)
+	args := make([]interface{}, len(raws))
+	for i, arg := range flag.Args()[2:] {
+		if raws[i], err = parseArg(arg, *literal, *simple); err != nil {
+			fatal(fmt.Errorf("arg %d: %v", i+1, err))
+		}
+		if *byref {
+			args[i] = &raws[i]
+		} else {
+			args[i] = raws[i]
+		}
+	}
+	options := &hprose.InvokeOptions{ByRef: *byref, SimpleMode: *simple, ResultMode: resultMode}
+	var result []byte
+	if resultMode == hprose.Normal {
+		var raw hprose.RawMessage
+		err = <-invoker.InvokeContext(ctx, flag.Arg(1), args, options, &raw)
+		result = raw
+	} else {
+		err = <-invoker.InvokeContext(ctx, flag.Arg(1), args, options, &result)
+	}
+	if err != nil {
+		fatal(err)
+	}
+	if resultMode == hprose.Raw || resultMode == hprose.RawWithEndTag {
+		// the raw results hold the protocol tags, which JSON can't hold.
+		if *format == "json" {
+			*format = "dump"
+		}
+	}
+	if err = printValue(result, *format); err != nil {
+		fatal(err)
+	}
+	if *byref && resultMode < hprose.Raw {
+		for i, raw := range raws {
+			fmt.Printf("arg %d: ", i+1)
+			if err = printValue(raw, *format); err != nil {
+				fatal(err)
+			}
+		}
+	}
+}
+
+// newClient returns the client of uri, or an error for the schemes which
+// are not supported.
+func newClient(uri string) (client hprose.Client, err error) {
+	defer func() {
+		if e := recover(); e != nil {
+			err = fmt.Errorf("%v", e)
+		}
+	}()
+	return hprose.NewClient(uri), nil
+}
+
+func parseArg(arg string, literal bool, simple bool) (hprose.RawMessage, error) {
+	if literal {
+		if _, err := hprose.UnserializeValue([]byte(arg)); err != nil {
+			return nil, err
+		}
+		return hprose.RawMessage(arg), nil
+	}
+	if json.Valid([]byte(arg)) {
+		data, err := hprose.JSONToHprose([]byte(arg), simple)
+		return hprose.RawMessage(data), err
+	}
+	data, err := hprose.Serialize(arg, true)
+	return hprose.RawMessage(data), err
+}
+
+func printValue(data []byte, format string) (err error) {
+	switch format {
+	case "json":
+		if data, err = hprose.HproseToJSON(data, true); err == nil {
+			_, err = fmt.Printf("%s\n", data)
+		}
+	case "dump":
+		err = hprose.Dump(os.Stdout, data)
+	default:
+		_, err = fmt.Printf("%s\n", data)
+	}
+	return err
+}
+
+func fatal(err error) {
+	fmt.Fprintln(os.Stderr, "hprose:", err)
+	os.Exit(1)
+}
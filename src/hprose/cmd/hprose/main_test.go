@@ -0,0 +1,104 @@
+/**********************************************************\
+|                                                          |
+|                          hprose                          |
+|                                                          |
+| Official WebSite: http://www.hprose.com/                 |
+|                   http://www.hprose.net/                 |
+|                   http://www.hprose.org/                 |
+|                                                          |
+\**********************************************************/
+/**********************************************************\
+ *                                                        *
+ * hprose/cmd/hprose/main_test.go                         *
+ *                                                        *
+ * hprose command line tool test for Go.                  *
+ *                                                        *
+\**********************************************************/
+
+package main
+
+import (
+	"bytes"
+	"hprose"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+)
+
+// TestMain runs the command instead of the tests when the test binary is
+// started by runCommand.
+func TestMain(m *testing.M) {
+	if os.Getenv("HPROSE_COMMAND_TEST") == "1" {
+		os.Args = append([]string{"hprose"}, os.Args[1:]...)
+		main()
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+func runCommand(t *testing.T, args ...string) (stdout string, stderr string, err error) {
+	cmd := exec.Command(os.Args[0], args...)
+	cmd.Env = append(os.Environ(), "HPROSE_COMMAND_TEST=1")
+	var out, errOut bytes.Buffer
+	cmd.Stdout = &out
+	cmd.Stderr = &errOut
+	err = cmd.Run()
+	return out.String(), errOut.String(), err
+}
+
+func TestParseArg(t *testing.T) {
+	tests := []struct {
+		arg     string
+		literal bool
+		simple  bool
+		data    string
+	}{
+		{`["ab","ab"]`, false, false, `a2{s2"ab"s2"ab"}`},
+		{`["ab","ab"]`, false, true, `a2{s2"ab"s2"ab"}`},
+		{`hello`, false, false, `s5"hello"`},
+		{`s2"ab"`, true, false, `s2"ab"`},
+	}
+	for _, test := range tests {
+		data, err := parseArg(test.arg, test.literal, test.simple)
+		if err != nil || string(data) != test.data {
+			t.Error(test.arg, string(data), err)
+		}
+	}
+	if _, err := parseArg(`a1{`, true, false); err == nil {
+		t.Error("parseArg accepts a bad hprose value")
+	}
+}
+
+func TestCommand(t *testing.T) {
+	service := hprose.NewHttpService()
+	service.AddFunction("hello", func(name string) string {
+		return "Hello " + name + "!"
+	})
+	service.AddFunction("swap", func(a, b []string) ([]string, []string) {
+		return b, a
+	})
+	server := httptest.NewServer(service)
+	defer server.Close()
+	stdout, stderr, err := runCommand(t, server.URL)
+	if err != nil || !strings.Contains(stdout, "hello\n") || !strings.Contains(stdout, "swap\n") {
+		t.Error(stdout, stderr, err)
+	}
+	stdout, stderr, err = runCommand(t, server.URL, "hello", "World")
+	if err != nil || stdout != "\"Hello World!\"\n" {
+		t.Error(stdout, stderr, err)
+	}
+	stdout, stderr, err = runCommand(t, "-simple", server.URL, "swap", `["a"]`, `["b","b"]`)
+	if err != nil || stdout != "[[\"b\",\"b\"],[\"a\"]]\n" {
+		t.Error(stdout, stderr, err)
+	}
+	stdout, stderr, err = runCommand(t, "-format", "hprose", "-byref", server.URL, "hello", "World")
+	if err != nil || stdout != "s12\"Hello World!\"\narg 1: s5\"World\"\n" {
+		t.Error(stdout, stderr, err)
+	}
+	stdout, stderr, err = runCommand(t, server.URL, "missing")
+	if err == nil || !strings.HasPrefix(stderr, "hprose: ") {
+		t.Error(stdout, stderr, err)
+	}
+}
@@ -0,0 +1,406 @@
+/**********************************************************\
+|                                                          |
+|                          hprose                          |
+|                                                          |
+| Official WebSite: http://www.hprose.com/                 |
+|                   http://www.hprose.net/                 |
+|                   http://www.hprose.org/                 |
+|                                                          |
+\**********************************************************/
+/**********************************************************\
+ *                                                        *
+ * hprose/decoder.go                                      *
+ *                                                        *
+ * hprose Decoder for Go.                                 *
+ *                                                        *
+\**********************************************************/
+
+package hprose
+
+import (
+	"errors"
+	"io"
+	"math"
+	"strconv"
+)
+
+// TokenKind identifies the kind of a Token.
+type TokenKind int
+
+const (
+	NullToken TokenKind = iota
+	BoolToken
+	IntToken
+	LongToken
+	DoubleToken
+	DateToken
+	BytesToken
+	StringToken
+	GuidToken
+	ListToken
+	MapToken
+	ClassToken
+	ObjectToken
+	RefToken
+	EndToken
+	CallToken
+	ResultToken
+	ArgumentToken
+	ErrorToken
+	FunctionsToken
+	MessageEndToken
+)
+
+var tokenKindNames = [...]string{
+	NullToken:       "null",
+	BoolToken:       "bool",
+	IntToken:        "int",
+	LongToken:       "long",
+	DoubleToken:     "double",
+	DateToken:       "date",
+	BytesToken:      "bytes",
+	StringToken:     "string",
+	GuidToken:       "guid",
+	ListToken:       "list",
+	MapToken:        "map",
+	ClassToken:      "class",
+	ObjectToken:     "object",
+	RefToken:        "ref",
+	EndToken:        "end",
+	CallToken:       "call",
+	ResultToken:     "result",
+	ArgumentToken:   "argument",
+	ErrorToken:      "error",
+	FunctionsToken:  "functions",
+	MessageEndToken: "message end",
+}
+
+func (kind TokenKind) String() string {
+	if kind >= 0 && int(kind) < len(tokenKindNames) {
+		return tokenKindNames[kind]
+	}
+	return "TokenKind(" + strconv.Itoa(int(kind)) + ")"
+}
+
+// Token is an element of a hprose stream returned by Decoder.Token.
+//
+// Value holds a bool for BoolToken, an int64 for IntToken, a *big.Int for
+// LongToken, a float64 for DoubleToken, a time.Time for DateToken, a []byte
+// for BytesToken, a string for StringToken and a uuid.UUID for GuidToken.
+//
+// ListToken, MapToken and ObjectToken start a collection, which is followed
+// by Count elements (Count pairs of key and value for a map) and an
+// EndToken. ClassToken defines the Class and its Fields used by the next
+// objects, and is not a value itself. ObjectToken has the Class and Fields
+// of its class.
+//
+// Ref is the index of the referenced value for RefToken, the index the
+// value is registered with for the values which can be referenced, and -1
+// for the others.
+type Token struct {
+	Kind   TokenKind
+	Value  interface{}
+	Count  int
+	Class  string
+	Fields []string
+	Ref    int
+}
+
+type decoderClass struct {
+	name   string
+	fields []string
+}
+
+// Decoder reads a hprose stream token by token, without building the
+// values it contains.
+type Decoder struct {
+	r         *reader
+	remaining []int
+	classes   []decoderClass
+	refs      int
+	values    []Value
+	call      bool
+}
+
+var badEndError = errors.New("no value before the end of the collection")
+
+func NewDecoder(stream BufReader) *Decoder {
+	return &Decoder{
+		r: &reader{
+			RawReader:   &RawReader{stream: stream},
+			readerRefer: fakeReaderRefer{},
+		},
+	}
+}
+
+// SetLimits sets the limits checked while decoding.
+func (d *Decoder) SetLimits(limits ReaderLimits) {
+	d.r.SetLimits(limits)
+}
+
+// Reset forgets the classes and references read before, like Reader.Reset.
+// It is called automatically when a protocol tag is read.
+func (d *Decoder) Reset() {
+	d.classes = nil
+	d.refs = 0
+	d.values = nil
+}
+
+// Depth returns the number of the collections which are not ended.
+func (d *Decoder) Depth() int {
+	return len(d.remaining)
+}
+
+// More reports whether the current collection has more elements. At the
+// top level it always returns true.
+func (d *Decoder) More() bool {
+	n := len(d.remaining)
+	return n == 0 || d.remaining[n-1] > 0
+}
+
+// Token returns the next token in the stream. At the end of the stream it
+// returns io.EOF, and io.ErrUnexpectedEOF if the stream ends inside a value
+// or a collection.
+func (d *Decoder) Token() (token Token, err error) {
+	token.Ref = -1
+	n := len(d.remaining)
+	if n > 0 && d.remaining[n-1] == 0 {
+		if err = d.r.CheckTag(TagClosebrace); err == nil {
+			d.remaining = d.remaining[:n-1]
+			d.r.leave()
+			token.Kind = EndToken
+		}
+		return token, d.unexpectedEOF(err)
+	}
+	tag, err := d.r.stream.ReadByte()
+	if err != nil {
+		return token, d.unexpectedEOF(err)
+	}
+	if tag == TagClass {
+		err = d.readClass(&token)
+	} else {
+		err = d.readToken(tag, &token)
+	}
+	if err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return Token{Ref: -1}, err
+	}
+	if tag == TagClass {
+		return token, nil
+	}
+	switch token.Kind {
+	case CallToken, ResultToken, ArgumentToken, ErrorToken, FunctionsToken, MessageEndToken:
+		if n > 0 {
+			return token, unexpectedTag(tag, nil)
+		}
+		d.Reset()
+		d.call = token.Kind == CallToken
+		return token, nil
+	}
+	if n > 0 {
+		d.remaining[n-1]--
+	}
+	switch token.Kind {
+	case ListToken, MapToken, ObjectToken:
+		if err = d.r.enter(); err != nil {
+			return token, err
+		}
+		count := token.Count
+		if token.Kind == MapToken {
+			count *= 2
+		}
+		d.remaining = append(d.remaining, count)
+	}
+	if d.call && len(d.remaining) == 0 {
+		// the name of the function is followed by its arguments, which
+		// are read with a new reference table.
+		d.Reset()
+		d.call = false
+	}
+	return token, nil
+}
+
+// Skip reads and drops the next value, including all the elements of a
+// list, a map or an object.
+func (d *Decoder) Skip() error {
+	if !d.More() {
+		return badEndError
+	}
+	depth := len(d.remaining)
+	for {
+		token, err := d.Token()
+		if err != nil {
+			return err
+		}
+		if token.Kind != ClassToken && len(d.remaining) == depth {
+			return nil
+		}
+	}
+}
+
+func (d *Decoder) unexpectedEOF(err error) error {
+	if err == io.EOF && len(d.remaining) > 0 {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+func (d *Decoder) addRef() (int, error) {
+	if max := d.r.limits.MaxRefs; max > 0 && d.refs >= max {
+		return -1, &LimitError{RefsLimit, d.refs + 1, max}
+	}
+	d.refs++
+	return d.refs - 1, nil
+}
+
+func (d *Decoder) setRef(token *Token) (err error) {
+	token.Ref, err = d.addRef()
+	return err
+}
+
+// readFieldName reads a field name of a class, which is registered as a
+// reference like the other strings.
+func (d *Decoder) readFieldName() (name string, err error) {
+	r := d.r
+	tag, err := r.stream.ReadByte()
+	if err != nil {
+		return "", err
+	}
+	switch tag {
+	case TagEmpty:
+		return "", nil
+	case TagUTF8Char:
+		return r.readUTF8String(1)
+	case TagString:
+		if name, err = r.ReadStringWithoutTag(); err == nil {
+			_, err = d.addRef()
+		}
+		return name, err
+	}
+	return "", unexpectedTag(tag, []byte{TagString})
+}
+
+func (d *Decoder) readClass(token *Token) (err error) {
+	r := d.r
+	token.Kind = ClassToken
+	if token.Class, err = r.readStringWithoutTag(); err != nil {
+		return err
+	}
+	if token.Count, err = r.readCount(); err != nil {
+		return err
+	}
+	token.Fields = make([]string, token.Count)
+	for i := range token.Fields {
+		if token.Fields[i], err = d.readFieldName(); err != nil {
+			return err
+		}
+	}
+	if err = r.CheckTag(TagClosebrace); err == nil {
+		d.classes = append(d.classes, decoderClass{token.Class, token.Fields})
+	}
+	return err
+}
+
+func (d *Decoder) readToken(tag byte, token *Token) (err error) {
+	r := d.r
+	switch tag {
+	case '0', '1', '2', '3', '4', '5', '6', '7', '8', '9':
+		token.Kind, token.Value = IntToken, int64(tag-'0')
+	case TagInteger:
+		token.Kind = IntToken
+		token.Value, err = r.ReadInt64WithoutTag()
+	case TagLong:
+		token.Kind = LongToken
+		token.Value, err = r.ReadBigIntWithoutTag()
+	case TagDouble:
+		token.Kind = DoubleToken
+		token.Value, err = r.ReadFloat64WithoutTag()
+	case TagNaN:
+		token.Kind, token.Value = DoubleToken, math.NaN()
+	case TagInfinity:
+		token.Kind = DoubleToken
+		token.Value, err = r.readInfinity()
+	case TagNull:
+		token.Kind = NullToken
+	case TagTrue, TagFalse:
+		token.Kind, token.Value = BoolToken, tag == TagTrue
+	case TagEmpty:
+		token.Kind, token.Value = StringToken, ""
+	case TagUTF8Char:
+		token.Kind = StringToken
+		token.Value, err = r.readUTF8String(1)
+	case TagString:
+		token.Kind = StringToken
+		if token.Value, err = r.ReadStringWithoutTag(); err == nil {
+			err = d.setRef(token)
+		}
+	case TagBytes:
+		token.Kind = BytesToken
+		var b *[]byte
+		if b, err = r.ReadBytesWithoutTag(); err == nil {
+			token.Value = *b
+			err = d.setRef(token)
+		}
+	case TagDate, TagTime:
+		token.Kind = DateToken
+		if tag == TagDate {
+			token.Value, err = r.ReadDateWithoutTag()
+		} else {
+			token.Value, err = r.ReadTimeWithoutTag()
+		}
+		if err == nil {
+			err = d.setRef(token)
+		}
+	case TagGuid:
+		token.Kind = GuidToken
+		u, e := r.ReadUUIDWithoutTag()
+		if err = e; err == nil {
+			token.Value = *u
+			err = d.setRef(token)
+		}
+	case TagRef:
+		token.Kind = RefToken
+		if token.Ref, err = r.ReadInteger(TagSemicolon); err == nil {
+			if token.Ref < 0 || token.Ref >= d.refs {
+				err = badRefError
+			}
+		}
+	case TagList, TagMap:
+		token.Kind = ListToken
+		if tag == TagMap {
+			token.Kind = MapToken
+		}
+		if token.Count, err = r.readCount(); err == nil {
+			err = d.setRef(token)
+		}
+	case TagObject:
+		token.Kind = ObjectToken
+		var index int
+		if index, err = r.ReadInteger(TagOpenbrace); err != nil {
+			return err
+		}
+		if index < 0 || index >= len(d.classes) {
+			return badClassError
+		}
+		class := d.classes[index]
+		token.Class, token.Fields, token.Count = class.name, class.fields, len(class.fields)
+		err = d.setRef(token)
+	case TagCall:
+		token.Kind = CallToken
+	case TagResult:
+		token.Kind = ResultToken
+	case TagArgument:
+		token.Kind = ArgumentToken
+	case TagError:
+		token.Kind = ErrorToken
+	case TagFunctions:
+		token.Kind = FunctionsToken
+	case TagEnd:
+		token.Kind = MessageEndToken
+	default:
+		err = unexpectedTag(tag, nil)
+	}
+	return err
+}
@@ -0,0 +1,189 @@
+/**********************************************************\
+|                                                          |
+|                          hprose                          |
+|                                                          |
+| Official WebSite: http://www.hprose.com/                 |
+|                   http://www.hprose.net/                 |
+|                   http://www.hprose.org/                 |
+|                                                          |
+\**********************************************************/
+/**********************************************************\
+ *                                                        *
+ * hprose/decoder_test.go                                 *
+ *                                                        *
+ * hprose Decoder Test for Go.                            *
+ *                                                        *
+\**********************************************************/
+
+package hprose_test
+
+import (
+	"bytes"
+	. "hprose"
+	"io"
+	"reflect"
+	"testing"
+)
+
+func decodeTokens(t *testing.T, d *Decoder) []Token {
+	var tokens []Token
+	for {
+		token, err := d.Token()
+		if err == io.EOF {
+			return tokens
+		}
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		tokens = append(tokens, token)
+	}
+}
+
+func TestDecoderToken(t *testing.T) {
+	d := NewDecoder(NewBufReader([]byte(`a4{1s5"hello"r1;m1{ud2}}`)))
+	tokens := decodeTokens(t, d)
+	expected := []Token{
+		{Kind: ListToken, Count: 4, Ref: 0},
+		{Kind: IntToken, Value: int64(1), Ref: -1},
+		{Kind: StringToken, Value: "hello", Ref: 1},
+		{Kind: RefToken, Ref: 1},
+		{Kind: MapToken, Count: 1, Ref: 2},
+		{Kind: StringToken, Value: "d", Ref: -1},
+		{Kind: IntToken, Value: int64(2), Ref: -1},
+		{Kind: EndToken, Ref: -1},
+		{Kind: EndToken, Ref: -1},
+	}
+	if len(tokens) != len(expected) {
+		t.Fatal(tokens)
+	}
+	for i, token := range tokens {
+		if !reflect.DeepEqual(token, expected[i]) {
+			t.Errorf("token %d: %v, expected %v", i, token, expected[i])
+		}
+	}
+}
+
+func TestDecoderObject(t *testing.T) {
+	b := new(bytes.Buffer)
+	writer := NewWriter(b)
+	if err := writer.Serialize([]testTaggedUser{{"Tom", ""}, {"Tom", ""}}); err != nil {
+		t.Fatal(err.Error())
+	}
+	d := NewDecoder(NewBufReader(b.Bytes()))
+	var kinds []TokenKind
+	var refs []int
+	for _, token := range decodeTokens(t, d) {
+		kinds = append(kinds, token.Kind)
+		refs = append(refs, token.Ref)
+		switch token.Kind {
+		case ClassToken:
+			if token.Class != "testTaggedUser" || !reflect.DeepEqual(token.Fields, []string{"user_name"}) {
+				t.Error(token)
+			}
+		case ObjectToken:
+			if token.Class != "testTaggedUser" || token.Count != 1 {
+				t.Error(token)
+			}
+		case StringToken:
+			if token.Value != "Tom" {
+				t.Error(token)
+			}
+		}
+	}
+	expected := []TokenKind{ListToken, ClassToken, ObjectToken, StringToken, EndToken,
+		ObjectToken, RefToken, EndToken, EndToken}
+	if !reflect.DeepEqual(kinds, expected) {
+		t.Error(kinds)
+	}
+	if !reflect.DeepEqual(refs, []int{0, -1, 2, 3, -1, 4, 3, -1, -1}) {
+		t.Error(refs)
+	}
+}
+
+func TestDecoderSkip(t *testing.T) {
+	d := NewDecoder(NewBufReader([]byte(`m2{s1"a"a2{1m1{23}}s1"b"i5;}`)))
+	if token, err := d.Token(); err != nil || token.Kind != MapToken {
+		t.Fatal(token, err)
+	}
+	values := map[string]interface{}{}
+	for d.More() {
+		key, err := d.Token()
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if key.Value == "a" {
+			if err = d.Skip(); err != nil {
+				t.Fatal(err.Error())
+			}
+			continue
+		}
+		value, err := d.Token()
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		values[key.Value.(string)] = value.Value
+	}
+	if err := d.Skip(); err == nil {
+		t.Error("Skip should fail at the end of the map")
+	}
+	if token, err := d.Token(); err != nil || token.Kind != EndToken {
+		t.Error(token, err)
+	}
+	if len(values) != 1 || values["b"] != int64(5) {
+		t.Error(values)
+	}
+	if _, err := d.Token(); err != io.EOF {
+		t.Error(err)
+	}
+}
+
+func TestDecoderMessage(t *testing.T) {
+	d := NewDecoder(NewBufReader([]byte(`Cs5"hello"a1{s5"World"}tz`)))
+	tokens := decodeTokens(t, d)
+	kinds := make([]TokenKind, len(tokens))
+	for i, token := range tokens {
+		kinds[i] = token.Kind
+	}
+	expected := []TokenKind{CallToken, StringToken, ListToken, StringToken,
+		EndToken, BoolToken, MessageEndToken}
+	if !reflect.DeepEqual(kinds, expected) {
+		t.Error(kinds)
+	}
+	if tokens[2].Ref != 0 || tokens[3].Ref != 1 {
+		t.Error(tokens[2], tokens[3])
+	}
+}
+
+func TestDecoderErrors(t *testing.T) {
+	d := NewDecoder(NewBufReader([]byte(`a1{a1{a1{}}}`)))
+	d.SetLimits(ReaderLimits{MaxDepth: 2})
+	var err error
+	for err == nil {
+		_, err = d.Token()
+	}
+	checkLimitError(t, err, DepthLimit)
+	d = NewDecoder(NewBufReader([]byte(`a2{1`)))
+	for err = nil; err == nil; _, err = d.Token() {
+	}
+	if err != io.ErrUnexpectedEOF {
+		t.Error(err)
+	}
+	d = NewDecoder(NewBufReader([]byte(`r0;`)))
+	if _, err = d.Token(); err == nil {
+		t.Error("expected bad reference index")
+	}
+	for _, data := range []string{`s5"hel`, `s999999999"x"`, `b10"abc`, `i12`} {
+		d = NewDecoder(NewBufReader([]byte(data)))
+		token, err := d.Token()
+		if err != io.ErrUnexpectedEOF {
+			t.Errorf("%s: expected io.ErrUnexpectedEOF, got %v", data, err)
+		}
+		if token.Kind != NullToken {
+			t.Errorf("%s: expected a null token, got %v", data, token.Kind)
+		}
+	}
+	d = NewDecoder(NewBufReader(nil))
+	if _, err = d.Token(); err != io.EOF {
+		t.Errorf("expected io.EOF, got %v", err)
+	}
+}
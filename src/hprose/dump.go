@@ -0,0 +1,419 @@
+/**********************************************************\
+|                                                          |
+|                          hprose                          |
+|                                                          |
+| Official WebSite: http://www.hprose.com/                 |
+|                   http://www.hprose.net/                 |
+|                   http://www.hprose.org/                 |
+|                                                          |
+\**********************************************************/
+/**********************************************************\
+ *                                                        *
+ * hprose/dump.go                                         *
+ *                                                        *
+ * hprose Dump for Go.                                    *
+ *                                                        *
+\**********************************************************/
+
+package hprose
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+var protocolTags = map[TokenKind]byte{
+	CallToken:       TagCall,
+	ResultToken:     TagResult,
+	ArgumentToken:   TagArgument,
+	ErrorToken:      TagError,
+	FunctionsToken:  TagFunctions,
+	MessageEndToken: TagEnd,
+}
+
+// Dump writes an indented view of the hprose stream in data to w, one
+// element per line. The protocol tags are written with their names, the
+// classes with their indexes, and the values which can be referenced with
+// their reference numbers after a '#'. The references show the number and
+// the value they refer to:
+//
+//	C call
+//	  "hello" #0
+//	  list(2) #0 {
+//	    "World" #1
+//	    ref #1 -> "World"
+//	  }
+//	z message end
+//
+// When the stream is malformed or truncated, Dump returns the error after
+// writing the elements before it.
+func Dump(w io.Writer, data []byte) error {
+	decoder := NewDecoder(NewBufReader(data))
+	d := &dumper{w: w}
+	var frames []dumpFrame
+	var refs []string
+	base := 0
+	for {
+		before := decoder.refs
+		token, err := decoder.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			d.end()
+			return err
+		}
+		depth := base + len(frames)
+		var text string
+		switch token.Kind {
+		case CallToken, ResultToken, ArgumentToken, ErrorToken, FunctionsToken, MessageEndToken:
+			d.line(0, string(protocolTags[token.Kind])+" "+token.Kind.String())
+			base = 1
+			if token.Kind == MessageEndToken {
+				base = 0
+			}
+			continue
+		case ClassToken:
+			index := strconv.Itoa(len(decoder.classes) - 1)
+			d.line(depth, "class #"+index+" "+token.Class+" ("+strings.Join(token.Fields, ", ")+")")
+			// the field names are referenced like the other strings.
+			if decoder.refs-before == len(token.Fields) {
+				for i, name := range token.Fields {
+					refs = setRefText(refs, before+i, strconv.Quote(name))
+				}
+			}
+			continue
+		case EndToken:
+			frame := frames[len(frames)-1]
+			frames = frames[:len(frames)-1]
+			if !frame.empty {
+				d.line(depth-1, "}")
+			}
+			nextElement(frames)
+			continue
+		case RefToken:
+			text = "ref #" + strconv.Itoa(token.Ref) + " -> "
+			if token.Ref < len(refs) {
+				text += refs[token.Ref]
+			}
+		case ListToken:
+			text = "list(" + strconv.Itoa(token.Count) + ")"
+		case MapToken:
+			text = "map(" + strconv.Itoa(token.Count) + ")"
+		case ObjectToken:
+			text = "object " + token.Class
+		default:
+			text = valueText(scalarValue(token))
+		}
+		if token.Ref >= 0 && token.Kind != RefToken {
+			refs = setRefText(refs, token.Ref, text)
+			text += " #" + strconv.Itoa(token.Ref)
+		}
+		prefix := ""
+		var parent *dumpFrame
+		if n := len(frames); n > 0 {
+			parent = &frames[n-1]
+			prefix = parent.prefix()
+		}
+		switch token.Kind {
+		case ListToken, MapToken, ObjectToken:
+			if parent != nil && parent.isKey() {
+				parent.key = ": "
+			}
+			frame := dumpFrame{kind: token.Kind, fields: token.Fields, empty: token.Count == 0}
+			if frame.empty {
+				d.line(depth, prefix+text+" {}")
+			} else {
+				d.line(depth, prefix+text+" {")
+			}
+			frames = append(frames, frame)
+			continue
+		}
+		if parent != nil && parent.isKey() {
+			parent.key = text + ": "
+		} else {
+			d.line(depth, prefix+text)
+		}
+		nextElement(frames)
+	}
+	return d.end()
+}
+
+// dumpFrame is a collection being dumped.
+type dumpFrame struct {
+	kind   TokenKind
+	fields []string
+	n      int
+	key    string
+	empty  bool
+}
+
+func (f *dumpFrame) isKey() bool {
+	return f.kind == MapToken && f.n%2 == 0
+}
+
+// prefix returns the text written before the next element, which is the
+// name of an object field or the key of a map value.
+func (f *dumpFrame) prefix() string {
+	switch f.kind {
+	case ObjectToken:
+		return f.fields[f.n] + ": "
+	case MapToken:
+		if f.n%2 == 1 {
+			return f.key
+		}
+	}
+	return ""
+}
+
+func nextElement(frames []dumpFrame) {
+	if n := len(frames); n > 0 {
+		frames[n-1].n++
+	}
+}
+
+func setRefText(refs []string, ref int, text string) []string {
+	for len(refs) <= ref {
+		refs = append(refs, "")
+	}
+	refs[ref] = text
+	return refs
+}
+
+// dumper writes the indented lines of a dump.
+type dumper struct {
+	w     io.Writer
+	lines int
+	err   error
+}
+
+func (d *dumper) line(depth int, text string) {
+	if d.err != nil {
+		return
+	}
+	if d.lines > 0 {
+		text = "\n" + strings.Repeat("  ", depth) + text
+	} else {
+		text = strings.Repeat("  ", depth) + text
+	}
+	d.lines++
+	_, d.err = io.WriteString(d.w, text)
+}
+
+func (d *dumper) end() error {
+	if d.err == nil && d.lines > 0 {
+		_, d.err = io.WriteString(d.w, "\n")
+	}
+	return d.err
+}
+
+// valueText returns the text of a value in a dump. The collections are
+// written with their sizes or classes only.
+func valueText(v Value) string {
+	switch v := v.(type) {
+	case nil, Null:
+		return "null"
+	case Bool:
+		return strconv.FormatBool(bool(v))
+	case Int:
+		return strconv.FormatInt(int64(v), 10)
+	case BigInt:
+		if v.Value == nil {
+			return "null"
+		}
+		return "long " + v.Value.String()
+	case Double:
+		return "double " + strconv.FormatFloat(float64(v), 'g', -1, 64)
+	case *String:
+		return strconv.Quote(v.Value)
+	case *Bytes:
+		return "b" + strconv.Quote(string(v.Value))
+	case *Date:
+		return "date " + v.Value.Format(time.RFC3339Nano)
+	case *Guid:
+		return "guid " + v.Value.String()
+	case *List:
+		return "list(" + strconv.Itoa(len(v.Items)) + ")"
+	case *Map:
+		return "map(" + strconv.Itoa(len(v.Entries)) + ")"
+	case *Object:
+		return "object " + v.Class
+	case Ref:
+		return "ref -> " + valueText(v.Target)
+	}
+	return v.Kind().String()
+}
+
+// shortString reports whether s is written without a reference, as an
+// empty string or a single character.
+func shortString(s string) bool {
+	length := len(s)
+	return length == 0 || length < utf8.UTFMax && utf8.RuneCountInString(s) == 1
+}
+
+func (v Null) Format(s fmt.State, verb rune)   { formatValue(s, verb, v, nil) }
+func (v Bool) Format(s fmt.State, verb rune)   { formatValue(s, verb, v, bool(v)) }
+func (v Int) Format(s fmt.State, verb rune)    { formatValue(s, verb, v, int64(v)) }
+func (v BigInt) Format(s fmt.State, verb rune) { formatValue(s, verb, v, v.Value) }
+func (v Double) Format(s fmt.State, verb rune) { formatValue(s, verb, v, float64(v)) }
+
+func (v *String) Format(s fmt.State, verb rune) { formatValue(s, verb, v, v.Value) }
+func (v *Bytes) Format(s fmt.State, verb rune)  { formatValue(s, verb, v, v.Value) }
+func (v *Date) Format(s fmt.State, verb rune)   { formatValue(s, verb, v, v.Value) }
+func (v *Guid) Format(s fmt.State, verb rune)   { formatValue(s, verb, v, v.Value) }
+
+func (v *List) Format(s fmt.State, verb rune) {
+	formatValue(s, verb, v, struct{ Items []Value }(*v))
+}
+
+func (v *Map) Format(s fmt.State, verb rune) {
+	formatValue(s, verb, v, struct{ Entries []MapEntry }(*v))
+}
+
+func (v *Object) Format(s fmt.State, verb rune) {
+	formatValue(s, verb, v, struct {
+		Class  string
+		Fields []ObjectField
+	}(*v))
+}
+
+func (v Ref) Format(s fmt.State, verb rune) {
+	formatValue(s, verb, v, struct{ Target Value }(v))
+}
+
+// formatValue writes the view of a Value tree like Dump for the %v, %+v and
+// %s verbs. The classes and the reference numbers are the ones the tree is
+// serialized with by a writer. The other verbs and %#v format underlying,
+// the Go value of the node.
+func formatValue(s fmt.State, verb rune, v Value, underlying interface{}) {
+	if (verb == 'v' && !s.Flag('#')) || verb == 's' {
+		f := &treeFormatter{dumper: dumper{w: s}, targets: refTargets(v)}
+		f.value(v, 0, "")
+		return
+	}
+	fmt.Fprintf(s, fmt.FormatString(s, verb), underlying)
+}
+
+type treeFormatter struct {
+	dumper
+	refs       map[Value]int
+	targets    map[*String]bool
+	count      int
+	names      map[string]int
+	classes    map[string][]string
+	classCount int
+}
+
+func (f *treeFormatter) setRef(v Value) string {
+	if f.refs == nil {
+		f.refs = make(map[Value]int)
+	}
+	f.refs[v] = f.count
+	f.count++
+	return " #" + strconv.Itoa(f.count-1)
+}
+
+// text returns the text of a value which is not a collection.
+func (f *treeFormatter) text(v Value) string {
+	text := valueText(v)
+	switch v := v.(type) {
+	case *String:
+		if !shortString(v.Value) || f.targets[v] {
+			text += f.setRef(v)
+		}
+	case *Bytes, *Date, *Guid:
+		text += f.setRef(v)
+	case Ref:
+		n, ok := f.refs[v.Target]
+		if s, isString := v.Target.(*String); !ok && isString {
+			n, ok = f.names[s.Value]
+		}
+		if ok {
+			text = "ref #" + strconv.Itoa(n) + " -> " + valueText(v.Target)
+		}
+	}
+	return text
+}
+
+func (f *treeFormatter) value(v Value, depth int, prefix string) {
+	switch v := v.(type) {
+	case *List:
+		f.begin(v, depth, prefix, len(v.Items))
+		for _, item := range v.Items {
+			f.value(item, depth+1, "")
+		}
+		f.close(depth, len(v.Items))
+	case *Map:
+		f.begin(v, depth, prefix, len(v.Entries))
+		for _, entry := range v.Entries {
+			switch entry.Key.(type) {
+			case *List, *Map, *Object:
+				f.value(entry.Key, depth+1, "")
+				f.value(entry.Value, depth+1, ": ")
+			default:
+				f.value(entry.Value, depth+1, f.text(entry.Key)+": ")
+			}
+		}
+		f.close(depth, len(v.Entries))
+	case *Object:
+		f.defineClass(v, depth)
+		f.begin(v, depth, prefix, len(v.Fields))
+		for _, field := range v.Fields {
+			f.value(field.Value, depth+1, field.Name+": ")
+		}
+		f.close(depth, len(v.Fields))
+	default:
+		f.line(depth, prefix+f.text(v))
+	}
+}
+
+func (f *treeFormatter) begin(v Value, depth int, prefix string, count int) {
+	text := prefix + valueText(v) + f.setRef(v)
+	if count == 0 {
+		f.line(depth, text+" {}")
+	} else {
+		f.line(depth, text+" {")
+	}
+}
+
+func (f *treeFormatter) close(depth int, count int) {
+	if count > 0 {
+		f.line(depth, "}")
+	}
+}
+
+// defineClass writes the class of o when a writer defines it, which is
+// when its name is not defined before with the same fields.
+func (f *treeFormatter) defineClass(o *Object, depth int) {
+	names := make([]string, len(o.Fields))
+	for i, field := range o.Fields {
+		names[i] = field.Name
+	}
+	if fields, ok := f.classes[o.Class]; ok && len(fields) == len(names) {
+		same := true
+		for i, name := range fields {
+			same = same && name == names[i]
+		}
+		if same {
+			return
+		}
+	}
+	if f.classes == nil {
+		f.classes = make(map[string][]string)
+	}
+	f.classes[o.Class] = names
+	f.line(depth, "class #"+strconv.Itoa(f.classCount)+" "+o.Class+" ("+strings.Join(names, ", ")+")")
+	f.classCount++
+	// the field names are referenced like the other strings.
+	if f.names == nil {
+		f.names = make(map[string]int)
+	}
+	for _, name := range names {
+		f.names[name] = f.count
+		f.count++
+	}
+}
@@ -0,0 +1,165 @@
+/**********************************************************\
+|                                                          |
+|                          hprose                          |
+|                                                          |
+| Official WebSite: http://www.hprose.com/                 |
+|                   http://www.hprose.net/                 |
+|                   http://www.hprose.org/                 |
+|                                                          |
+\**********************************************************/
+/**********************************************************\
+ *                                                        *
+ * hprose/dump_test.go                                    *
+ *                                                        *
+ * hprose Dump Test for Go.                               *
+ *                                                        *
+\**********************************************************/
+
+package hprose_test
+
+import (
+	"bytes"
+	"fmt"
+	. "hprose"
+	"io"
+	"math/big"
+	"testing"
+)
+
+func TestDump(t *testing.T) {
+	buf := new(bytes.Buffer)
+	if err := Dump(buf, []byte(`Cs5"hello"a2{s5"World"r1;}zRez`)); err != nil {
+		t.Fatal(err.Error())
+	}
+	s := `C call
+  "hello" #0
+  list(2) #0 {
+    "World" #1
+    ref #1 -> "World"
+  }
+z message end
+R result
+  ""
+z message end
+`
+	if buf.String() != s {
+		t.Error(buf.String())
+	}
+}
+
+const testDumpObject = `a3{c14"testTaggedUser"1{s9"user_name"}o0{s3"Tom"}m1{r1;a{}}r3;}`
+
+func TestDumpObject(t *testing.T) {
+	buf := new(bytes.Buffer)
+	if err := Dump(buf, []byte("R"+testDumpObject+"z")); err != nil {
+		t.Fatal(err.Error())
+	}
+	s := `R result
+  list(3) #0 {
+    class #0 testTaggedUser (user_name)
+    object testTaggedUser #2 {
+      user_name: "Tom" #3
+    }
+    map(1) #4 {
+      ref #1 -> "user_name": list(0) #5 {}
+    }
+    ref #3 -> "Tom"
+  }
+z message end
+`
+	if buf.String() != s {
+		t.Error(buf.String())
+	}
+}
+
+func TestDumpError(t *testing.T) {
+	buf := new(bytes.Buffer)
+	if err := Dump(buf, []byte(`a2{1x`)); err == nil {
+		t.Error("a malformed stream should fail")
+	}
+	if buf.String() != "list(2) #0 {\n  1\n" {
+		t.Error(buf.String())
+	}
+	buf.Reset()
+	if err := Dump(buf, []byte(`Rs999999999"x"z`)); err != io.ErrUnexpectedEOF {
+		t.Error(err)
+	}
+	if buf.String() != "R result\n" {
+		t.Error(buf.String())
+	}
+}
+
+func TestValueFormat(t *testing.T) {
+	v, err := UnserializeValue([]byte(testDumpObject))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	s := `list(3) #0 {
+  class #0 testTaggedUser (user_name)
+  object testTaggedUser #2 {
+    user_name: "Tom" #3
+  }
+  map(1) #4 {
+    ref #1 -> "user_name": list(0) #5 {}
+  }
+  ref #3 -> "Tom"
+}`
+	if result := fmt.Sprint(v); result != s {
+		t.Error(result)
+	}
+	if data, err := Serialize(v, false); err != nil || string(data) != testDumpObject {
+		t.Error(string(data), err)
+	}
+	if result := fmt.Sprintf("%v", Int(12)); result != "12" {
+		t.Error(result)
+	}
+}
+
+func TestValueFormatShortString(t *testing.T) {
+	data := `a3{s1"a"r1;u"}`
+	v, err := UnserializeValue([]byte(data))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	s := `list(3) #0 {
+  "a" #1
+  ref #1 -> "a"
+  "\""
+}`
+	if result := fmt.Sprint(v); result != s {
+		t.Error(result)
+	}
+	buf := new(bytes.Buffer)
+	if err := Dump(buf, []byte(data)); err != nil || buf.String() != s+"\n" {
+		t.Error(buf.String(), err)
+	}
+	if data, err := Serialize(v, false); err != nil || string(data) != `a3{s1"a"r1;u"}` {
+		t.Error(string(data), err)
+	}
+}
+
+func TestValueFormatVerbs(t *testing.T) {
+	tests := []struct {
+		format string
+		value  Value
+		result string
+	}{
+		{"%s", Int(255), "255"},
+		{"%+v", Int(255), "255"},
+		{"%x", Int(255), "ff"},
+		{"%5d", Int(255), "  255"},
+		{"%#v", Int(255), "255"},
+		{"%t", Bool(true), "true"},
+		{"%.2f", Double(1.5), "1.50"},
+		{"%X", BigInt{big.NewInt(255)}, "FF"},
+		{"%q", &String{"abc"}, `"abc"`},
+		{"%x", &Bytes{[]byte{1, 2}}, "0102"},
+		{"%d", &List{[]Value{Int(1), Int(2)}}, "{[1 2]}"},
+		{"%x", Ref{&List{[]Value{Int(255)}}}, "{{[ff]}}"},
+	}
+	for _, test := range tests {
+		if result := fmt.Sprintf(test.format, test.value); result != test.result {
+			t.Error(test.format, result)
+		}
+	}
+}
@@ -0,0 +1,98 @@
+/**********************************************************\
+|                                                          |
+|                          hprose                          |
+|                                                          |
+| Official WebSite: http://www.hprose.com/                 |
+|                   http://www.hprose.net/                 |
+|                   http://www.hprose.org/                 |
+|                                                          |
+\**********************************************************/
+/**********************************************************\
+ *                                                        *
+ * hprose/duplex.go                                       *
+ *                                                        *
+ * hprose duplex calls for Go.                            *
+ *                                                        *
+\**********************************************************/
+
+package hprose
+
+import (
+	"context"
+	"sync"
+)
+
+// duplexCalls keeps the invokings waiting for their responses on a full
+// duplex connection, every invoking is identified by a request id.
+type duplexCalls struct {
+	mutex sync.Mutex
+	id    uint32
+	calls map[uint32]chan duplexResponse
+	err   error
+}
+
+type duplexResponse struct {
+	data []byte
+	err  error
+}
+
+func (c *duplexCalls) alive() bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.err == nil
+}
+
+func (c *duplexCalls) register() (id uint32, response chan duplexResponse, err error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.err != nil {
+		return 0, nil, c.err
+	}
+	if c.calls == nil {
+		c.calls = make(map[uint32]chan duplexResponse)
+	}
+	c.id++
+	response = make(chan duplexResponse, 1)
+	c.calls[c.id] = response
+	return c.id, response, nil
+}
+
+func (c *duplexCalls) unregister(id uint32) {
+	c.mutex.Lock()
+	delete(c.calls, id)
+	c.mutex.Unlock()
+}
+
+func (c *duplexCalls) dispatch(id uint32, response duplexResponse) {
+	c.mutex.Lock()
+	call, ok := c.calls[id]
+	delete(c.calls, id)
+	c.mutex.Unlock()
+	if ok {
+		call <- response
+	}
+}
+
+// fail is called when the connection is broken, all waiting invokings get
+// the error, and the later invokings can't be registered.
+func (c *duplexCalls) fail(err error) {
+	c.mutex.Lock()
+	c.err = err
+	for _, call := range c.calls {
+		call <- duplexResponse{err: err}
+	}
+	c.calls = nil
+	c.mutex.Unlock()
+}
+
+func waitResponse(ctx context.Context, response chan duplexResponse) (BufReader, error) {
+	select {
+	case r := <-response:
+		if r.err != nil {
+			return nil, r.err
+		}
+		return NewBufReader(r.data), nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
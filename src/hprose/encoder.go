@@ -0,0 +1,227 @@
+/**********************************************************\
+|                                                          |
+|                          hprose                          |
+|                                                          |
+| Official WebSite: http://www.hprose.com/                 |
+|                   http://www.hprose.net/                 |
+|                   http://www.hprose.org/                 |
+|                                                          |
+\**********************************************************/
+/**********************************************************\
+ *                                                        *
+ * hprose/encoder.go                                      *
+ *                                                        *
+ * hprose Encoder for Go.                                 *
+ *                                                        *
+\**********************************************************/
+
+package hprose
+
+import (
+	"errors"
+	"math/big"
+	"strconv"
+	"time"
+)
+
+// Encoder writes lists, maps and objects element by element, so they can
+// be streamed without being built in memory first. It shares the reference
+// and class tables with the writer it is created from, so the values
+// written by the Encoder and by the writer can be mixed freely.
+type Encoder struct {
+	w         *writer
+	remaining []int
+}
+
+var tooManyValuesError = errors.New("too many values in the collection")
+
+// NewEncoder returns an Encoder writing through w, which must be returned
+// by NewWriter or NewSimpleWriter.
+func NewEncoder(w Writer) *Encoder {
+	ew, ok := w.(*writer)
+	if !ok {
+		panic("NewEncoder needs a writer returned by NewWriter or NewSimpleWriter")
+	}
+	return &Encoder{w: ew}
+}
+
+// StreamFunc is a value serialized by calling itself with an Encoder. A
+// method of a service can return a StreamFunc to stream its result into
+// the response.
+type StreamFunc func(encoder *Encoder) error
+
+// MarshalHprose implements the HproseMarshaler interface. It fails if the
+// function returns before all the collections it begins are ended.
+func (f StreamFunc) MarshalHprose(writer Writer) error {
+	encoder := NewEncoder(writer)
+	if err := f(encoder); err != nil {
+		return err
+	}
+	if n := encoder.Depth(); n > 0 {
+		return errors.New(strconv.Itoa(n) + " collections are not ended")
+	}
+	return nil
+}
+
+// Depth returns the number of the collections which are not ended.
+func (e *Encoder) Depth() int {
+	return len(e.remaining)
+}
+
+// BeginList starts a list of count elements, which must be followed by
+// count values and End.
+func (e *Encoder) BeginList(count int) error {
+	return e.begin(TagList, count, count)
+}
+
+// BeginMap starts a map of count entries, which must be followed by count
+// pairs of key and value and End.
+func (e *Encoder) BeginMap(count int) error {
+	return e.begin(TagMap, count, count*2)
+}
+
+// BeginObject starts an object of class, which must be followed by the
+// values of its fields and End. The fields must be given the first time a
+// class is written, and can be omitted later. The structs serialized by
+// the writer define their classes too.
+func (e *Encoder) BeginObject(class string, fields ...string) (err error) {
+	w := e.w
+	if err = e.next(); err != nil {
+		return err
+	}
+	if w.classref == nil {
+		w.classref = make(map[string]int)
+		w.fieldsref = make([][]field, 0)
+	}
+	index, found := w.classref[class]
+	if found {
+		if len(fields) > 0 && !sameFieldNames(w.fieldsref[index], fields) {
+			return errors.New("the fields of class " + class + " are different from its definition")
+		}
+	} else {
+		if len(fields) == 0 {
+			return errors.New("the fields of class " + class + " are not defined")
+		}
+		f := make([]field, len(fields))
+		for i, name := range fields {
+			f[i].Name = name
+		}
+		if index, err = w.writeClass(class, f); err != nil {
+			return err
+		}
+	}
+	w.setRef(new(int))
+	s := w.stream
+	if err = s.WriteByte(TagObject); err == nil {
+		if err = w.writeInt(index); err == nil {
+			err = s.WriteByte(TagOpenbrace)
+		}
+	}
+	if err == nil {
+		e.remaining = append(e.remaining, len(w.fieldsref[index]))
+	}
+	return err
+}
+
+// End ends the current list, map or object.
+func (e *Encoder) End() error {
+	n := len(e.remaining)
+	if n == 0 {
+		return errors.New("no collection to end")
+	}
+	if r := e.remaining[n-1]; r > 0 {
+		return errors.New(strconv.Itoa(r) + " values missing before the end of the collection")
+	}
+	e.remaining = e.remaining[:n-1]
+	return e.w.stream.WriteByte(TagClosebrace)
+}
+
+// Encode writes v as the next value, like Writer.Serialize.
+func (e *Encoder) Encode(v interface{}) error {
+	if err := e.next(); err != nil {
+		return err
+	}
+	return e.w.Serialize(v)
+}
+
+func (e *Encoder) WriteNull() error {
+	return e.Encode(nil)
+}
+
+func (e *Encoder) WriteInt64(v int64) error {
+	return e.Encode(v)
+}
+
+func (e *Encoder) WriteUint64(v uint64) error {
+	return e.Encode(v)
+}
+
+func (e *Encoder) WriteBigInt(v *big.Int) error {
+	return e.Encode(v)
+}
+
+func (e *Encoder) WriteFloat64(v float64) error {
+	return e.Encode(v)
+}
+
+func (e *Encoder) WriteBool(v bool) error {
+	return e.Encode(v)
+}
+
+func (e *Encoder) WriteTime(v time.Time) error {
+	return e.Encode(v)
+}
+
+func (e *Encoder) WriteString(v string) error {
+	return e.Encode(v)
+}
+
+func (e *Encoder) WriteBytes(v []byte) error {
+	return e.Encode(v)
+}
+
+func (e *Encoder) next() error {
+	if n := len(e.remaining); n > 0 {
+		if e.remaining[n-1] == 0 {
+			return tooManyValuesError
+		}
+		e.remaining[n-1]--
+	}
+	return nil
+}
+
+func (e *Encoder) begin(tag byte, count int, values int) (err error) {
+	if count < 0 {
+		return errors.New("negative count " + strconv.Itoa(count))
+	}
+	if err = e.next(); err != nil {
+		return err
+	}
+	w := e.w
+	w.setRef(new(int))
+	s := w.stream
+	if err = s.WriteByte(tag); err == nil {
+		if count > 0 {
+			err = w.writeInt(count)
+		}
+		if err == nil {
+			err = s.WriteByte(TagOpenbrace)
+		}
+	}
+	if err == nil {
+		e.remaining = append(e.remaining, values)
+	}
+	return err
+}
+
+func sameFieldNames(fields []field, names []string) bool {
+	if len(fields) != len(names) {
+		return false
+	}
+	for i, f := range fields {
+		if f.Name != names[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,173 @@
+/**********************************************************\
+|                                                          |
+|                          hprose                          |
+|                                                          |
+| Official WebSite: http://www.hprose.com/                 |
+|                   http://www.hprose.net/                 |
+|                   http://www.hprose.org/                 |
+|                                                          |
+\**********************************************************/
+/**********************************************************\
+ *                                                        *
+ * hprose/encoder_test.go                                 *
+ *                                                        *
+ * hprose Encoder Test for Go.                            *
+ *                                                        *
+\**********************************************************/
+
+package hprose_test
+
+import (
+	"bytes"
+	. "hprose"
+	"strings"
+	"testing"
+)
+
+type testRows int
+
+func (n testRows) MarshalHprose(writer Writer) error {
+	encoder := NewEncoder(writer)
+	if err := encoder.BeginList(int(n)); err != nil {
+		return err
+	}
+	for i := 0; i < int(n); i++ {
+		if err := encoder.WriteInt64(int64(i)); err != nil {
+			return err
+		}
+	}
+	return encoder.End()
+}
+
+func TestEncoder(t *testing.T) {
+	b1 := new(bytes.Buffer)
+	writer := NewWriter(b1)
+	err := writer.Serialize([]interface{}{1, "hello", "hello", map[string]int{"a": 1}, testTaggedUser{"Tom", ""}})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	b2 := new(bytes.Buffer)
+	encoder := NewEncoder(NewWriter(b2))
+	for _, err = range []error{
+		encoder.BeginList(5),
+		encoder.WriteInt64(1),
+		encoder.WriteString("hello"),
+		encoder.WriteString("hello"),
+		encoder.BeginMap(1),
+		encoder.WriteString("a"),
+		encoder.WriteInt64(1),
+		encoder.End(),
+		encoder.BeginObject("testTaggedUser", "user_name"),
+		encoder.WriteString("Tom"),
+		encoder.End(),
+		encoder.End(),
+	} {
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	if b2.String() != b1.String() {
+		t.Error(b2.String())
+	}
+	if encoder.Depth() != 0 {
+		t.Error(encoder.Depth())
+	}
+}
+
+func TestEncoderSharedWriter(t *testing.T) {
+	b := new(bytes.Buffer)
+	writer := NewWriter(b)
+	encoder := NewEncoder(writer)
+	if err := writer.Serialize(testTaggedUser{"Tom", ""}); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := encoder.BeginObject("testTaggedUser"); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := encoder.WriteString("Tom"); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := encoder.End(); err != nil {
+		t.Fatal(err.Error())
+	}
+	s := `c14"testTaggedUser"1{s9"user_name"}o0{s3"Tom"}o0{r2;}`
+	if b.String() != s {
+		t.Error(b.String())
+	}
+	reader := NewReader(NewBufReader(b.Bytes()))
+	for i := 0; i < 2; i++ {
+		var u testTaggedUser
+		if err := reader.Unserialize(&u); err != nil || u.Name != "Tom" {
+			t.Error(u, err)
+		}
+	}
+}
+
+func TestEncoderClassBeforeStruct(t *testing.T) {
+	b := new(bytes.Buffer)
+	writer := NewWriter(b)
+	encoder := NewEncoder(writer)
+	if err := encoder.BeginObject("testTaggedUser", "user_name"); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := encoder.WriteString("Tom"); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := encoder.End(); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := writer.Serialize(testTaggedUser{"Jerry", ""}); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := writer.Serialize("Jerry"); err != nil {
+		t.Fatal(err.Error())
+	}
+	s := `c14"testTaggedUser"1{s9"user_name"}o0{s3"Tom"}` +
+		`c14"testTaggedUser"1{s9"user_name"}o1{s5"Jerry"}r5;`
+	if b.String() != s {
+		t.Error(b.String())
+	}
+	reader := NewReader(NewBufReader(b.Bytes()))
+	for _, name := range []string{"Tom", "Jerry"} {
+		var u testTaggedUser
+		if err := reader.Unserialize(&u); err != nil || u.Name != name {
+			t.Error(u, err)
+		}
+	}
+	if s, err := reader.ReadString(); err != nil || s != "Jerry" {
+		t.Error(s, err)
+	}
+}
+
+func TestEncoderErrors(t *testing.T) {
+	encoder := NewEncoder(NewSimpleWriter(new(bytes.Buffer)))
+	if err := encoder.End(); err == nil {
+		t.Error("End should fail without a collection")
+	}
+	if err := encoder.BeginObject("unknown"); err == nil {
+		t.Error("BeginObject should fail without the fields")
+	}
+	encoder.BeginList(1)
+	if err := encoder.End(); err == nil {
+		t.Error("End should fail before all the values are written")
+	}
+	encoder.WriteNull()
+	if err := encoder.WriteNull(); err == nil {
+		t.Error("WriteNull should fail after all the values are written")
+	}
+	if err := encoder.End(); err != nil {
+		t.Error(err.Error())
+	}
+}
+
+func TestEncoderService(t *testing.T) {
+	service := NewBaseService()
+	service.AddFunction("rows", func(n int) testRows { return testRows(n) })
+	buf := new(strings.Builder)
+	if err := service.Handle(NewBufReader([]byte(`Cs4"rows"a1{3}z`)), buf); err != nil {
+		t.Fatal(err.Error())
+	}
+	if buf.String() != `Ra3{012}z` {
+		t.Error(buf.String())
+	}
+}
@@ -23,6 +23,7 @@ package hprose
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"crypto/tls"
 	"io"
 	"net/http"
@@ -45,6 +46,7 @@ type HttpTransporter struct {
 
 type HttpContext struct {
 	uri  string
+	ctx  context.Context
 	body io.ReadCloser
 }
 
@@ -138,13 +140,17 @@ func newHttpTransporter() *HttpTransporter {
 }
 
 func (h *HttpTransporter) GetInvokeContext(uri string) (interface{}, error) {
-	return &HttpContext{uri: uri}, nil
+	return h.GetInvokeContextWithContext(context.Background(), uri)
+}
+
+func (h *HttpTransporter) GetInvokeContextWithContext(ctx context.Context, uri string) (interface{}, error) {
+	return &HttpContext{uri: uri, ctx: ctx}, nil
 }
 
 func (h *HttpTransporter) SendData(context interface{}, data []byte, success bool) error {
 	if success {
 		context := context.(*HttpContext)
-		req, err := http.NewRequest("POST", context.uri, bytes.NewReader(data))
+		req, err := http.NewRequestWithContext(context.ctx, "POST", context.uri, bytes.NewReader(data))
 		if err != nil {
 			return err
 		}
@@ -167,5 +173,8 @@ func (h *HttpTransporter) GetInputStream(context interface{}) (BufReader, error)
 }
 
 func (h *HttpTransporter) EndInvoke(context interface{}, success bool) error {
-	return context.(*HttpContext).body.Close()
+	if body := context.(*HttpContext).body; body != nil {
+		return body.Close()
+	}
+	return nil
 }
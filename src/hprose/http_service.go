@@ -166,12 +166,16 @@ func (service *HttpService) ServeHTTP(response http.ResponseWriter, request *htt
 	switch request.Method {
 	case "GET":
 		if service.GetEnabled {
-			service.doFunctionList(response)
+			service.doFunctionList(&serviceSession{ostream: response})
 		} else {
 			response.WriteHeader(403)
 		}
 	case "POST":
-		service.Handle(bufio.NewReader(request.Body), response)
+		service.handle(&serviceSession{
+			istream: bufio.NewReader(request.Body),
+			ostream: response,
+			context: &ServiceContext{Context: request.Context(), Request: request},
+		})
 		request.Body.Close()
 	}
 }
@@ -0,0 +1,383 @@
+/**********************************************************\
+|                                                          |
+|                          hprose                          |
+|                                                          |
+| Official WebSite: http://www.hprose.com/                 |
+|                   http://www.hprose.net/                 |
+|                   http://www.hprose.org/                 |
+|                                                          |
+\**********************************************************/
+/**********************************************************\
+ *                                                        *
+ * hprose/json.go                                         *
+ *                                                        *
+ * hprose JSON transcoder for Go.                         *
+ *                                                        *
+\**********************************************************/
+
+package hprose
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"math/big"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// JSONClassKey is the key holding the class name of an object in JSON.
+const JSONClassKey = "@class"
+
+var cyclicRefError = errors.New("a cyclic reference cannot be converted to JSON")
+
+// HproseToJSON converts the first hprose value in data to JSON.
+//
+// Lists are converted to arrays, maps and objects to JSON objects, dates to
+// RFC 3339 strings, bytes to base64 strings and guids to strings, and the
+// references are expanded to the values they refer to. When classKey is
+// true, the class name of an object is written with the JSONClassKey key
+// before its fields. The keys of the maps must be strings, numbers,
+// booleans, dates or guids, and NaN and infinities cannot be converted.
+//
+// The expanded references make the JSON grow exponentially with the
+// nesting of data, so the data from an untrusted source should be
+// converted by HproseToJSONWithLimits.
+func HproseToJSON(data []byte, classKey bool) ([]byte, error) {
+	return HproseToJSONWithLimits(data, classKey, ReaderLimits{})
+}
+
+// HproseToJSONWithLimits is like HproseToJSON, but data is read with limits,
+// and MaxMessageSize limits the size of the JSON too.
+func HproseToJSONWithLimits(data []byte, classKey bool, limits ReaderLimits) ([]byte, error) {
+	decoder := NewDecoder(NewBufReader(data))
+	decoder.SetLimits(limits)
+	v, err := decoder.Value()
+	if err != nil {
+		return nil, err
+	}
+	buf := new(bytes.Buffer)
+	jw := &jsonWriter{buf: buf, classKey: classKey, max: limits.MaxMessageSize}
+	if err = jw.write(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// CopyHproseToJSON converts all the hprose values read from src to JSON
+// values written to dst, one per line, like HproseToJSON. When src ends
+// inside a value, it returns io.ErrUnexpectedEOF.
+func CopyHproseToJSON(dst io.Writer, src io.Reader, classKey bool) error {
+	return CopyHproseToJSONWithLimits(dst, src, classKey, ReaderLimits{})
+}
+
+// CopyHproseToJSONWithLimits is like CopyHproseToJSON, but every value is
+// read with limits, and MaxMessageSize limits the size of every JSON value
+// too.
+func CopyHproseToJSONWithLimits(dst io.Writer, src io.Reader, classKey bool, limits ReaderLimits) error {
+	stream, ok := src.(BufReader)
+	if !ok {
+		stream = bufio.NewReader(src)
+	}
+	decoder := NewDecoder(stream)
+	jw := &jsonWriter{buf: new(bytes.Buffer), classKey: classKey, max: limits.MaxMessageSize}
+	for {
+		decoder.SetLimits(limits)
+		v, err := decoder.Value()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		jw.buf.Reset()
+		if err = jw.write(v); err != nil {
+			return err
+		}
+		jw.buf.WriteByte('\n')
+		if _, err = dst.Write(jw.buf.Bytes()); err != nil {
+			return err
+		}
+	}
+}
+
+// JSONToHprose converts the first JSON value in data to hprose.
+//
+// Arrays are converted to lists, and JSON objects to maps with string
+// keys, or to objects when they have a JSONClassKey key with a string
+// value. Integers are converted to ints or big integers, and the other
+// numbers to doubles. Strings stay strings, so the dates, bytes and guids
+// converted by HproseToJSON are not restored.
+func JSONToHprose(data []byte, simple bool) ([]byte, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	v, err := readJSONValue(decoder)
+	if err != nil {
+		return nil, err
+	}
+	return Serialize(v, simple)
+}
+
+// CopyJSONToHprose converts all the JSON values read from src to hprose
+// values written to dst by one writer, like JSONToHprose.
+func CopyJSONToHprose(dst io.Writer, src io.Reader, simple bool) error {
+	stream, ok := dst.(BufWriter)
+	var buf *bufio.Writer
+	if !ok {
+		buf = bufio.NewWriter(dst)
+		stream = buf
+	}
+	var writer Writer
+	if simple {
+		writer = NewSimpleWriter(stream)
+	} else {
+		writer = NewWriter(stream)
+	}
+	decoder := json.NewDecoder(src)
+	decoder.UseNumber()
+	for decoder.More() {
+		v, err := readJSONValue(decoder)
+		if err != nil {
+			return err
+		}
+		if err = writer.Serialize(v); err != nil {
+			return err
+		}
+	}
+	if buf != nil {
+		return buf.Flush()
+	}
+	return nil
+}
+
+type jsonWriter struct {
+	buf      *bytes.Buffer
+	classKey bool
+	max      int
+	active   map[Value]bool
+}
+
+func (jw *jsonWriter) write(v Value) error {
+	buf := jw.buf
+	if err := jw.checkSize(); err != nil {
+		return err
+	}
+	switch v := v.(type) {
+	case nil, Null:
+		buf.WriteString("null")
+	case Bool:
+		buf.WriteString(strconv.FormatBool(bool(v)))
+	case Int:
+		buf.WriteString(strconv.FormatInt(int64(v), 10))
+	case BigInt:
+		if v.Value == nil {
+			buf.WriteString("null")
+		} else {
+			buf.WriteString(v.Value.String())
+		}
+	case Double:
+		b, err := json.Marshal(float64(v))
+		if err != nil {
+			return err
+		}
+		buf.Write(b)
+	case *String:
+		return jw.writeString(v.Value)
+	case *Bytes:
+		return jw.writeString(base64.StdEncoding.EncodeToString(v.Value))
+	case *Date:
+		return jw.writeString(v.Value.Format(time.RFC3339Nano))
+	case *Guid:
+		return jw.writeString(v.Value.String())
+	case Ref:
+		if jw.active[v.Target] {
+			return cyclicRefError
+		}
+		return jw.write(v.Target)
+	case *List:
+		jw.enter(v)
+		buf.WriteByte('[')
+		for i, item := range v.Items {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			if err := jw.write(item); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte(']')
+		delete(jw.active, v)
+	case *Map:
+		jw.enter(v)
+		buf.WriteByte('{')
+		for i, entry := range v.Entries {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			key, err := jw.key(entry.Key)
+			if err != nil {
+				return err
+			}
+			if err = jw.writeField(key, entry.Value); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte('}')
+		delete(jw.active, v)
+	case *Object:
+		jw.enter(v)
+		buf.WriteByte('{')
+		if jw.classKey {
+			if err := jw.writeField(JSONClassKey, &String{v.Class}); err != nil {
+				return err
+			}
+		}
+		for i, field := range v.Fields {
+			if i > 0 || jw.classKey {
+				buf.WriteByte(',')
+			}
+			if err := jw.writeField(field.Name, field.Value); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte('}')
+		delete(jw.active, v)
+	default:
+		return errors.New("unsupported Value type " + v.Kind().String())
+	}
+	return jw.checkSize()
+}
+
+// checkSize fails when the JSON is longer than the limit.
+func (jw *jsonWriter) checkSize() error {
+	if n := jw.buf.Len(); jw.max > 0 && n > jw.max {
+		return &LimitError{MessageSizeLimit, n, jw.max}
+	}
+	return nil
+}
+
+func (jw *jsonWriter) enter(v Value) {
+	if jw.active == nil {
+		jw.active = make(map[Value]bool)
+	}
+	jw.active[v] = true
+}
+
+func (jw *jsonWriter) writeString(s string) error {
+	encoder := json.NewEncoder(jw.buf)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(s); err != nil {
+		return err
+	}
+	// Encode ends the string with a newline.
+	jw.buf.Truncate(jw.buf.Len() - 1)
+	return jw.checkSize()
+}
+
+func (jw *jsonWriter) writeField(name string, v Value) error {
+	if err := jw.writeString(name); err != nil {
+		return err
+	}
+	jw.buf.WriteByte(':')
+	return jw.write(v)
+}
+
+// key returns the text of a map key, which is a JSON string.
+func (jw *jsonWriter) key(v Value) (string, error) {
+	if ref, ok := v.(Ref); ok {
+		v = ref.Target
+	}
+	switch v := v.(type) {
+	case *String:
+		return v.Value, nil
+	case *List, *Map, *Object:
+		return "", errors.New("a " + v.Kind().String() + " key cannot be converted to JSON")
+	}
+	buf := jw.buf
+	jw.buf = new(bytes.Buffer)
+	err := jw.write(v)
+	key := jw.buf.String()
+	jw.buf = buf
+	return strings.Trim(key, `"`), err
+}
+
+func readJSONValue(decoder *json.Decoder) (Value, error) {
+	token, err := decoder.Token()
+	if err != nil {
+		return nil, err
+	}
+	switch token := token.(type) {
+	case nil:
+		return Null{}, nil
+	case bool:
+		return Bool(token), nil
+	case string:
+		return &String{token}, nil
+	case json.Number:
+		return jsonNumber(string(token))
+	case json.Delim:
+		if token == '[' {
+			list := &List{make([]Value, 0)}
+			for decoder.More() {
+				item, err := readJSONValue(decoder)
+				if err != nil {
+					return nil, err
+				}
+				list.Items = append(list.Items, item)
+			}
+			_, err = decoder.Token()
+			return list, err
+		}
+		return readJSONObject(decoder)
+	}
+	return nil, errors.New("unexpected JSON token")
+}
+
+func readJSONObject(decoder *json.Decoder) (Value, error) {
+	var class *string
+	var fields []ObjectField
+	for decoder.More() {
+		token, err := decoder.Token()
+		if err != nil {
+			return nil, err
+		}
+		name := token.(string)
+		value, err := readJSONValue(decoder)
+		if err != nil {
+			return nil, err
+		}
+		if s, ok := value.(*String); ok && name == JSONClassKey && class == nil {
+			class = &s.Value
+			continue
+		}
+		fields = append(fields, ObjectField{name, value})
+	}
+	if _, err := decoder.Token(); err != nil {
+		return nil, err
+	}
+	if class != nil {
+		return &Object{*class, fields}, nil
+	}
+	m := &Map{make([]MapEntry, len(fields))}
+	for i, field := range fields {
+		m.Entries[i] = MapEntry{&String{field.Name}, field.Value}
+	}
+	return m, nil
+}
+
+func jsonNumber(s string) (Value, error) {
+	if i, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return Int(i), nil
+	}
+	if !strings.ContainsAny(s, ".eE") {
+		if i, ok := new(big.Int).SetString(s, 10); ok {
+			return BigInt{i}, nil
+		}
+	}
+	f, err := strconv.ParseFloat(s, 64)
+	return Double(f), err
+}
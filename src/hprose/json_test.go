@@ -0,0 +1,131 @@
+/**********************************************************\
+|                                                          |
+|                          hprose                          |
+|                                                          |
+| Official WebSite: http://www.hprose.com/                 |
+|                   http://www.hprose.net/                 |
+|                   http://www.hprose.org/                 |
+|                                                          |
+\**********************************************************/
+/**********************************************************\
+ *                                                        *
+ * hprose/json_test.go                                    *
+ *                                                        *
+ * hprose JSON transcoder Test for Go.                    *
+ *                                                        *
+\**********************************************************/
+
+package hprose_test
+
+import (
+	"bytes"
+	. "hprose"
+	"io"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHproseToJSON(t *testing.T) {
+	n, _ := new(big.Int).SetString("12345678901234567890", 10)
+	date := time.Date(2026, 10, 16, 12, 30, 0, 0, time.UTC)
+	data, err := Serialize([]interface{}{1, "hello", "hello", n, 2.5, true, nil, []byte("hi"), date,
+		map[int]string{1: "a<b"}, testTaggedUser{"Tom", ""}}, false)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	s := `[1,"hello","hello",12345678901234567890,2.5,true,null,"aGk=","2026-10-16T12:30:00Z",` +
+		`{"1":"a<b"},{"@class":"testTaggedUser","user_name":"Tom"}]`
+	if result, err := HproseToJSON(data, true); err != nil || string(result) != s {
+		t.Error(string(result), err)
+	}
+	data = []byte(`c5"Empty"{}o0{}`)
+	if result, err := HproseToJSON(data, false); err != nil || string(result) != `{}` {
+		t.Error(string(result), err)
+	}
+	data = []byte(`c14"testTaggedUser"1{s9"user_name"}o0{s3"Tom"}`)
+	if result, err := HproseToJSON(data, false); err != nil || string(result) != `{"user_name":"Tom"}` {
+		t.Error(string(result), err)
+	}
+}
+
+func TestJSONToHprose(t *testing.T) {
+	data, err := JSONToHprose([]byte(`[1, 12345678901234567890, 1.5, "a", "ab", null, true, {"a": []}]`), false)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	s := `a8{1l12345678901234567890;d1.5;uas2"ab"ntm1{uaa{}}}`
+	if string(data) != s {
+		t.Error(string(data))
+	}
+	data, err = JSONToHprose([]byte(`{"user_name": "Tom", "@class": "testTaggedUser"}`), true)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	var u testTaggedUser
+	if err = Unserialize(data, &u, true); err != nil || u.Name != "Tom" {
+		t.Error(string(data), u, err)
+	}
+}
+
+func TestCopyJSON(t *testing.T) {
+	buf := new(bytes.Buffer)
+	if err := CopyHproseToJSON(buf, strings.NewReader(`s5"hello"a2{r0;1}`), false); err != nil {
+		t.Fatal(err.Error())
+	}
+	if buf.String() != "\"hello\"\n[\"hello\",1]\n" {
+		t.Error(buf.String())
+	}
+	buf.Reset()
+	if err := CopyJSONToHprose(buf, strings.NewReader("{\"a\": 1}\n\"abc\""), false); err != nil {
+		t.Fatal(err.Error())
+	}
+	if buf.String() != `m1{ua1}s3"abc"` {
+		t.Error(buf.String())
+	}
+}
+
+func TestHproseToJSONWithLimits(t *testing.T) {
+	data := []byte(`a2{a2{a2{a2{s4"abcd"r4;}r3;}r2;}r1;}`)
+	if result, err := HproseToJSON(data, false); err != nil || len(result) != 141 {
+		t.Error(string(result), err)
+	}
+	result, err := HproseToJSONWithLimits(data, false, ReaderLimits{MaxMessageSize: 100})
+	if e, ok := err.(*LimitError); !ok || e.Kind != MessageSizeLimit || result != nil {
+		t.Error(string(result), err)
+	}
+	result, err = HproseToJSONWithLimits(data, false, ReaderLimits{MaxMessageSize: 141})
+	if err != nil || len(result) != 141 {
+		t.Error(string(result), err)
+	}
+	result, err = HproseToJSONWithLimits(data, false, ReaderLimits{MaxDepth: 2})
+	if e, ok := err.(*LimitError); !ok || e.Kind != DepthLimit || result != nil {
+		t.Error(string(result), err)
+	}
+	buf := new(bytes.Buffer)
+	err = CopyHproseToJSONWithLimits(buf, strings.NewReader(`s3"abc"a2{r0;r0;}`), false, ReaderLimits{MaxMessageSize: 12})
+	if e, ok := err.(*LimitError); !ok || e.Kind != MessageSizeLimit || buf.String() != "\"abc\"\n" {
+		t.Error(buf.String(), err)
+	}
+	for _, data := range []string{`s3"abc"s5"hel`, `s3"abc"i12`, `s3"abc"a2{1`, `s3"abc"c1"A"1{s1"a"}`} {
+		buf.Reset()
+		err = CopyHproseToJSONWithLimits(buf, strings.NewReader(data), false, ReaderLimits{})
+		if err != io.ErrUnexpectedEOF || buf.String() != "\"abc\"\n" {
+			t.Error(data, buf.String(), err)
+		}
+	}
+}
+
+func TestJSONErrors(t *testing.T) {
+	for _, data := range []string{`a1{r0;}`, `N`, `m1{a{}1}`, `Rz`} {
+		if result, err := HproseToJSON([]byte(data), true); err == nil || result != nil {
+			t.Error(data)
+		}
+	}
+	for _, data := range []string{`[1,`, `{"a"}`, `}`} {
+		if _, err := JSONToHprose([]byte(data), true); err == nil {
+			t.Error(data)
+		}
+	}
+}
@@ -0,0 +1,129 @@
+/**********************************************************\
+|                                                          |
+|                          hprose                          |
+|                                                          |
+| Official WebSite: http://www.hprose.com/                 |
+|                   http://www.hprose.net/                 |
+|                   http://www.hprose.org/                 |
+|                                                          |
+\**********************************************************/
+/**********************************************************\
+ *                                                        *
+ * hprose/marshaler.go                                    *
+ *                                                        *
+ * hprose Marshaler for Go.                               *
+ *                                                        *
+\**********************************************************/
+
+package hprose
+
+import (
+	"encoding"
+	"math/big"
+	"reflect"
+	"time"
+)
+
+// HproseMarshaler is the interface implemented by types that can write
+// their own hprose representation.
+//
+// MarshalHprose may call the methods of writer to serialize the value, or
+// write a raw hprose fragment directly to writer.Stream(). A raw fragment
+// is not seen by the reference table of writer, so it should not contain
+// strings, bytes, dates, lists, maps or objects unless the writer is a
+// simple writer.
+type HproseMarshaler interface {
+	MarshalHprose(writer Writer) error
+}
+
+// HproseUnmarshaler is the interface implemented by types that can read
+// their own hprose representation.
+//
+// UnmarshalHprose must consume exactly one value from reader, including
+// its tag. It may call the methods of reader, or take the raw fragment with
+// reader.ReadRaw(). A null value is passed to UnmarshalHprose like any
+// other value.
+type HproseUnmarshaler interface {
+	UnmarshalHprose(reader Reader) error
+}
+
+var marshalerType = reflect.TypeOf((*HproseMarshaler)(nil)).Elem()
+var unmarshalerType = reflect.TypeOf((*HproseUnmarshaler)(nil)).Elem()
+var textMarshalerType = reflect.TypeOf((*encoding.TextMarshaler)(nil)).Elem()
+var textUnmarshalerType = reflect.TypeOf((*encoding.TextUnmarshaler)(nil)).Elem()
+var binaryMarshalerType = reflect.TypeOf((*encoding.BinaryMarshaler)(nil)).Elem()
+var binaryUnmarshalerType = reflect.TypeOf((*encoding.BinaryUnmarshaler)(nil)).Elem()
+var timeType = reflect.TypeOf(time.Time{})
+var bigIntType = reflect.TypeOf(big.Int{})
+
+func hproseMarshaler(v interface{}, rv reflect.Value) HproseMarshaler {
+	if m, ok := v.(HproseMarshaler); ok {
+		return m
+	}
+	if rv.CanAddr() && reflect.PtrTo(rv.Type()).Implements(marshalerType) {
+		return rv.Addr().Interface().(HproseMarshaler)
+	}
+	return nil
+}
+
+func hproseUnmarshaler(v reflect.Value) HproseUnmarshaler {
+	t := v.Type()
+	if t.Kind() == reflect.Ptr && t.Implements(unmarshalerType) {
+		if v.IsNil() {
+			v.Set(reflect.New(t.Elem()))
+		}
+		return v.Interface().(HproseUnmarshaler)
+	}
+	if v.CanAddr() && reflect.PtrTo(t).Implements(unmarshalerType) {
+		return v.Addr().Interface().(HproseUnmarshaler)
+	}
+	return nil
+}
+
+// isNativeType reports whether values of t have their own hprose tag, even
+// though t implements the encoding interfaces.
+func isNativeType(t reflect.Type) bool {
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	return t == timeType || t == bigIntType
+}
+
+// encodingMarshaler returns the encoding.TextMarshaler or the
+// encoding.BinaryMarshaler of rv, or nil when rv implements neither.
+func encodingMarshaler(rv reflect.Value) interface{} {
+	t := rv.Type()
+	if isNativeType(t) {
+		return nil
+	}
+	if t.Implements(textMarshalerType) || t.Implements(binaryMarshalerType) {
+		return rv.Interface()
+	}
+	if rv.CanAddr() {
+		t = reflect.PtrTo(t)
+		if t.Implements(textMarshalerType) || t.Implements(binaryMarshalerType) {
+			return rv.Addr().Interface()
+		}
+	}
+	return nil
+}
+
+// encodingUnmarshaler reports whether v, or the address of v when v is not
+// a pointer, implements encoding.TextUnmarshaler or
+// encoding.BinaryUnmarshaler, and whether it is the former.
+func encodingUnmarshaler(v reflect.Value) (ok bool, text bool) {
+	t := v.Type()
+	if isNativeType(t) {
+		return false, false
+	}
+	if t.Kind() != reflect.Ptr {
+		if !v.CanAddr() {
+			return false, false
+		}
+		t = reflect.PtrTo(t)
+	}
+	if t.Implements(textUnmarshalerType) {
+		return true, true
+	}
+	return t.Implements(binaryUnmarshalerType), false
+}
@@ -0,0 +1,264 @@
+/**********************************************************\
+|                                                          |
+|                          hprose                          |
+|                                                          |
+| Official WebSite: http://www.hprose.com/                 |
+|                   http://www.hprose.net/                 |
+|                   http://www.hprose.org/                 |
+|                                                          |
+\**********************************************************/
+/**********************************************************\
+ *                                                        *
+ * hprose/raw_message.go                                  *
+ *                                                        *
+ * hprose RawMessage for Go.                              *
+ *                                                        *
+\**********************************************************/
+
+package hprose
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"strconv"
+	"time"
+	"unicode/utf8"
+	"uuid"
+)
+
+// RawMessage is a serialized hprose value. It can be used as a struct
+// field, a map value, a parameter or a result to delay the decoding of a
+// value, or to forward it untouched.
+//
+// A RawMessage is self-contained: the references and the objects in it
+// only refer to the values and the classes in the RawMessage itself. The
+// reader renumbers them when it reads a RawMessage, and the writer
+// renumbers them again when it writes the RawMessage in a stream, so that
+// the references before and after it stay valid. The other bytes are kept
+// as they are. A simple writer cannot write a RawMessage with references.
+type RawMessage []byte
+
+var rawMessageType = reflect.TypeOf(RawMessage(nil))
+
+var outsideRefError = errors.New("RawMessage refers to a collection outside of it")
+var rawRefError = errors.New("RawMessage with references cannot be written by a simple writer")
+
+// teeStream writes all the bytes read from the stream to buf.
+type teeStream struct {
+	BufReader
+	buf *bytes.Buffer
+}
+
+func (s *teeStream) Read(p []byte) (n int, err error) {
+	n, err = s.BufReader.Read(p)
+	s.buf.Write(p[:n])
+	return n, err
+}
+
+func (s *teeStream) ReadByte() (c byte, err error) {
+	if c, err = s.BufReader.ReadByte(); err == nil {
+		s.buf.WriteByte(c)
+	}
+	return c, err
+}
+
+func (s *teeStream) ReadRune() (r rune, size int, err error) {
+	var b [utf8.UTFMax]byte
+	for !utf8.FullRune(b[:size]) {
+		if b[size], err = s.ReadByte(); err != nil {
+			return utf8.RuneError, size, err
+		}
+		size++
+	}
+	r, _ = utf8.DecodeRune(b[:size])
+	return r, size, nil
+}
+
+func (s *teeStream) ReadString(delim byte) (line string, err error) {
+	line, err = s.BufReader.ReadString(delim)
+	s.buf.WriteString(line)
+	return line, err
+}
+
+func (r *reader) readRawMessage(v reflect.Value) error {
+	var values []interface{}
+	if refer, ok := r.readerRefer.(*realReaderRefer); ok {
+		values = refer.ref
+	}
+	rw := &rawRewriter{
+		refBase: len(values),
+		classes: make([]decoderClass, len(r.fieldsref)),
+		outside: values,
+	}
+	for i, fields := range r.fieldsref {
+		rw.classes[i] = decoderClass{r.classnames[i], fields}
+	}
+	buf := new(bytes.Buffer)
+	stream := r.stream
+	r.stream = &teeStream{stream, buf}
+	_, err := r.readInterface()
+	r.stream = stream
+	if err == nil {
+		if err = rw.rewrite(buf.Bytes()); err == nil {
+			v.Set(reflect.ValueOf(RawMessage(rw.out.Bytes())))
+		}
+	}
+	return err
+}
+
+func (w *writer) writeRawMessage(raw RawMessage) (err error) {
+	if len(raw) == 0 {
+		return w.WriteNull()
+	}
+	rw := &rawRewriter{classCount: len(w.fieldsref)}
+	refer, ok := w.writerRefer.(*realWriterRefer)
+	if ok {
+		rw.refs = refer.count
+	}
+	refs := rw.refs
+	if err = rw.rewrite(raw); err != nil {
+		return err
+	}
+	if rw.hasRef && !ok {
+		return rawRefError
+	}
+	if _, err = w.stream.Write(rw.out.Bytes()); err != nil {
+		return err
+	}
+	for i := rw.refs - refs; i > 0; i-- {
+		w.setRef(new(int))
+	}
+	if len(rw.defs) > 0 && w.classref == nil {
+		w.classref = make(map[string]int)
+		w.fieldsref = make([][]field, 0)
+	}
+	for _, class := range rw.defs {
+		fields := make([]field, len(class.fields))
+		for i, name := range class.fields {
+			fields[i].Name = name
+		}
+		w.classref[class.name] = len(w.fieldsref)
+		w.fieldsref = append(w.fieldsref, fields)
+	}
+	return nil
+}
+
+// rawRewriter copies a serialized value read after refBase references and
+// classes, renumbering its references and classes to start from refs and
+// classCount. The references to the strings, bytes, dates and guids before
+// the value are replaced with the values in outside, and the classes
+// defined before the value are defined again.
+type rawRewriter struct {
+	refBase    int
+	classes    []decoderClass
+	outside    []interface{}
+	out        bytes.Buffer
+	refs       int
+	classCount int
+	refMap     map[int]int
+	classMap   map[int]int
+	defs       []decoderClass
+	hasRef     bool
+}
+
+func (rw *rawRewriter) rewrite(raw []byte) error {
+	stream := &bufReader{raw, 0}
+	d := NewDecoder(stream)
+	d.refs = rw.refBase
+	d.classes = append([]decoderClass(nil), rw.classes...)
+	rw.refMap = make(map[int]int)
+	rw.classMap = make(map[int]int)
+	for {
+		start, refs := stream.i, d.refs
+		token, err := d.Token()
+		if err != nil {
+			return err
+		}
+		switch token.Kind {
+		case RefToken:
+			err = rw.writeRef(token.Ref)
+		case ObjectToken:
+			var index int
+			if index, err = strconv.Atoi(string(raw[start+1 : stream.i-1])); err == nil {
+				err = rw.writeObject(index)
+			}
+		case ClassToken:
+			rw.classMap[len(d.classes)-1] = rw.classCount
+			rw.classCount++
+			rw.defs = append(rw.defs, decoderClass{token.Class, token.Fields})
+			rw.out.Write(raw[start:stream.i])
+		case CallToken, ResultToken, ArgumentToken, ErrorToken, FunctionsToken, MessageEndToken:
+			return unexpectedTag(raw[start], nil)
+		default:
+			rw.out.Write(raw[start:stream.i])
+		}
+		if err != nil {
+			return err
+		}
+		for i := refs; i < d.refs; i++ {
+			rw.refMap[i] = rw.refs
+			rw.refs++
+		}
+		if token.Kind != ClassToken && d.Depth() == 0 {
+			break
+		}
+	}
+	if stream.i != len(raw) {
+		return errors.New("RawMessage contains more than one value")
+	}
+	return nil
+}
+
+func (rw *rawRewriter) writeRef(index int) error {
+	if ref, ok := rw.refMap[index]; ok {
+		rw.hasRef = true
+		rw.out.WriteByte(TagRef)
+		rw.out.WriteString(strconv.Itoa(ref))
+		rw.out.WriteByte(TagSemicolon)
+		return nil
+	}
+	if index >= len(rw.outside) {
+		return badRefError
+	}
+	v := rw.outside[index]
+	switch v.(type) {
+	case string, *[]byte, time.Time, *uuid.UUID:
+	default:
+		return outsideRefError
+	}
+	start := rw.out.Len()
+	if err := NewSimpleWriter(&rw.out).Serialize(v); err != nil {
+		return err
+	}
+	switch rw.out.Bytes()[start] {
+	case TagString, TagBytes, TagDate, TagTime, TagGuid:
+		rw.refMap[index] = rw.refs
+		rw.refs++
+	}
+	return nil
+}
+
+func (rw *rawRewriter) writeObject(index int) error {
+	class, ok := rw.classMap[index]
+	if !ok {
+		def := rw.classes[index]
+		w := &writer{stream: &rw.out, writerRefer: fakeWriterRefer{}, classref: make(map[string]int)}
+		fields := make([]field, len(def.fields))
+		for i, name := range def.fields {
+			fields[i].Name = name
+		}
+		if _, err := w.writeClass(def.name, fields); err != nil {
+			return err
+		}
+		rw.refs += len(fields)
+		class = rw.classCount
+		rw.classMap[index] = class
+		rw.classCount++
+		rw.defs = append(rw.defs, def)
+	}
+	rw.out.WriteByte(TagObject)
+	rw.out.WriteString(strconv.Itoa(class))
+	rw.out.WriteByte(TagOpenbrace)
+	return nil
+}
@@ -0,0 +1,135 @@
+/**********************************************************\
+|                                                          |
+|                          hprose                          |
+|                                                          |
+| Official WebSite: http://www.hprose.com/                 |
+|                   http://www.hprose.net/                 |
+|                   http://www.hprose.org/                 |
+|                                                          |
+\**********************************************************/
+/**********************************************************\
+ *                                                        *
+ * hprose/raw_message_test.go                             *
+ *                                                        *
+ * hprose RawMessage Test for Go.                         *
+ *                                                        *
+\**********************************************************/
+
+package hprose_test
+
+import (
+	"bytes"
+	. "hprose"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestRawMessageRead(t *testing.T) {
+	data, err := Serialize([]interface{}{"Tom", []interface{}{"Tom", testTaggedUser{"Tom", ""}},
+		testTaggedUser{"Jerry", ""}, "Tom"}, false)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	var raws []RawMessage
+	if err = Unserialize(data, &raws, false); err != nil {
+		t.Fatal(err.Error())
+	}
+	expected := []string{
+		`s3"Tom"`,
+		`a2{s3"Tom"c14"testTaggedUser"1{s9"user_name"}o0{r1;}}`,
+		`c14"testTaggedUser"1{s9"user_name"}o0{s5"Jerry"}`,
+		`s3"Tom"`,
+	}
+	if len(raws) != len(expected) {
+		t.Fatal(raws)
+	}
+	for i, raw := range raws {
+		if string(raw) != expected[i] {
+			t.Errorf("raw %d: %s", i, raw)
+		}
+	}
+	var users []interface{}
+	if err = Unserialize(raws[1], &users, false); err != nil {
+		t.Fatal(err.Error())
+	}
+	if u, ok := users[1].(*testTaggedUser); !ok || u.Name != "Tom" {
+		t.Error(users)
+	}
+}
+
+func TestRawMessageWrite(t *testing.T) {
+	raws := []RawMessage{
+		RawMessage(`s3"Tom"`),
+		RawMessage(`a2{s3"Tom"c14"testTaggedUser"1{s9"user_name"}o0{r1;}}`),
+		RawMessage(`c14"testTaggedUser"1{s9"user_name"}o0{s5"Jerry"}`),
+	}
+	b := new(bytes.Buffer)
+	writer := NewWriter(b)
+	if err := writer.Serialize(raws); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := writer.Serialize(testTaggedUser{"Ann", ""}); err != nil {
+		t.Fatal(err.Error())
+	}
+	s := `a3{s3"Tom"a2{s3"Tom"c14"testTaggedUser"1{s9"user_name"}o0{r3;}}` +
+		`c14"testTaggedUser"1{s9"user_name"}o1{s5"Jerry"}}` +
+		`c14"testTaggedUser"1{s9"user_name"}o2{s3"Ann"}`
+	if b.String() != s {
+		t.Error(b.String())
+	}
+	reader := NewReader(NewBufReader(b.Bytes()))
+	var values []interface{}
+	if err := reader.Unserialize(&values); err != nil {
+		t.Fatal(err.Error())
+	}
+	users := *(values[1].(*[]interface{}))
+	if u, ok := users[1].(*testTaggedUser); !ok || u.Name != "Tom" {
+		t.Error(users)
+	}
+	var u testTaggedUser
+	if err := reader.Unserialize(&u); err != nil || u.Name != "Ann" {
+		t.Error(u, err)
+	}
+}
+
+func TestRawMessageField(t *testing.T) {
+	type envelope struct {
+		Kind string
+		Body RawMessage
+	}
+	data := []byte(`m2{s4"kind"s4"user"s4"body"a2{r2;r3;}}`)
+	var e envelope
+	if err := Unserialize(data, &e, false); err != nil {
+		t.Fatal(err.Error())
+	}
+	if e.Kind != "user" || string(e.Body) != `a2{s4"user"s4"body"}` {
+		t.Error(e.Kind, string(e.Body))
+	}
+	var body []string
+	if err := Unserialize(e.Body, &body, false); err != nil || !reflect.DeepEqual(body, []string{"user", "body"}) {
+		t.Error(body, err)
+	}
+}
+
+func TestRawMessageSimpleWriter(t *testing.T) {
+	writer := NewSimpleWriter(new(bytes.Buffer))
+	if err := writer.Serialize(RawMessage(`a2{s3"Tom"r1;}`)); err == nil {
+		t.Error("a simple writer should not write a RawMessage with references")
+	}
+	if err := writer.Serialize(RawMessage(`r0;`)); err == nil {
+		t.Error("a RawMessage should be self-contained")
+	}
+}
+
+func TestRawMessageService(t *testing.T) {
+	service := NewBaseService()
+	service.AddFunction("echo", func(raw RawMessage) RawMessage { return raw })
+	buf := new(strings.Builder)
+	if err := service.Handle(NewBufReader([]byte(`Cs4"echo"a1{a2{s1"a"r2;}}z`)), buf); err != nil {
+		t.Fatal(err.Error())
+	}
+	if buf.String() != `Ra2{s1"a"r1;}z` {
+		t.Error(buf.String())
+	}
+}
@@ -29,12 +29,38 @@ import (
 type RawReader struct {
 	stream BufReader
 	strbuf [64]byte
+	limits ReaderLimits
+	depth  int
 }
 
 func NewRawReader(stream BufReader) *RawReader {
 	return &RawReader{stream: stream}
 }
 
+// SetLimits sets the limits checked while reading from the stream. The
+// message size is counted from the first byte read after SetLimits.
+func (r *RawReader) SetLimits(limits ReaderLimits) {
+	r.limits = limits
+	if s, ok := r.stream.(*limitedStream); ok {
+		r.stream = s.BufReader
+	}
+	if limits.MaxMessageSize > 0 {
+		r.stream = &limitedStream{BufReader: r.stream, max: limits.MaxMessageSize}
+	}
+}
+
+func (r *RawReader) enter() error {
+	if max := r.limits.MaxDepth; max > 0 && r.depth >= max {
+		return &LimitError{DepthLimit, r.depth + 1, max}
+	}
+	r.depth++
+	return nil
+}
+
+func (r *RawReader) leave() {
+	r.depth--
+}
+
 func (r *RawReader) ReadRaw() (raw []byte, err error) {
 	ostream := new(bytes.Buffer)
 	err = r.ReadRawTo(ostream)
@@ -135,6 +161,9 @@ func (r *RawReader) readBytesRaw(ostream BufWriter, tag byte) (err error) {
 			}
 		}
 	}
+	if err == nil {
+		err = r.limits.checkLength(count)
+	}
 	if err == nil {
 		b := make([]byte, count+1)
 		if _, err = r.stream.Read(b); err == nil {
@@ -157,6 +186,9 @@ func (r *RawReader) readStringRaw(ostream BufWriter, tag byte) (err error) {
 			}
 		}
 	}
+	if err == nil {
+		err = r.limits.checkLength(count)
+	}
 	if err == nil {
 		var str string
 		if str, err = r.readUTF8String(count + 1); err == nil {
@@ -177,6 +209,10 @@ func (r *RawReader) readGuidRaw(ostream BufWriter, tag byte) (err error) {
 }
 
 func (r *RawReader) readComplexRaw(ostream BufWriter, tag byte) (err error) {
+	if err = r.enter(); err != nil {
+		return err
+	}
+	defer r.leave()
 	err = ostream.WriteByte(tag)
 	for err == nil && tag != TagOpenbrace {
 		if tag, err = r.stream.ReadByte(); err == nil {
@@ -80,25 +80,40 @@ type Reader interface {
 	Reset()
 }
 
+// LimitSetter is implemented by the readers created by NewReader and
+// NewSimpleReader, and by RawReader. The limits are checked while reading
+// from the stream.
+type LimitSetter interface {
+	SetLimits(ReaderLimits)
+}
+
 type readerRefer interface {
-	setRef(p interface{})
+	setRef(p interface{}) error
 	readRef(i int, err error) (interface{}, error)
 	resetRef()
 }
 
 type realReaderRefer struct {
 	ref []interface{}
+	max int
 }
 
-func (r *realReaderRefer) setRef(p interface{}) {
+func (r *realReaderRefer) setRef(p interface{}) error {
+	if r.max > 0 && len(r.ref) >= r.max {
+		return &LimitError{RefsLimit, len(r.ref) + 1, r.max}
+	}
 	if r.ref == nil {
 		r.ref = make([]interface{}, 0)
 	}
 	r.ref = append(r.ref, p)
+	return nil
 }
 
 func (r *realReaderRefer) readRef(i int, err error) (interface{}, error) {
 	if err == nil {
+		if i < 0 || i >= len(r.ref) {
+			return nil, badRefError
+		}
 		return r.ref[i], nil
 	}
 	return nil, err
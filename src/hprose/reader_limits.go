@@ -0,0 +1,173 @@
+/**********************************************************\
+|                                                          |
+|                          hprose                          |
+|                                                          |
+| Official WebSite: http://www.hprose.com/                 |
+|                   http://www.hprose.net/                 |
+|                   http://www.hprose.org/                 |
+|                                                          |
+\**********************************************************/
+/**********************************************************\
+ *                                                        *
+ * hprose/reader_limits.go                                *
+ *                                                        *
+ * hprose ReaderLimits for Go.                            *
+ *                                                        *
+\**********************************************************/
+
+package hprose
+
+import (
+	"bytes"
+	"errors"
+	"strconv"
+)
+
+// ReaderLimits restricts what a reader accepts from an untrusted stream.
+// A zero field means no limit. The readers, decoders and clients have no
+// limits unless they are set, the services use DefaultServiceLimits.
+type ReaderLimits struct {
+	// MaxDepth is the maximum nesting depth of lists, maps and objects.
+	MaxDepth int
+	// MaxCollectionSize is the maximum count of the elements of a list,
+	// the entries of a map or the fields of a class.
+	MaxCollectionSize int
+	// MaxStringLength is the maximum length of a string or bytes.
+	MaxStringLength int
+	// MaxRefs is the maximum number of the values which can be referenced.
+	MaxRefs int
+	// MaxMessageSize is the maximum number of bytes read from the stream.
+	// It is also the maximum length of a frame of the tcp transport and of
+	// a message of the websocket transport.
+	MaxMessageSize int
+}
+
+// DefaultServiceLimits is the Limits of the services created by
+// NewBaseService and the constructors built on it, so a service is
+// protected from the untrusted requests unless its Limits are changed.
+var DefaultServiceLimits = ReaderLimits{
+	MaxDepth:          100,
+	MaxCollectionSize: 1 << 20,
+	MaxStringLength:   16 << 20,
+	MaxRefs:           1 << 20,
+	MaxMessageSize:    16 << 20,
+}
+
+// LimitKind identifies the limit of ReaderLimits which was exceeded.
+type LimitKind int
+
+const (
+	DepthLimit LimitKind = iota
+	CollectionSizeLimit
+	StringLengthLimit
+	RefsLimit
+	MessageSizeLimit
+)
+
+func (kind LimitKind) String() string {
+	switch kind {
+	case DepthLimit:
+		return "nesting depth"
+	case CollectionSizeLimit:
+		return "collection size"
+	case StringLengthLimit:
+		return "string length"
+	case RefsLimit:
+		return "number of references"
+	case MessageSizeLimit:
+		return "message size"
+	}
+	return "LimitKind(" + strconv.Itoa(int(kind)) + ")"
+}
+
+// LimitError is returned by a reader when the stream exceeds one of its
+// ReaderLimits.
+type LimitError struct {
+	Kind  LimitKind
+	Size  int
+	Limit int
+}
+
+func (e *LimitError) Error() string {
+	return "The " + e.Kind.String() + " " + strconv.Itoa(e.Size) +
+		" exceeds the limit " + strconv.Itoa(e.Limit) + "."
+}
+
+var badLengthError = errors.New("bad length in stream")
+
+func (limits *ReaderLimits) checkCount(count int) error {
+	if count < 0 {
+		return badLengthError
+	}
+	if max := limits.MaxCollectionSize; max > 0 && count > max {
+		return &LimitError{CollectionSizeLimit, count, max}
+	}
+	return nil
+}
+
+func (limits *ReaderLimits) checkLength(length int) error {
+	if length < 0 {
+		return badLengthError
+	}
+	if max := limits.MaxStringLength; max > 0 && length > max {
+		return &LimitError{StringLengthLimit, length, max}
+	}
+	return nil
+}
+
+// limitedStream fails when more than max bytes are read from the stream.
+type limitedStream struct {
+	BufReader
+	n   int
+	max int
+}
+
+func (s *limitedStream) exceeded(n int) error {
+	return &LimitError{MessageSizeLimit, s.n + n, s.max}
+}
+
+func (s *limitedStream) Read(p []byte) (n int, err error) {
+	if len(p) > s.max-s.n {
+		return 0, s.exceeded(len(p))
+	}
+	n, err = s.BufReader.Read(p)
+	s.n += n
+	return n, err
+}
+
+func (s *limitedStream) ReadByte() (c byte, err error) {
+	if s.n >= s.max {
+		return 0, s.exceeded(1)
+	}
+	if c, err = s.BufReader.ReadByte(); err == nil {
+		s.n++
+	}
+	return c, err
+}
+
+func (s *limitedStream) ReadRune() (r rune, size int, err error) {
+	if s.n >= s.max {
+		return 0, 0, s.exceeded(1)
+	}
+	if r, size, err = s.BufReader.ReadRune(); err == nil {
+		if s.n += size; s.n > s.max {
+			return 0, 0, s.exceeded(0)
+		}
+	}
+	return r, size, err
+}
+
+func (s *limitedStream) ReadString(delim byte) (line string, err error) {
+	buf := new(bytes.Buffer)
+	var c byte
+	for {
+		if c, err = s.ReadByte(); err != nil {
+			break
+		}
+		buf.WriteByte(c)
+		if c == delim {
+			break
+		}
+	}
+	return buf.String(), err
+}
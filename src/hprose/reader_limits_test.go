@@ -0,0 +1,110 @@
+/**********************************************************\
+|                                                          |
+|                          hprose                          |
+|                                                          |
+| Official WebSite: http://www.hprose.com/                 |
+|                   http://www.hprose.net/                 |
+|                   http://www.hprose.org/                 |
+|                                                          |
+\**********************************************************/
+/**********************************************************\
+ *                                                        *
+ * hprose/reader_limits_test.go                           *
+ *                                                        *
+ * hprose ReaderLimits Test for Go.                       *
+ *                                                        *
+\**********************************************************/
+
+package hprose_test
+
+import (
+	. "hprose"
+	"testing"
+)
+
+func checkLimitError(t *testing.T, err error, kind LimitKind) {
+	if e, ok := err.(*LimitError); !ok {
+		t.Errorf("expected %s limit error, got %v", kind, err)
+	} else if e.Kind != kind {
+		t.Error(e.Error())
+	}
+}
+
+func TestReaderLimitsCollectionSize(t *testing.T) {
+	reader := NewReader(NewBufReader([]byte(`a999999999{`)))
+	reader.(LimitSetter).SetLimits(ReaderLimits{MaxCollectionSize: 1000})
+	var a []int
+	checkLimitError(t, reader.Unserialize(&a), CollectionSizeLimit)
+	reader = NewReader(NewBufReader([]byte(`a3{123}`)))
+	reader.(LimitSetter).SetLimits(ReaderLimits{MaxCollectionSize: 3})
+	if err := reader.Unserialize(&a); err != nil || len(a) != 3 {
+		t.Error(a, err)
+	}
+}
+
+func TestReaderLimitsStringLength(t *testing.T) {
+	reader := NewReader(NewBufReader([]byte(`b999999999"`)))
+	reader.(LimitSetter).SetLimits(ReaderLimits{MaxStringLength: 1000})
+	var b []byte
+	checkLimitError(t, reader.Unserialize(&b), StringLengthLimit)
+	reader = NewReader(NewBufReader([]byte(`s999999999"`)))
+	reader.(LimitSetter).SetLimits(ReaderLimits{MaxStringLength: 1000})
+	_, err := reader.ReadRaw()
+	checkLimitError(t, err, StringLengthLimit)
+}
+
+func TestReaderLimitsDepth(t *testing.T) {
+	data := []byte(`a1{a1{a1{1}}}`)
+	reader := NewReader(NewBufReader(data))
+	reader.(LimitSetter).SetLimits(ReaderLimits{MaxDepth: 2})
+	var e interface{}
+	checkLimitError(t, reader.Unserialize(&e), DepthLimit)
+	reader = NewReader(NewBufReader(data))
+	reader.(LimitSetter).SetLimits(ReaderLimits{MaxDepth: 2})
+	_, err := reader.ReadRaw()
+	checkLimitError(t, err, DepthLimit)
+	reader = NewReader(NewBufReader(data))
+	reader.(LimitSetter).SetLimits(ReaderLimits{MaxDepth: 3})
+	var a [][][]int
+	if err := reader.Unserialize(&a); err != nil || a[0][0][0] != 1 {
+		t.Error(a, err)
+	}
+}
+
+func TestReaderLimitsRefs(t *testing.T) {
+	data := []byte(`a2{s1"a"s1"b"}`)
+	reader := NewReader(NewBufReader(data))
+	reader.(LimitSetter).SetLimits(ReaderLimits{MaxRefs: 2})
+	var a []string
+	checkLimitError(t, reader.Unserialize(&a), RefsLimit)
+	reader = NewSimpleReader(NewBufReader(data))
+	reader.(LimitSetter).SetLimits(ReaderLimits{MaxRefs: 2})
+	if err := reader.Unserialize(&a); err != nil {
+		t.Error(err.Error())
+	}
+}
+
+func TestReaderLimitsMessageSize(t *testing.T) {
+	reader := NewReader(NewBufReader([]byte(`s10"0123456789"i12345678;`)))
+	reader.(LimitSetter).SetLimits(ReaderLimits{MaxMessageSize: 16})
+	var s string
+	if err := reader.Unserialize(&s); err != nil {
+		t.Error(err.Error())
+	}
+	var i int
+	checkLimitError(t, reader.Unserialize(&i), MessageSizeLimit)
+}
+
+func TestReaderBadIndex(t *testing.T) {
+	reader := NewReader(NewBufReader([]byte(`r5;o3{}a-1{}`)))
+	var e interface{}
+	if err := reader.Unserialize(&e); err == nil {
+		t.Error("expected bad reference index")
+	}
+	if err := reader.Unserialize(&e); err == nil {
+		t.Error("expected bad class index")
+	}
+	if err := reader.Unserialize(&e); err == nil {
+		t.Error("expected bad length")
+	}
+}
@@ -22,9 +22,13 @@ package hprose
 
 import (
 	"bytes"
+	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"io"
+	"net"
+	"net/http"
 	"reflect"
 	"strings"
 )
@@ -37,6 +41,65 @@ type ServiceEvent interface {
 	OnSendError(err error)
 }
 
+// ServiceContext is passed to the method handlers, it is created for every
+// invoking. A method handler can pass values to the next handlers and to
+// the method by replacing the embedded context.Context with
+// context.WithValue.
+//
+// When the first parameter of a method is a *ServiceContext or a
+// context.Context, the ServiceContext is passed to it, and it isn't counted
+// as an argument sent by the client.
+type ServiceContext struct {
+	context.Context
+	// Request is the http request served by the HttpService and the
+	// WebSocketService.
+	Request *http.Request
+	// Conn is the connection served by the TcpService and the
+	// WebSocketService.
+	Conn    net.Conn
+	Method  *Method
+	ByRef   bool
+	missing bool
+	// args are the arguments the method is called with, which may be
+	// replaced by the method handlers.
+	args []reflect.Value
+}
+
+var serviceContextType = reflect.TypeOf((*ServiceContext)(nil))
+
+// ConnectionState returns the state of the TLS connection, or nil when the
+// request isn't sent on a TLS connection. The certificates of the client
+// are in its PeerCertificates and VerifiedChains.
+func (context *ServiceContext) ConnectionState() *tls.ConnectionState {
+	if context.Request != nil && context.Request.TLS != nil {
+		return context.Request.TLS
+	}
+	if conn, ok := context.Conn.(*tls.Conn); ok {
+		state := conn.ConnectionState()
+		return &state
+	}
+	return nil
+}
+
+func hasServiceContext(ft reflect.Type) bool {
+	if ft.NumIn() == 0 {
+		return false
+	}
+	t := ft.In(0)
+	return t == serviceContextType || t == contextType
+}
+
+// NextMethodHandler is the rest of the method handler chain, the last one
+// calls the method.
+type NextMethodHandler func(name string, args []reflect.Value, context *ServiceContext) (results []reflect.Value, err error)
+
+// MethodHandler is a service middleware which wraps every method call. It
+// can change the args before calling next, replace the results, or reject
+// the call by returning an error, which is sent to the client. The args the
+// method is called with are passed to OnAfterInvoke and sent back to the
+// client when the call is by reference.
+type MethodHandler func(name string, args []reflect.Value, context *ServiceContext, next NextMethodHandler) (results []reflect.Value, err error)
+
 type Method struct {
 	Function   reflect.Value
 	ResultMode ResultMode
@@ -117,14 +180,40 @@ type BaseService struct {
 	*Methods
 	ServiceEvent
 	Filter
-	IOError error
+	Limits        ReaderLimits
+	handlers      []MethodHandler
+	methodHandler NextMethodHandler
+}
+
+// serviceSession is created for every request, it holds the streams of the
+// request and the I/O error, so the requests on different connections never
+// share any state.
+type serviceSession struct {
+	istream BufReader
+	ostream io.Writer
+	context *ServiceContext
+	err     error
 }
 
 func NewBaseService() *BaseService {
-	return &BaseService{Methods: NewMethods()}
+	return &BaseService{Methods: NewMethods(), Limits: DefaultServiceLimits}
+}
+
+// Use appends the method handlers to the chain, the first one is the
+// outermost. It should be called before serving.
+func (service *BaseService) Use(handlers ...MethodHandler) {
+	service.handlers = append(service.handlers, handlers...)
+	next := NextMethodHandler(service.callMethod)
+	for i := len(service.handlers) - 1; i >= 0; i-- {
+		handler, n := service.handlers[i], next
+		next = func(name string, args []reflect.Value, context *ServiceContext) ([]reflect.Value, error) {
+			return handler(name, args, context, n)
+		}
+	}
+	service.methodHandler = next
 }
 
-func (service *BaseService) responseEnd(ostream io.Writer, buf []byte, err error) {
+func (service *BaseService) responseEnd(session *serviceSession, buf []byte, err error) {
 	defer recover()
 	if service.Filter != nil {
 		buf = service.OutputFilter(buf)
@@ -132,30 +221,31 @@ func (service *BaseService) responseEnd(ostream io.Writer, buf []byte, err error
 	if err != nil && service.ServiceEvent != nil {
 		service.OnSendError(err)
 	}
-	if _, err := ostream.Write(buf); err != nil {
-		service.IOError = err
+	if _, err := session.ostream.Write(buf); err != nil {
+		session.err = err
 	}
 }
 
-func (service *BaseService) sendError(ostream io.Writer, err error) {
+func (service *BaseService) sendError(session *serviceSession, err error) {
 	defer recover()
 	buf := new(bytes.Buffer)
 	writer := NewSimpleWriter(buf)
 	writer.Stream().WriteByte(TagError)
 	writer.WriteString(err.Error())
 	writer.Stream().WriteByte(TagEnd)
-	service.responseEnd(ostream, buf.Bytes(), err)
+	service.responseEnd(session, buf.Bytes(), err)
 }
 
-func (service *BaseService) doInvoke(istream BufReader, ostream io.Writer) (err error) {
-	reader := NewReader(istream)
+func (service *BaseService) doInvoke(session *serviceSession) (err error) {
+	reader := NewReader(session.istream)
+	reader.(LimitSetter).SetLimits(service.Limits)
 	buf := new(bytes.Buffer)
 	for {
 		reader.Reset()
 		var name string
 		name, err = reader.ReadString()
 		if err != nil {
-			service.IOError = err
+			session.err = err
 			return err
 		}
 		alias := strings.ToLower(name)
@@ -165,13 +255,16 @@ func (service *BaseService) doInvoke(istream BufReader, ostream io.Writer) (err
 		byref := false
 		var tag byte
 		if tag, err = reader.CheckTags([]byte{TagList, TagEnd, TagCall}); err != nil {
-			service.IOError = err
+			session.err = err
 			return err
 		}
 		if tag == TagList {
 			reader.Reset()
-			if count, err = reader.ReadInteger(TagOpenbrace); err != nil {
-				service.IOError = err
+			if count, err = reader.ReadInteger(TagOpenbrace); err == nil {
+				err = service.Limits.checkCount(count)
+			}
+			if err != nil {
+				session.err = err
 				return err
 			}
 			args = make([]reflect.Value, count)
@@ -181,26 +274,30 @@ func (service *BaseService) doInvoke(istream BufReader, ostream io.Writer) (err
 					args[i] = reflect.ValueOf(&e).Elem()
 				}
 				if err = reader.ReadArray(args); err != nil {
-					service.IOError = err
+					session.err = err
 					return err
 				}
 			} else {
 				ft := remoteMethod.Function.Type()
-				n := ft.NumIn()
+				first := 0
+				if hasServiceContext(ft) {
+					first = 1
+				}
+				n := ft.NumIn() - first
 				if ft.IsVariadic() {
 					n--
 				}
 				if n < count {
 					for i := 0; i < n; i++ {
-						args[i] = reflect.New(ft.In(i)).Elem()
+						args[i] = reflect.New(ft.In(first + i)).Elem()
 					}
 					if ft.IsVariadic() {
-						t := ft.In(n).Elem()
+						t := ft.In(first + n).Elem()
 						for i := n; i < count; i++ {
 							args[i] = reflect.New(t).Elem()
 						}
 						if err = reader.ReadArray(args); err != nil {
-							service.IOError = err
+							session.err = err
 							return err
 						}
 					} else {
@@ -209,29 +306,29 @@ func (service *BaseService) doInvoke(istream BufReader, ostream io.Writer) (err
 							args[i] = reflect.ValueOf(&e).Elem()
 						}
 						if err = reader.ReadArray(args); err != nil {
-							service.IOError = err
+							session.err = err
 							return err
 						}
 						args = args[:n]
 					}
 				} else {
 					for i := 0; i < n; i++ {
-						args[i] = reflect.New(ft.In(i)).Elem()
+						args[i] = reflect.New(ft.In(first + i)).Elem()
 					}
 					if err = reader.ReadArray(args[0:count]); err != nil {
-						service.IOError = err
+						session.err = err
 						return err
 					}
 				}
 			}
 			if tag, err = reader.CheckTags([]byte{TagTrue, TagEnd, TagCall}); err != nil {
-				service.IOError = err
+				session.err = err
 				return err
 			}
 			if tag == TagTrue {
 				byref = true
 				if tag, err = reader.CheckTags([]byte{TagEnd, TagCall}); err != nil {
-					service.IOError = err
+					session.err = err
 					return err
 				}
 			}
@@ -241,29 +338,29 @@ func (service *BaseService) doInvoke(istream BufReader, ostream io.Writer) (err
 		if service.ServiceEvent != nil {
 			service.OnBeforeInvoke(name, args, byref)
 		}
-		var result []reflect.Value
-		if result, err = func() (out []reflect.Value, err error) {
-			defer func() {
-				if e := recover(); e != nil && err == nil {
-					err = fmt.Errorf("%v", e)
-				}
-			}()
-			if remoteMethod == nil {
-				remoteMethod = service.RemoteMethods["*"]
-				if remoteMethod == nil {
-					return nil, errors.New("Can't find this method " + name)
-				}
-				if missingMethod, ok := remoteMethod.Function.Interface().(MissingMethod); ok {
-					return missingMethod(name, args), nil
-				} else {
-					return nil, errors.New("Can't find this method " + name)
-				}
-			} else {
-				return remoteMethod.Function.Call(args), nil
+		missing := remoteMethod == nil
+		if missing {
+			if remoteMethod = service.RemoteMethods["*"]; remoteMethod == nil {
+				return errors.New("Can't find this method " + name)
 			}
-		}(); err != nil {
+		}
+		context := new(ServiceContext)
+		*context = *session.context
+		context.Method = remoteMethod
+		context.ByRef = byref
+		context.missing = missing
+		var result []reflect.Value
+		if service.methodHandler != nil {
+			result, err = service.methodHandler(name, args, context)
+		} else {
+			result, err = service.callMethod(name, args, context)
+		}
+		if err != nil {
 			return err
 		}
+		if context.args != nil {
+			args = context.args
+		}
 		if service.ServiceEvent != nil {
 			service.OnAfterInvoke(name, args, byref, result)
 		}
@@ -302,7 +399,7 @@ func (service *BaseService) doInvoke(istream BufReader, ostream io.Writer) (err
 				}
 			}
 			if remoteMethod.ResultMode == RawWithEndTag {
-				service.responseEnd(ostream, data, nil)
+				service.responseEnd(session, data, nil)
 				return nil
 			}
 		}
@@ -346,11 +443,30 @@ func (service *BaseService) doInvoke(istream BufReader, ostream io.Writer) (err
 		}
 	}
 	buf.WriteByte(TagEnd)
-	service.responseEnd(ostream, buf.Bytes(), nil)
+	service.responseEnd(session, buf.Bytes(), nil)
 	return nil
 }
 
-func (service *BaseService) doFunctionList(ostream io.Writer) error {
+func (service *BaseService) callMethod(name string, args []reflect.Value, context *ServiceContext) (result []reflect.Value, err error) {
+	defer func() {
+		if e := recover(); e != nil && err == nil {
+			err = fmt.Errorf("%v", e)
+		}
+	}()
+	context.args = args
+	if context.missing {
+		if missingMethod, ok := context.Method.Function.Interface().(MissingMethod); ok {
+			return missingMethod(name, args), nil
+		}
+		return nil, errors.New("Can't find this method " + name)
+	}
+	if hasServiceContext(context.Method.Function.Type()) {
+		args = append([]reflect.Value{reflect.ValueOf(context)}, args...)
+	}
+	return context.Method.Function.Call(args), nil
+}
+
+func (service *BaseService) doFunctionList(session *serviceSession) error {
 	buf := new(bytes.Buffer)
 	writer := NewSimpleWriter(buf)
 	writer.Stream().WriteByte(TagFunctions)
@@ -358,35 +474,49 @@ func (service *BaseService) doFunctionList(ostream io.Writer) error {
 		return err
 	}
 	writer.Stream().WriteByte(TagEnd)
-	service.responseEnd(ostream, buf.Bytes(), nil)
+	service.responseEnd(session, buf.Bytes(), nil)
 	return nil
 }
 
-func (service *BaseService) Handle(istream BufReader, ostream io.Writer) {
+// Handle reads a request from istream and writes the response to ostream.
+// The errors of the request are sent to the client, the returned error is
+// the I/O error of istream or ostream, after which the streams can't be
+// used any more.
+func (service *BaseService) Handle(istream BufReader, ostream io.Writer) error {
+	return service.handle(&serviceSession{
+		istream: istream,
+		ostream: ostream,
+		context: &ServiceContext{Context: context.Background()},
+	})
+}
+
+func (service *BaseService) handle(session *serviceSession) (ioError error) {
 	var err error
 	defer func() {
 		if e := recover(); e != nil && err == nil {
 			err = fmt.Errorf("%v", e)
 		}
 		if err != nil {
-			service.sendError(ostream, err)
+			service.sendError(session, err)
 		}
+		ioError = session.err
 	}()
 	if service.Filter != nil {
-		istream = service.InputFilter(istream)
+		session.istream = service.InputFilter(session.istream)
 	}
 	buf := []byte{0}
-	if _, err = istream.Read(buf); err == nil {
+	if _, err = session.istream.Read(buf); err == nil {
 		tag := buf[0]
 		switch tag {
 		case TagCall:
-			err = service.doInvoke(istream, ostream)
+			err = service.doInvoke(session)
 		case TagEnd:
-			err = service.doFunctionList(ostream)
+			err = service.doFunctionList(session)
 		default:
 			err = errors.New("Unknown Tag: " + string(buf))
 		}
 	} else {
-		service.IOError = err
+		session.err = err
 	}
+	return nil
 }
@@ -21,17 +21,44 @@
 package hprose_test
 
 import (
+	"bufio"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"hprose"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 func hello(name string) string {
 	return "Hello " + name + "!"
 }
 
+func slowHello(name string) string {
+	time.Sleep(500 * time.Millisecond)
+	return hello(name)
+}
+
 type testServe int
 
 func (*testServe) Swap(a int, b int) (int, int) {
@@ -60,6 +87,41 @@ type testRemoteObject2 struct {
 	PanicTest func() error
 }
 
+type testRemoteObject3 struct {
+	Hello     func(context.Context, string) (string, error)
+	SlowHello func(context.Context, string) (string, error)
+}
+
+func testServiceContext(t *testing.T, client hprose.Client) {
+	var ro *testRemoteObject3
+	client.UseService(&ro)
+	if s, err := ro.Hello(context.Background(), "World"); err != nil {
+		t.Error(err.Error())
+	} else if s != "Hello World!" {
+		t.Error(s)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, err := ro.SlowHello(ctx, "World"); err != context.DeadlineExceeded {
+		t.Error(err)
+	}
+	if d := time.Since(start); d > 400*time.Millisecond {
+		t.Error("the call was not cancelled in time:", d)
+	}
+	var s string
+	if err := <-client.(hprose.ContextInvoker).InvokeContext(context.Background(), "slowHello", []interface{}{"World"}, nil, &s); err != nil {
+		t.Error(err.Error())
+	} else if s != "Hello World!" {
+		t.Error(s)
+	}
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	if err := <-client.(hprose.ContextInvoker).InvokeContext(ctx, "hello", []interface{}{"World"}, nil, &s); err != context.Canceled {
+		t.Error(err)
+	}
+}
+
 func TestHttpService(t *testing.T) {
 	service := hprose.NewHttpService()
 	service.AddFunction("hello", hello)
@@ -131,3 +193,1328 @@ func TestTcpService(t *testing.T) {
 		t.Error("missing panic")
 	}
 }
+
+type testEncodedUser struct {
+	Id   int
+	Name string
+}
+
+func TestHttpServiceStreamFunc(t *testing.T) {
+	service := hprose.NewHttpService()
+	service.AddFunction("users", func(names ...string) hprose.StreamFunc {
+		return func(encoder *hprose.Encoder) error {
+			if err := encoder.BeginList(len(names)); err != nil {
+				return err
+			}
+			for i, name := range names {
+				if err := encoder.BeginObject("testEncodedUser", "id", "name"); err != nil {
+					return err
+				}
+				if err := encoder.WriteInt64(int64(i)); err != nil {
+					return err
+				}
+				if err := encoder.WriteString(name); err != nil {
+					return err
+				}
+				if err := encoder.End(); err != nil {
+					return err
+				}
+			}
+			return encoder.End()
+		}
+	})
+	service.AddFunction("broken", func() hprose.StreamFunc {
+		return func(encoder *hprose.Encoder) error {
+			return encoder.BeginList(1)
+		}
+	})
+	server := httptest.NewServer(service)
+	defer server.Close()
+	client := hprose.NewClient(server.URL)
+	var ro struct {
+		Users  func(...string) ([]testEncodedUser, error)
+		Broken func() error
+	}
+	client.UseService(&ro)
+	users, err := ro.Users("Tom", "Jerry")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(users) != 2 || users[0] != (testEncodedUser{0, "Tom"}) || users[1] != (testEncodedUser{1, "Jerry"}) {
+		t.Error(users)
+	}
+	if err := ro.Broken(); err == nil || err.Error() != "1 collections are not ended" {
+		t.Error(err)
+	}
+}
+
+func TestHttpServiceFunctionList(t *testing.T) {
+	service := hprose.NewHttpService()
+	service.AddFunction("hello", hello)
+	server := httptest.NewServer(service)
+	defer server.Close()
+	client := hprose.NewClient(server.URL)
+	var calls []string
+	client.(*hprose.HttpClient).Use(func(name string, args []reflect.Value, context *hprose.ClientContext, next hprose.NextInvokeHandler) error {
+		calls = append(calls, name)
+		return next(name, args, context)
+	})
+	names, err := client.(hprose.FunctionLister).FunctionList(context.Background())
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	found := false
+	for _, name := range names {
+		found = found || name == "hello"
+	}
+	if !found {
+		t.Error(names)
+	}
+	if len(calls) != 1 || calls[0] != "" {
+		t.Error(calls)
+	}
+}
+
+func TestHttpServiceContext(t *testing.T) {
+	service := hprose.NewHttpService()
+	service.AddFunction("hello", hello)
+	service.AddFunction("slowHello", slowHello)
+	server := httptest.NewServer(service)
+	defer server.Close()
+	testServiceContext(t, hprose.NewClient(server.URL))
+}
+
+// testLegacyTransporter hides GetInvokeContextWithContext of the
+// HttpTransporter, like the transporters written before ContextTransporter.
+type testLegacyTransporter struct {
+	trans *hprose.HttpTransporter
+}
+
+func (t testLegacyTransporter) GetInvokeContext(uri string) (interface{}, error) {
+	return t.trans.GetInvokeContext(uri)
+}
+
+func (t testLegacyTransporter) SendData(context interface{}, data []byte, success bool) error {
+	return t.trans.SendData(context, data, success)
+}
+
+func (t testLegacyTransporter) GetInputStream(context interface{}) (hprose.BufReader, error) {
+	return t.trans.GetInputStream(context)
+}
+
+func (t testLegacyTransporter) EndInvoke(context interface{}, success bool) error {
+	return t.trans.EndInvoke(context, success)
+}
+
+func TestLegacyTransporterContext(t *testing.T) {
+	service := hprose.NewHttpService()
+	service.AddFunction("hello", hello)
+	service.AddFunction("slowHello", slowHello)
+	server := httptest.NewServer(service)
+	defer server.Close()
+	trans := hprose.NewHttpClient(server.URL).(*hprose.HttpClient).Transporter.(*hprose.HttpTransporter)
+	client := hprose.NewBaseClient(testLegacyTransporter{trans})
+	client.SetUri(server.URL)
+	var ro *testRemoteObject3
+	client.UseService(&ro)
+	if s, err := ro.Hello(context.Background(), "World"); err != nil {
+		t.Error(err.Error())
+	} else if s != "Hello World!" {
+		t.Error(s)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := ro.SlowHello(ctx, "World"); err != context.DeadlineExceeded {
+		t.Error(err)
+	}
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	if _, err := ro.Hello(ctx, "World"); err != context.Canceled {
+		t.Error(err)
+	}
+}
+
+func TestTcpServiceContext(t *testing.T) {
+	server := hprose.NewTcpServer("")
+	server.AddFunction("hello", hello)
+	server.AddFunction("slowHello", slowHello)
+	go server.Start()
+	defer server.Close()
+	testServiceContext(t, hprose.NewClient(server.URL))
+}
+
+// testConnCounter counts the connections open on a listener.
+type testConnCounter struct {
+	open int32
+	max  int32
+}
+
+type testCountedConn struct {
+	net.Conn
+	counter *testConnCounter
+	once    sync.Once
+}
+
+func (c *testCountedConn) Close() error {
+	c.once.Do(func() { atomic.AddInt32(&c.counter.open, -1) })
+	return c.Conn.Close()
+}
+
+func (c *testConnCounter) Open() int32 {
+	return atomic.LoadInt32(&c.open)
+}
+
+// serveCounted serves the connections accepted by a local listener with
+// serve, and counts them.
+func serveCounted(t *testing.T, serve func(conn net.Conn)) (uri string, counter *testConnCounter) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	t.Cleanup(func() { listener.Close() })
+	counter = new(testConnCounter)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			n := atomic.AddInt32(&counter.open, 1)
+			for {
+				max := atomic.LoadInt32(&counter.max)
+				if n <= max || atomic.CompareAndSwapInt32(&counter.max, max, n) {
+					break
+				}
+			}
+			serve(&testCountedConn{Conn: conn, counter: counter})
+		}
+	}()
+	return "tcp://" + listener.Addr().String(), counter
+}
+
+func TestTcpClientConcurrent(t *testing.T) {
+	service := hprose.NewTcpService()
+	service.AddFunction("hello", hello)
+	service.AddMethods(new(testServe))
+	uri, counter := serveCounted(t, service.ServeTCP)
+	client := hprose.NewClient(uri).(*hprose.TcpClient)
+	defer client.Close()
+	client.SetMaxPoolSize(4)
+	var ro *testRemoteObject2
+	client.UseService(&ro)
+	var wg sync.WaitGroup
+	for i := 0; i < 32; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				name := fmt.Sprint("World", i, j)
+				if s, err := ro.Hello(name); err != nil {
+					t.Error(err.Error())
+				} else if s != "Hello "+name+"!" {
+					t.Error(s)
+				}
+				if a, b, err := ro.Swap(i, j); err != nil {
+					t.Error(err.Error())
+				} else if a != j || b != i {
+					t.Error(a, b)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	if max := atomic.LoadInt32(&counter.max); max > 4 || max < 2 {
+		t.Error("the maximum number of the connections is", max)
+	}
+}
+
+func waitConnCount(t *testing.T, counter *testConnCounter, n int32) {
+	deadline := time.Now().Add(time.Second)
+	for counter.Open() != n {
+		if time.Now().After(deadline) {
+			t.Fatal("the number of the open connections is", counter.Open(), "not", n)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestTcpClientIdleTimeout(t *testing.T) {
+	service := hprose.NewTcpService()
+	service.AddFunction("hello", hello)
+	uri, counter := serveCounted(t, service.ServeTCP)
+	client := hprose.NewClient(uri).(*hprose.TcpClient)
+	defer client.Close()
+	client.SetIdleTimeout(50 * time.Millisecond)
+	var ro *testRemoteObject2
+	client.UseService(&ro)
+	for i := 0; i < 2; i++ {
+		if s, err := ro.Hello("World"); err != nil {
+			t.Error(err.Error())
+		} else if s != "Hello World!" {
+			t.Error(s)
+		}
+		waitConnCount(t, counter, 1)
+		// the client is not used, the idle connection is closed by the timer
+		time.Sleep(100 * time.Millisecond)
+		waitConnCount(t, counter, 0)
+	}
+}
+
+func TestTcpClientBrokenIdleConn(t *testing.T) {
+	service := hprose.NewTcpService()
+	service.AddFunction("hello", hello)
+	uri, _ := serveCounted(t, func(conn net.Conn) {
+		// the server closes the connection after a request
+		go func() {
+			defer conn.Close()
+			service.Handle(bufio.NewReader(conn), conn)
+		}()
+	})
+	client := hprose.NewClient(uri).(*hprose.TcpClient)
+	defer client.Close()
+	client.SetMaxPoolSize(1)
+	var ro *testRemoteObject2
+	client.UseService(&ro)
+	for i := 0; i < 3; i++ {
+		if s, err := ro.Hello("World"); err != nil {
+			t.Error(err.Error())
+		} else if s != "Hello World!" {
+			t.Error(s)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func TestTcpClientFullDuplex(t *testing.T) {
+	server := hprose.NewTcpServer("")
+	server.AddFunction("hello", hello)
+	server.AddFunction("slowHello", slowHello)
+	go server.Start()
+	defer server.Close()
+	client := hprose.NewClient(server.URL).(*hprose.TcpClient)
+	defer client.Close()
+	client.SetFullDuplex(true)
+	client.SetMaxPoolSize(1)
+	var ro *testRemoteObject3
+	client.UseService(&ro)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if s, err := ro.SlowHello(context.Background(), "Slow"); err != nil {
+			t.Error(err.Error())
+		} else if s != "Hello Slow!" {
+			t.Error(s)
+		}
+	}()
+	time.Sleep(50 * time.Millisecond)
+	for i := 0; i < 10; i++ {
+		name := fmt.Sprint("World", i)
+		if s, err := ro.Hello(context.Background(), name); err != nil {
+			t.Error(err.Error())
+		} else if s != "Hello "+name+"!" {
+			t.Error(s)
+		}
+	}
+	select {
+	case <-done:
+		t.Error("the responses were not out of order")
+	default:
+	}
+	<-done
+	testServiceContext(t, client)
+}
+
+func TestTcpClientFullDuplexFallback(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer listener.Close()
+	service := hprose.NewTcpService()
+	service.AddFunction("hello", hello)
+	go func() {
+		// a server without the full duplex mode
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		istream := bufio.NewReader(conn)
+		for service.Handle(istream, conn) == nil {
+		}
+	}()
+	client := hprose.NewClient("tcp://" + listener.Addr().String()).(*hprose.TcpClient)
+	defer client.Close()
+	client.SetFullDuplex(true)
+	client.SetMaxPoolSize(1)
+	var ro *testRemoteObject2
+	client.UseService(&ro)
+	for i := 0; i < 3; i++ {
+		if s, err := ro.Hello("World"); err != nil {
+			t.Error(err.Error())
+		} else if s != "Hello World!" {
+			t.Error(s)
+		}
+	}
+}
+
+func TestTcpClientFullDuplexWriteCancel(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer listener.Close()
+	go func() {
+		// a server which accepts the full duplex mode and stops reading
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.Read(make([]byte, 1))
+		conn.Write([]byte{'!'})
+		time.Sleep(time.Second)
+	}()
+	client := hprose.NewClient("tcp://" + listener.Addr().String()).(*hprose.TcpClient)
+	defer client.Close()
+	client.SetFullDuplex(true)
+	var ro *testRemoteObject3
+	client.UseService(&ro)
+	name := strings.Repeat("World", 1<<22)
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, err := ro.Hello(ctx, name); err != context.DeadlineExceeded {
+		t.Error(err)
+	}
+	if d := time.Since(start); d > 500*time.Millisecond {
+		t.Error("the write was not cancelled in time:", d)
+	}
+}
+
+var testActive, testMaxActive int32
+
+func countedHello(name string) string {
+	n := atomic.AddInt32(&testActive, 1)
+	defer atomic.AddInt32(&testActive, -1)
+	for {
+		max := atomic.LoadInt32(&testMaxActive)
+		if n <= max || atomic.CompareAndSwapInt32(&testMaxActive, max, n) {
+			break
+		}
+	}
+	time.Sleep(20 * time.Millisecond)
+	return hello(name)
+}
+
+func TestTcpServiceMaxConcurrentRequests(t *testing.T) {
+	atomic.StoreInt32(&testMaxActive, 0)
+	server := hprose.NewTcpServer("")
+	server.AddFunction("hello", countedHello)
+	server.MaxConcurrentRequests = 2
+	go server.Start()
+	defer server.Close()
+	client := hprose.NewClient(server.URL).(*hprose.TcpClient)
+	defer client.Close()
+	client.SetFullDuplex(true)
+	var ro *testRemoteObject2
+	client.UseService(&ro)
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			name := fmt.Sprint("World", i)
+			if s, err := ro.Hello(name); err != nil {
+				t.Error(err.Error())
+			} else if s != "Hello "+name+"!" {
+				t.Error(s)
+			}
+		}(i)
+	}
+	wg.Wait()
+	if max := atomic.LoadInt32(&testMaxActive); max != 2 {
+		t.Error("the maximum number of the concurrent requests is", max)
+	}
+}
+
+func TestTcpClientFramed(t *testing.T) {
+	server := hprose.NewTcpServer("")
+	server.AddFunction("hello", hello)
+	server.Limits.MaxMessageSize = 64
+	go server.Start()
+	defer server.Close()
+	client := hprose.NewClient(server.URL).(*hprose.TcpClient)
+	defer client.Close()
+	client.SetFramed(true)
+	client.SetMaxPoolSize(1)
+	var ro *testRemoteObject2
+	client.UseService(&ro)
+	if s, err := ro.Hello("World"); err != nil {
+		t.Error(err.Error())
+	} else if s != "Hello World!" {
+		t.Error(s)
+	}
+	if _, err := ro.Hello(strings.Repeat("World", 20)); err == nil || err.Error() != hprose.ErrMessageTooLarge.Error() {
+		t.Error(err)
+	}
+	if s, err := ro.Hello("World"); err != nil {
+		t.Error(err.Error())
+	} else if s != "Hello World!" {
+		t.Error(s)
+	}
+	client.Limits.MaxMessageSize = 8
+	if _, err := ro.Hello("World"); err != hprose.ErrMessageTooLarge {
+		t.Error(err)
+	}
+}
+
+func TestTcpServiceFramedResync(t *testing.T) {
+	server := hprose.NewTcpServer("")
+	server.AddFunction("hello", hello)
+	go server.Start()
+	defer server.Close()
+	conn, err := net.Dial("tcp", server.TCPListener.Addr().String())
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer conn.Close()
+	istream := bufio.NewReader(conn)
+	if _, err := conn.Write([]byte{'!'}); err != nil {
+		t.Fatal(err.Error())
+	}
+	if b, err := istream.ReadByte(); err != nil || b != '!' {
+		t.Fatal(b, err)
+	}
+	call := func(request string) string {
+		header := make([]byte, 4)
+		binary.BigEndian.PutUint32(header, uint32(len(request)))
+		if _, err := conn.Write(append(header, request...)); err != nil {
+			t.Fatal(err.Error())
+		}
+		if _, err := io.ReadFull(istream, header); err != nil {
+			t.Fatal(err.Error())
+		}
+		response := make([]byte, binary.BigEndian.Uint32(header))
+		if _, err := io.ReadFull(istream, response); err != nil {
+			t.Fatal(err.Error())
+		}
+		return string(response)
+	}
+	if response := call(`Cs5"hello"a1{s5"Wor`); response[0] != 'E' {
+		t.Error(response)
+	}
+	if response := call(`Cs5"hello"a1{s5"World"}z`); response != `Rs12"Hello World!"z` {
+		t.Error(response)
+	}
+}
+
+func TestWebSocketService(t *testing.T) {
+	service := hprose.NewWebSocketService()
+	service.AddFunction("hello", hello)
+	service.AddFunction("slowHello", slowHello)
+	service.AddMethods(new(testServe))
+	server := httptest.NewServer(service)
+	defer server.Close()
+	client := hprose.NewClient("ws" + strings.TrimPrefix(server.URL, "http")).(*hprose.WebSocketClient)
+	defer client.Close()
+	var ro *testRemoteObject2
+	client.UseService(&ro)
+	if s, err := ro.Hello("World"); err != nil {
+		t.Error(err.Error())
+	} else if s != "Hello World!" {
+		t.Error(s)
+	}
+	if a, b, err := ro.Swap(1, 2); err != nil {
+		t.Error(err.Error())
+	} else if a != 2 || b != 1 {
+		t.Error(a, b)
+	}
+	if sum, err := ro.Sum(1); err == nil {
+		t.Error(sum)
+	}
+	if err := ro.PanicTest(); err == nil {
+		t.Error("missing panic")
+	}
+	var ro3 *testRemoteObject3
+	client.UseService(&ro3)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if s, err := ro3.SlowHello(context.Background(), "Slow"); err != nil {
+			t.Error(err.Error())
+		} else if s != "Hello Slow!" {
+			t.Error(s)
+		}
+	}()
+	time.Sleep(50 * time.Millisecond)
+	var wg sync.WaitGroup
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			name := fmt.Sprint("World", i)
+			if s, err := ro3.Hello(context.Background(), name); err != nil {
+				t.Error(err.Error())
+			} else if s != "Hello "+name+"!" {
+				t.Error(s)
+			}
+		}(i)
+	}
+	wg.Wait()
+	select {
+	case <-done:
+		t.Error("the responses were not out of order")
+	default:
+	}
+	<-done
+	testServiceContext(t, client)
+	hprose.NewClient(server.URL).UseService(&ro)
+	if s, err := ro.Hello("World"); err != nil {
+		t.Error(err.Error())
+	} else if s != "Hello World!" {
+		t.Error(s)
+	}
+}
+
+func TestWebSocketServiceOrigin(t *testing.T) {
+	service := hprose.NewWebSocketService()
+	service.AddFunction("hello", hello)
+	server := httptest.NewServer(service)
+	defer server.Close()
+	uri := "ws" + strings.TrimPrefix(server.URL, "http")
+	for _, origin := range []string{"", server.URL, "http://evil.example"} {
+		client := hprose.NewClient(uri).(*hprose.WebSocketClient)
+		if origin != "" {
+			client.Header().Set("Origin", origin)
+		}
+		var ro *testRemoteObject2
+		client.UseService(&ro)
+		_, err := ro.Hello("World")
+		if accepted := origin != "http://evil.example"; accepted != (err == nil) {
+			t.Error(origin, err)
+		}
+		client.Close()
+	}
+	request, _ := http.NewRequest("GET", server.URL, nil)
+	request.Header.Set("Upgrade", "websocket")
+	request.Header.Set("Connection", "Upgrade")
+	request.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+	request.Header.Set("Sec-WebSocket-Version", "13")
+	request.Header.Set("Origin", "http://evil.example")
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusForbidden {
+		t.Error(response.Status)
+	}
+	service.CheckOrigin = func(*http.Request) bool { return true }
+	client := hprose.NewClient(uri).(*hprose.WebSocketClient)
+	defer client.Close()
+	client.Header().Set("Origin", "http://evil.example")
+	var ro *testRemoteObject2
+	client.UseService(&ro)
+	if _, err := ro.Hello("World"); err != nil {
+		t.Error(err.Error())
+	}
+}
+
+func TestWebSocketServiceUnmaskedFrame(t *testing.T) {
+	service := hprose.NewWebSocketService()
+	service.AddFunction("hello", hello)
+	server := httptest.NewServer(service)
+	defer server.Close()
+	conn, err := net.Dial("tcp", strings.TrimPrefix(server.URL, "http://"))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer conn.Close()
+	io.WriteString(conn, "GET / HTTP/1.1\r\n"+
+		"Host: "+strings.TrimPrefix(server.URL, "http://")+"\r\n"+
+		"Upgrade: websocket\r\n"+
+		"Connection: Upgrade\r\n"+
+		"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n"+
+		"Sec-WebSocket-Version: 13\r\n\r\n")
+	istream := bufio.NewReader(conn)
+	response, err := http.ReadResponse(istream, nil)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if response.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatal(response.Status)
+	}
+	// an unmasked binary frame with the request id 1 and an empty request
+	conn.Write([]byte{0x82, 4, 0, 0, 0, 1})
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	frame := make([]byte, 4)
+	if _, err := io.ReadFull(istream, frame); err != nil {
+		t.Fatal(err.Error())
+	}
+	if frame[0] != 0x88 || binary.BigEndian.Uint16(frame[2:]) != 1002 {
+		t.Error(frame)
+	}
+}
+
+func TestWebSocketClientWriteCancel(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer listener.Close()
+	go func() {
+		// a server which accepts the websocket and stops reading
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		request, err := http.ReadRequest(bufio.NewReader(conn))
+		if err != nil {
+			return
+		}
+		h := sha1.New()
+		io.WriteString(h, request.Header.Get("Sec-WebSocket-Key")+"258EAFA5-E914-47DA-95CA-C5AB0DC85B11")
+		io.WriteString(conn, "HTTP/1.1 101 Switching Protocols\r\n"+
+			"Upgrade: websocket\r\n"+
+			"Connection: Upgrade\r\n"+
+			"Sec-WebSocket-Accept: "+base64.StdEncoding.EncodeToString(h.Sum(nil))+"\r\n\r\n")
+		time.Sleep(5 * time.Second)
+	}()
+	client := hprose.NewClient("ws://" + listener.Addr().String()).(*hprose.WebSocketClient)
+	defer client.Close()
+	var ro *testRemoteObject3
+	client.UseService(&ro)
+	name := strings.Repeat("World", 1<<21)
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, err := ro.Hello(ctx, name); err != context.DeadlineExceeded {
+		t.Error(err)
+	}
+	if d := time.Since(start); d > 2*time.Second {
+		t.Error("the write was not cancelled in time:", d)
+	}
+}
+
+func TestWebSocketServiceMaxConcurrentRequests(t *testing.T) {
+	atomic.StoreInt32(&testMaxActive, 0)
+	service := hprose.NewWebSocketService()
+	service.AddFunction("hello", countedHello)
+	service.MaxConcurrentRequests = 2
+	server := httptest.NewServer(service)
+	defer server.Close()
+	client := hprose.NewClient("ws" + strings.TrimPrefix(server.URL, "http")).(*hprose.WebSocketClient)
+	defer client.Close()
+	var ro *testRemoteObject2
+	client.UseService(&ro)
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			name := fmt.Sprint("World", i)
+			if s, err := ro.Hello(name); err != nil {
+				t.Error(err.Error())
+			} else if s != "Hello "+name+"!" {
+				t.Error(s)
+			}
+		}(i)
+	}
+	wg.Wait()
+	if max := atomic.LoadInt32(&testMaxActive); max != 2 {
+		t.Error("the maximum number of the concurrent requests is", max)
+	}
+}
+
+func TestWebSocketServiceTLS(t *testing.T) {
+	service := hprose.NewWebSocketService()
+	service.AddFunction("hello", hello)
+	server := httptest.NewTLSServer(service)
+	defer server.Close()
+	client := hprose.NewClient("wss" + strings.TrimPrefix(server.URL, "https")).(*hprose.WebSocketClient)
+	defer client.Close()
+	client.SetTLSClientConfig(server.Client().Transport.(*http.Transport).TLSClientConfig)
+	var ro *testRemoteObject2
+	client.UseService(&ro)
+	if s, err := ro.Hello("World"); err != nil {
+		t.Error(err.Error())
+	} else if s != "Hello World!" {
+		t.Error(s)
+	}
+}
+
+func TestUnixService(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "hprose.sock")
+	server := hprose.NewUnixServerWithMode("unix:"+path, 0600)
+	server.AddFunction("hello", hello)
+	server.AddMethods(new(testServe))
+	if info, err := os.Stat(path); err != nil {
+		t.Fatal(err.Error())
+	} else if info.Mode().Perm() != 0600 {
+		t.Error(info.Mode())
+	}
+	if entries, err := os.ReadDir(filepath.Dir(path)); err != nil || len(entries) != 1 {
+		t.Error(entries, err)
+	}
+	if addr := server.Addr().String(); addr != path {
+		t.Error(addr)
+	}
+	go server.Start()
+	defer func() {
+		server.Close()
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Error("the socket file is not removed:", err)
+		}
+	}()
+	client := hprose.NewClient(server.URL).(*hprose.UnixClient)
+	defer client.Close()
+	var ro *testRemoteObject2
+	client.UseService(&ro)
+	if s, err := ro.Hello("World"); err != nil {
+		t.Error(err.Error())
+	} else if s != "Hello World!" {
+		t.Error(s)
+	}
+	client.SetFullDuplex(true)
+	if a, b, err := ro.Swap(1, 2); err != nil {
+		t.Error(err.Error())
+	} else if a != 2 || b != 1 {
+		t.Error(a, b)
+	}
+}
+
+func TestUnixServiceRelativePath(t *testing.T) {
+	t.Chdir(t.TempDir())
+	if err := os.Mkdir("relative", 0700); err != nil {
+		t.Fatal(err.Error())
+	}
+	server := hprose.NewUnixServer("unix://relative/hprose.sock")
+	server.AddFunction("hello", hello)
+	go server.Start()
+	defer server.Close()
+	if _, err := os.Stat(filepath.Join("relative", "hprose.sock")); err != nil {
+		t.Fatal(err.Error())
+	}
+	for _, uri := range []string{server.URL, "unix://relative/hprose.sock"} {
+		client := hprose.NewClient(uri)
+		var ro *testRemoteObject2
+		client.UseService(&ro)
+		if s, err := ro.Hello("World"); err != nil {
+			t.Error(uri, err.Error())
+		} else if s != "Hello World!" {
+			t.Error(s)
+		}
+		client.(*hprose.UnixClient).Close()
+	}
+}
+
+func TestClientInvokeHandler(t *testing.T) {
+	server := hprose.NewTcpServer("")
+	server.AddFunction("hello", hello)
+	calls := 0
+	server.AddFunction("flaky", func() (int, error) {
+		if calls++; calls == 1 {
+			return 0, errors.New("try again")
+		}
+		return calls, nil
+	})
+	go server.Start()
+	defer server.Close()
+	client := hprose.NewClient(server.URL)
+	defer client.(*hprose.TcpClient).Close()
+	var trace []string
+	client.(*hprose.TcpClient).Use(func(name string, args []reflect.Value, context *hprose.ClientContext, next hprose.NextInvokeHandler) error {
+		trace = append(trace, "a>"+name)
+		defer func() { trace = append(trace, "<a") }()
+		switch name {
+		case "cached":
+			context.Results[0].Set(reflect.ValueOf("Hello Cache!"))
+			return nil
+		case "forbidden":
+			return errors.New("forbidden")
+		}
+		return next(name, args, context)
+	}, func(name string, args []reflect.Value, context *hprose.ClientContext, next hprose.NextInvokeHandler) error {
+		trace = append(trace, "b>"+name)
+		defer func() { trace = append(trace, "<b") }()
+		if name == "hello" {
+			args[0] = reflect.ValueOf("Middleware")
+		}
+		err := next(name, args, context)
+		if err != nil && name == "flaky" {
+			err = next(name, args, context)
+		}
+		return err
+	})
+	var s string
+	if err := <-client.Invoke("hello", []interface{}{"World"}, nil, &s); err != nil {
+		t.Error(err.Error())
+	} else if s != "Hello Middleware!" {
+		t.Error(s)
+	}
+	if fmt.Sprint(trace) != "[a>hello b>hello <b <a]" {
+		t.Error(trace)
+	}
+	if err := <-client.Invoke("cached", nil, nil, &s); err != nil {
+		t.Error(err.Error())
+	} else if s != "Hello Cache!" {
+		t.Error(s)
+	}
+	if err := <-client.Invoke("forbidden", nil, nil, &s); err == nil || err.Error() != "forbidden" {
+		t.Error(err)
+	}
+	var n int
+	if err := <-client.Invoke("flaky", nil, nil, &n); err != nil {
+		t.Error(err.Error())
+	} else if n != 2 {
+		t.Error(n)
+	}
+}
+
+type testContextKey struct{}
+
+func TestServiceMethodHandler(t *testing.T) {
+	server := hprose.NewTcpServer("")
+	server.AddFunction("hello", hello)
+	server.AddMethods(new(testServe))
+	server.Use(func(name string, args []reflect.Value, context *hprose.ServiceContext, next hprose.NextMethodHandler) ([]reflect.Value, error) {
+		if name == "Sum" && len(args) > 3 {
+			return nil, errors.New("Too many parameters")
+		}
+		context.Context = contextWithValue(context.Context, name)
+		return next(name, args, context)
+	}, func(name string, args []reflect.Value, context *hprose.ServiceContext, next hprose.NextMethodHandler) ([]reflect.Value, error) {
+		if context.Value(testContextKey{}) != name {
+			return nil, errors.New("Missing context value")
+		}
+		if name == "Hello" {
+			args[0] = reflect.ValueOf(strings.ToUpper(args[0].String()))
+		}
+		results, err := next(name, args, context)
+		if err == nil && name == "Swap" {
+			results[0], results[1] = results[1], results[0]
+		}
+		return results, err
+	})
+	go server.Start()
+	defer server.Close()
+	client := hprose.NewClient(server.URL)
+	defer client.(*hprose.TcpClient).Close()
+	var ro *testRemoteObject2
+	client.UseService(&ro)
+	if s, err := ro.Hello("World"); err != nil {
+		t.Error(err.Error())
+	} else if s != "Hello WORLD!" {
+		t.Error(s)
+	}
+	if a, b, err := ro.Swap(1, 2); err != nil {
+		t.Error(err.Error())
+	} else if a != 1 || b != 2 {
+		t.Error(a, b)
+	}
+	if sum, err := ro.Sum(1, 2, 3); err != nil {
+		t.Error(err.Error())
+	} else if sum != 6 {
+		t.Error(sum)
+	}
+	if _, err := ro.Sum(1, 2, 3, 4); err == nil || err.Error() != "Too many parameters" {
+		t.Error(err)
+	}
+}
+
+func contextWithValue(ctx context.Context, name string) context.Context {
+	return context.WithValue(ctx, testContextKey{}, name)
+}
+
+func peer(context *hprose.ServiceContext, prefix string) string {
+	switch {
+	case context.Request != nil && context.Conn != nil:
+		return prefix + "websocket"
+	case context.Request != nil:
+		return prefix + "http"
+	case context.Conn != nil:
+		return prefix + "tcp"
+	}
+	return prefix
+}
+
+func user(ctx context.Context, a, b int) string {
+	return fmt.Sprint(ctx.Value(testContextKey{}), a+b)
+}
+
+func testServiceContextInjection(t *testing.T, uri string, transport string) {
+	client := hprose.NewClient(uri)
+	if c, ok := client.(interface{ Close() }); ok {
+		defer c.Close()
+	}
+	var s string
+	if err := <-client.Invoke("peer", []interface{}{"via "}, nil, &s); err != nil {
+		t.Error(err.Error())
+	} else if s != "via "+transport {
+		t.Error(s)
+	}
+	if err := <-client.Invoke("user", []interface{}{1, 2}, nil, &s); err != nil {
+		t.Error(err.Error())
+	} else if s != "user3" {
+		t.Error(s)
+	}
+}
+
+func addContextFunctions(service *hprose.BaseService) {
+	service.AddFunction("peer", peer)
+	service.AddFunction("user", user)
+	service.Use(func(name string, args []reflect.Value, context *hprose.ServiceContext, next hprose.NextMethodHandler) ([]reflect.Value, error) {
+		context.Context = contextWithValue(context.Context, name)
+		return next(name, args, context)
+	})
+}
+
+func TestServiceContextInjection(t *testing.T) {
+	httpService := hprose.NewHttpService()
+	addContextFunctions(httpService.BaseService)
+	httpServer := httptest.NewServer(httpService)
+	defer httpServer.Close()
+	testServiceContextInjection(t, httpServer.URL, "http")
+	tcpServer := hprose.NewTcpServer("")
+	addContextFunctions(tcpServer.BaseService)
+	go tcpServer.Start()
+	defer tcpServer.Close()
+	testServiceContextInjection(t, tcpServer.URL, "tcp")
+	wsService := hprose.NewWebSocketService()
+	addContextFunctions(wsService.BaseService)
+	wsServer := httptest.NewServer(wsService)
+	defer wsServer.Close()
+	testServiceContextInjection(t, "ws"+strings.TrimPrefix(wsServer.URL, "http"), "websocket")
+}
+
+func TestServiceHandleError(t *testing.T) {
+	service := hprose.NewBaseService()
+	service.AddFunction("hello", hello)
+	buf := new(strings.Builder)
+	if err := service.Handle(hprose.NewBufReader([]byte(`Cs5"hello"a1{s5"World"}z`)), buf); err != nil {
+		t.Error(err.Error())
+	} else if buf.String() != `Rs12"Hello World!"z` {
+		t.Error(buf.String())
+	}
+	if err := service.Handle(hprose.NewBufReader(nil), buf); err != io.EOF {
+		t.Error(err)
+	}
+}
+
+type testServiceEvent struct {
+	before []string
+	after  []string
+	errors []string
+}
+
+func (e *testServiceEvent) OnBeforeInvoke(name string, args []reflect.Value, byref bool) {
+	e.before = append(e.before, name)
+}
+
+func (e *testServiceEvent) OnAfterInvoke(name string, args []reflect.Value, byref bool, result []reflect.Value) {
+	e.after = append(e.after, fmt.Sprint(name, args))
+}
+
+func (e *testServiceEvent) OnSendError(err error) {
+	e.errors = append(e.errors, err.Error())
+}
+
+func TestServiceEventMissingMethod(t *testing.T) {
+	service := hprose.NewBaseService()
+	service.AddFunction("hello", hello)
+	event := new(testServiceEvent)
+	service.ServiceEvent = event
+	service.Use(func(name string, args []reflect.Value, context *hprose.ServiceContext, next hprose.NextMethodHandler) ([]reflect.Value, error) {
+		return next(name, args, context)
+	})
+	buf := new(strings.Builder)
+	if err := service.Handle(hprose.NewBufReader([]byte(`Cs7"unknown"a1{s5"World"}z`)), buf); err != nil {
+		t.Error(err.Error())
+	} else if buf.String() != `Es30"Can't find this method unknown"z` {
+		t.Error(buf.String())
+	}
+	if len(event.before) != 1 || event.before[0] != "unknown" {
+		t.Error(event.before)
+	}
+	if len(event.errors) != 1 || event.errors[0] != "Can't find this method unknown" {
+		t.Error(event.errors)
+	}
+}
+
+func TestServiceHandlerArgs(t *testing.T) {
+	service := hprose.NewBaseService()
+	service.AddFunction("hello", hello)
+	event := new(testServiceEvent)
+	service.ServiceEvent = event
+	service.Use(func(name string, args []reflect.Value, context *hprose.ServiceContext, next hprose.NextMethodHandler) ([]reflect.Value, error) {
+		return next(name, []reflect.Value{reflect.ValueOf("Handler")}, context)
+	})
+	buf := new(strings.Builder)
+	if err := service.Handle(hprose.NewBufReader([]byte(`Cs5"hello"a1{s5"World"}tz`)), buf); err != nil {
+		t.Error(err.Error())
+	} else if buf.String() != `Rs14"Hello Handler!"Aa1{s7"Handler"}z` {
+		t.Error(buf.String())
+	}
+	if len(event.after) != 1 || event.after[0] != "hello[Handler]" {
+		t.Error(event.after)
+	}
+}
+
+func TestServiceLimits(t *testing.T) {
+	service := hprose.NewBaseService()
+	service.AddFunction("hello", hello)
+	buf := new(strings.Builder)
+	// the default limits reject the huge collection
+	err := service.Handle(hprose.NewBufReader([]byte(`Cs5"hello"a999999999{`)), buf)
+	if e, ok := err.(*hprose.LimitError); !ok || e.Kind != hprose.CollectionSizeLimit {
+		t.Error(err)
+	}
+	service.Limits = hprose.ReaderLimits{MaxCollectionSize: 16, MaxStringLength: 16}
+	buf.Reset()
+	err = service.Handle(hprose.NewBufReader([]byte(`Cs5"hello"a999999999{`)), buf)
+	if e, ok := err.(*hprose.LimitError); !ok || e.Kind != hprose.CollectionSizeLimit {
+		t.Error(err)
+	}
+	if !strings.HasPrefix(buf.String(), "Es") {
+		t.Error(buf.String())
+	}
+	buf.Reset()
+	err = service.Handle(hprose.NewBufReader([]byte(`Cs5"hello"a1{s99"World`)), buf)
+	if e, ok := err.(*hprose.LimitError); !ok || e.Kind != hprose.StringLengthLimit {
+		t.Error(err)
+	}
+}
+
+func TestTcpServiceBrokenConn(t *testing.T) {
+	server := hprose.NewTcpServer("")
+	server.AddFunction("hello", hello)
+	go server.Start()
+	defer server.Close()
+	client := hprose.NewClient(server.URL)
+	defer client.(*hprose.TcpClient).Close()
+	var ro *testRemoteObject2
+	client.UseService(&ro)
+	for i := 0; i < 10; i++ {
+		conn, err := net.Dial("tcp", server.TCPListener.Addr().String())
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		conn.Write([]byte(`Cs5"hel`))
+		conn.Close()
+		if s, err := ro.Hello("World"); err != nil {
+			t.Error(err.Error())
+		} else if s != "Hello World!" {
+			t.Error(s)
+		}
+	}
+}
+
+func TestTcpServerShutdown(t *testing.T) {
+	server := hprose.NewTcpServer("")
+	server.AddFunction("hello", hello)
+	server.AddFunction("slowHello", slowHello)
+	started := make(chan error, 1)
+	go func() { started <- server.Start() }()
+	client := hprose.NewClient(server.URL)
+	defer client.(*hprose.TcpClient).Close()
+	var ro *testRemoteObject3
+	client.UseService(&ro)
+	if _, err := ro.Hello(context.Background(), "World"); err != nil {
+		t.Fatal(err.Error())
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if s, err := ro.SlowHello(context.Background(), "World"); err != nil {
+			t.Error(err.Error())
+		} else if s != "Hello World!" {
+			t.Error(s)
+		}
+	}()
+	time.Sleep(100 * time.Millisecond)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Error(err)
+	}
+	ctx, cancel = context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := server.Shutdown(ctx); err == context.DeadlineExceeded {
+		t.Error(err)
+	}
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Error("the call was not finished")
+	}
+	if err := <-started; err != hprose.ErrServerClosed {
+		t.Error(err)
+	}
+	if _, err := ro.Hello(context.Background(), "World"); err == nil {
+		t.Error("the server was not shut down")
+	}
+}
+
+func TestTcpServerShutdownRequest(t *testing.T) {
+	const request = `Cs5"hello"a1{s5"World"}z`
+	const response = `Rs12"Hello World!"z`
+	for i := 0; i < 20; i++ {
+		server := hprose.NewTcpServer("")
+		server.AddFunction("hello", hello)
+		go server.Start()
+		conn, err := net.Dial("tcp", strings.TrimPrefix(server.URL, "tcp://"))
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		time.Sleep(10 * time.Millisecond)
+		shutdown := make(chan error, 1)
+		if i%2 == 0 {
+			// the request is sent at the same moment Shutdown starts
+			go func() { shutdown <- server.Shutdown(context.Background()) }()
+			io.WriteString(conn, request)
+		} else {
+			// the first byte of the request arrived before Shutdown
+			io.WriteString(conn, request[:1])
+			time.Sleep(10 * time.Millisecond)
+			go func() { shutdown <- server.Shutdown(context.Background()) }()
+			time.Sleep(10 * time.Millisecond)
+			io.WriteString(conn, request[1:])
+		}
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		data, err := io.ReadAll(conn)
+		conn.Close()
+		// the request is either served or the connection is closed before
+		// any byte of it is read, which may reset the connection
+		if s := string(data); s != response && (i%2 != 0 || s != "") {
+			t.Error(i, s, err)
+		} else if s == response && err != nil {
+			t.Error(i, err.Error())
+		}
+		if err := <-shutdown; err != nil {
+			t.Error(err.Error())
+		}
+	}
+}
+
+func TestTcpServerClose(t *testing.T) {
+	server := hprose.NewTcpServer("")
+	server.AddFunction("slowHello", slowHello)
+	go server.Start()
+	client := hprose.NewClient(server.URL)
+	defer client.(*hprose.TcpClient).Close()
+	var ro *testRemoteObject3
+	client.UseService(&ro)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if _, err := ro.SlowHello(context.Background(), "World"); err == nil {
+			t.Error("the call was not interrupted")
+		}
+	}()
+	time.Sleep(100 * time.Millisecond)
+	if err := server.Close(); err != nil {
+		t.Error(err.Error())
+	}
+	<-done
+}
+
+func newTestCertificate(t *testing.T, name string, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (tls.Certificate, *x509.Certificate) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: cert}, cert
+}
+
+type testTlsEvent struct {
+	names chan string
+}
+
+func (e *testTlsEvent) OnBeforeInvoke(name string, args []reflect.Value, byref bool) {}
+
+func (e *testTlsEvent) OnAfterInvoke(name string, args []reflect.Value, byref bool, result []reflect.Value) {
+}
+
+func (e *testTlsEvent) OnSendError(err error) {}
+
+func (e *testTlsEvent) OnAccept(context *hprose.ServiceContext) error {
+	name := context.ConnectionState().VerifiedChains[0][0].Subject.CommonName
+	e.names <- name
+	if name == "mallory" {
+		return errors.New("Access Denied")
+	}
+	return nil
+}
+
+func whoami(context *hprose.ServiceContext) string {
+	return context.ConnectionState().VerifiedChains[0][0].Subject.CommonName
+}
+
+func TestTcpServerMutualTLS(t *testing.T) {
+	ca, caCert := newTestCertificate(t, "ca", nil, nil)
+	caKey := ca.PrivateKey.(*ecdsa.PrivateKey)
+	serverCert, _ := newTestCertificate(t, "server", caCert, caKey)
+	pool := x509.NewCertPool()
+	pool.AddCert(caCert)
+	server := hprose.NewTcpServer("")
+	server.AddFunction("whoami", whoami)
+	event := &testTlsEvent{make(chan string, 10)}
+	server.ServiceEvent = event
+	server.SetTLSConfig(&tls.Config{Certificates: []tls.Certificate{serverCert}})
+	server.SetClientAuth(tls.RequireAndVerifyClientCert, pool)
+	go server.Start()
+	defer server.Close()
+	for _, name := range []string{"alice", "mallory", ""} {
+		client := hprose.NewClient(server.URL).(*hprose.TcpClient)
+		config := &tls.Config{RootCAs: pool}
+		if name != "" {
+			clientCert, _ := newTestCertificate(t, name, caCert, caKey)
+			config.Certificates = []tls.Certificate{clientCert}
+		}
+		client.SetTLSConfig(config)
+		var s string
+		err := <-client.Invoke("whoami", nil, nil, &s)
+		client.Close()
+		switch name {
+		case "alice":
+			if err != nil {
+				t.Error(err.Error())
+			} else if s != "alice" {
+				t.Error(s)
+			}
+		default:
+			if err == nil {
+				t.Error("the client was not rejected:", s)
+			}
+		}
+		if name != "" {
+			if accepted := <-event.names; accepted != name {
+				t.Error(accepted)
+			}
+		}
+	}
+}
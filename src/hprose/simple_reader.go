@@ -22,6 +22,7 @@ package hprose
 
 import (
 	"container/list"
+	"encoding"
 	"errors"
 	"math"
 	"math/big"
@@ -37,6 +38,8 @@ import (
 var badEncodeError = errors.New("bad utf-8 encoding")
 var NilError = errors.New("nil")
 var refError = unexpectedTag(TagRef, nil)
+var badRefError = errors.New("bad reference index in stream")
+var badClassError = errors.New("bad class index in stream")
 
 var bigDigit = [...]*big.Int{
 	big.NewInt(0),
@@ -66,14 +69,17 @@ var indexCache struct {
 
 type reader struct {
 	*RawReader
-	classref  []interface{}
-	fieldsref [][]string
+	classref   []interface{}
+	fieldsref  [][]string
+	classnames []string
 	readerRefer
 }
 
 type fakeReaderRefer struct{}
 
-func (r fakeReaderRefer) setRef(p interface{}) {}
+func (r fakeReaderRefer) setRef(p interface{}) error {
+	return nil
+}
 
 func (r fakeReaderRefer) readRef(i int, err error) (interface{}, error) {
 	return nil, refError
@@ -165,10 +171,11 @@ func (r *reader) Unserialize(p interface{}) (err error) {
 		}
 		return err
 	case *big.Int:
-		if x, err := r.ReadBigInt(); err == NilError {
+		x, err := r.ReadBigInt()
+		if err == NilError {
 			err = nil
-			*p = *x
-		} else {
+		}
+		if x != nil {
 			*p = *x
 		}
 		return err
@@ -198,7 +205,8 @@ func (r *reader) Unserialize(p interface{}) (err error) {
 		}
 		return err
 	case *[]byte:
-		if x, err := r.ReadBytes(); err == NilError {
+		x, err := r.ReadBytes()
+		if err == NilError {
 			*p = *x
 			err = nil
 		} else {
@@ -206,7 +214,8 @@ func (r *reader) Unserialize(p interface{}) (err error) {
 		}
 		return err
 	case *uuid.UUID:
-		if x, err := r.ReadUUID(); err == NilError {
+		x, err := r.ReadUUID()
+		if err == NilError {
 			*p = *x
 			err = nil
 		} else {
@@ -214,7 +223,8 @@ func (r *reader) Unserialize(p interface{}) (err error) {
 		}
 		return err
 	case *list.List:
-		if x, err := r.ReadList(); err == NilError {
+		x, err := r.ReadList()
+		if err == NilError {
 			*p = *x
 			err = nil
 		} else {
@@ -222,7 +232,8 @@ func (r *reader) Unserialize(p interface{}) (err error) {
 		}
 		return err
 	case **int:
-		if x, err := r.ReadInt(); err == NilError {
+		x, err := r.ReadInt()
+		if err == NilError {
 			*p = nil
 			err = nil
 		} else {
@@ -230,7 +241,8 @@ func (r *reader) Unserialize(p interface{}) (err error) {
 		}
 		return err
 	case **uint:
-		if x, err := r.ReadUint(); err == NilError {
+		x, err := r.ReadUint()
+		if err == NilError {
 			*p = nil
 			err = nil
 		} else {
@@ -238,7 +250,8 @@ func (r *reader) Unserialize(p interface{}) (err error) {
 		}
 		return err
 	case **int8:
-		if x, err := r.ReadInt8(); err == NilError {
+		x, err := r.ReadInt8()
+		if err == NilError {
 			*p = nil
 			err = nil
 		} else {
@@ -246,7 +259,8 @@ func (r *reader) Unserialize(p interface{}) (err error) {
 		}
 		return err
 	case **uint8:
-		if x, err := r.ReadUint8(); err == NilError {
+		x, err := r.ReadUint8()
+		if err == NilError {
 			*p = nil
 			err = nil
 		} else {
@@ -254,7 +268,8 @@ func (r *reader) Unserialize(p interface{}) (err error) {
 		}
 		return err
 	case **int16:
-		if x, err := r.ReadInt16(); err == NilError {
+		x, err := r.ReadInt16()
+		if err == NilError {
 			*p = nil
 			err = nil
 		} else {
@@ -262,7 +277,8 @@ func (r *reader) Unserialize(p interface{}) (err error) {
 		}
 		return err
 	case **uint16:
-		if x, err := r.ReadUint16(); err == NilError {
+		x, err := r.ReadUint16()
+		if err == NilError {
 			*p = nil
 			err = nil
 		} else {
@@ -270,7 +286,8 @@ func (r *reader) Unserialize(p interface{}) (err error) {
 		}
 		return err
 	case **int32:
-		if x, err := r.ReadInt32(); err == NilError {
+		x, err := r.ReadInt32()
+		if err == NilError {
 			*p = nil
 			err = nil
 		} else {
@@ -278,7 +295,8 @@ func (r *reader) Unserialize(p interface{}) (err error) {
 		}
 		return err
 	case **uint32:
-		if x, err := r.ReadUint32(); err == NilError {
+		x, err := r.ReadUint32()
+		if err == NilError {
 			*p = nil
 			err = nil
 		} else {
@@ -286,7 +304,8 @@ func (r *reader) Unserialize(p interface{}) (err error) {
 		}
 		return err
 	case **int64:
-		if x, err := r.ReadInt64(); err == NilError {
+		x, err := r.ReadInt64()
+		if err == NilError {
 			*p = nil
 			err = nil
 		} else {
@@ -294,7 +313,8 @@ func (r *reader) Unserialize(p interface{}) (err error) {
 		}
 		return err
 	case **uint64:
-		if x, err := r.ReadUint64(); err == NilError {
+		x, err := r.ReadUint64()
+		if err == NilError {
 			*p = nil
 			err = nil
 		} else {
@@ -308,7 +328,8 @@ func (r *reader) Unserialize(p interface{}) (err error) {
 		}
 		return err
 	case **float32:
-		if x, err := r.ReadFloat32(); err == NilError {
+		x, err := r.ReadFloat32()
+		if err == NilError {
 			*p = nil
 			err = nil
 		} else {
@@ -316,7 +337,8 @@ func (r *reader) Unserialize(p interface{}) (err error) {
 		}
 		return err
 	case **float64:
-		if x, err := r.ReadFloat64(); err == NilError {
+		x, err := r.ReadFloat64()
+		if err == NilError {
 			*p = nil
 			err = nil
 		} else {
@@ -324,7 +346,8 @@ func (r *reader) Unserialize(p interface{}) (err error) {
 		}
 		return err
 	case **bool:
-		if x, err := r.ReadBool(); err == NilError {
+		x, err := r.ReadBool()
+		if err == NilError {
 			*p = nil
 			err = nil
 		} else {
@@ -332,7 +355,8 @@ func (r *reader) Unserialize(p interface{}) (err error) {
 		}
 		return err
 	case **time.Time:
-		if x, err := r.ReadDateTime(); err == NilError {
+		x, err := r.ReadDateTime()
+		if err == NilError {
 			*p = nil
 			err = nil
 		} else {
@@ -340,7 +364,8 @@ func (r *reader) Unserialize(p interface{}) (err error) {
 		}
 		return err
 	case **string:
-		if x, err := r.ReadString(); err == NilError {
+		x, err := r.ReadString()
+		if err == NilError {
 			*p = nil
 			err = nil
 		} else {
@@ -1208,8 +1233,7 @@ func (r *reader) ReadDateWithoutTag() (time.Time, error) {
 		return timeZero, unexpectedTag(tag, []byte{TagUTC, TagSemicolon})
 	}
 	d := time.Date(year, time.Month(month), day, hour, min, sec, nsec, loc)
-	r.setRef(d)
-	return d, nil
+	return d, r.setRef(d)
 }
 
 func (r *reader) ReadTimeWithoutTag() (time.Time, error) {
@@ -1226,8 +1250,7 @@ func (r *reader) ReadTimeWithoutTag() (time.Time, error) {
 		return timeZero, unexpectedTag(tag, []byte{TagUTC, TagSemicolon})
 	}
 	t := time.Date(1, 1, 1, hour, min, sec, nsec, loc)
-	r.setRef(t)
-	return t, nil
+	return t, r.setRef(t)
 }
 
 func (r *reader) ReadString() (string, error) {
@@ -1292,7 +1315,7 @@ func (r *reader) ReadString() (string, error) {
 
 func (r *reader) ReadStringWithoutTag() (str string, err error) {
 	if str, err = r.readStringWithoutTag(); err == nil {
-		r.setRef(str)
+		err = r.setRef(str)
 	}
 	return str, err
 }
@@ -1342,12 +1365,18 @@ func (r *reader) ReadBytes() (*[]byte, error) {
 
 func (r *reader) ReadBytesWithoutTag() (*[]byte, error) {
 	s := r.stream
-	if length, err := r.ReadInteger(TagQuote); err == nil {
+	length, err := r.ReadInteger(TagQuote)
+	if err == nil {
+		err = r.limits.checkLength(length)
+	}
+	if err == nil {
 		b := make([]byte, length)
 		if _, err = s.Read(b); err == nil {
 			err = r.CheckTag(TagQuote)
 		}
-		r.setRef(&b)
+		if err == nil {
+			err = r.setRef(&b)
+		}
 		return &b, err
 	} else {
 		return new([]byte), err
@@ -1401,7 +1430,9 @@ func (r *reader) ReadUUIDWithoutTag() (*uuid.UUID, error) {
 		if _, err = s.Read(b); err == nil {
 			err = r.CheckTag(TagClosebrace)
 			u := uuid.Parse(string(b))
-			r.setRef(&u)
+			if err == nil {
+				err = r.setRef(&u)
+			}
 			return &u, err
 		}
 	}
@@ -1436,8 +1467,14 @@ func (r *reader) ReadList() (*list.List, error) {
 
 func (r *reader) ReadListWithoutTag() (*list.List, error) {
 	l := list.New()
-	r.setRef(l)
-	length, err := r.ReadInteger(TagOpenbrace)
+	if err := r.setRef(l); err != nil {
+		return l, err
+	}
+	if err := r.enter(); err != nil {
+		return l, err
+	}
+	defer r.leave()
+	length, err := r.readCount()
 	if err == nil {
 		for i := 0; i < length; i++ {
 			if e, err := r.readInterface(); err == nil {
@@ -1455,7 +1492,9 @@ func (r *reader) ReadListWithoutTag() (*list.List, error) {
 
 func (r *reader) ReadArray(a []reflect.Value) error {
 	length := len(a)
-	r.setRef(&a)
+	if err := r.setRef(&a); err != nil {
+		return err
+	}
 	for i := 0; i < length; i++ {
 		if err := r.ReadValue(a[i]); err != nil {
 			return err
@@ -1512,16 +1551,32 @@ func (r *reader) ReadObjectWithoutTag(p interface{}) error {
 	return err
 }
 
+func (r *reader) SetLimits(limits ReaderLimits) {
+	r.RawReader.SetLimits(limits)
+	if refer, ok := r.readerRefer.(*realReaderRefer); ok {
+		refer.max = limits.MaxRefs
+	}
+}
+
 func (r *reader) Reset() {
 	if r.classref != nil {
 		r.classref = nil
 		r.fieldsref = nil
+		r.classnames = nil
 	}
 	r.resetRef()
 }
 
 // private methods
 
+func (r *reader) readCount() (int, error) {
+	count, err := r.ReadInteger(TagOpenbrace)
+	if err == nil {
+		err = r.limits.checkCount(count)
+	}
+	return count, err
+}
+
 func (r *reader) checkPointer(p interface{}) (v reflect.Value, err error) {
 	v = reflect.ValueOf(p)
 	if v.Kind() != reflect.Ptr {
@@ -1531,7 +1586,33 @@ func (r *reader) checkPointer(p interface{}) (v reflect.Value, err error) {
 }
 
 func (r *reader) ReadValue(v reflect.Value) error {
+	if u := hproseUnmarshaler(v); u != nil {
+		return u.UnmarshalHprose(r)
+	}
 	t := v.Type()
+	if t == rawMessageType {
+		return r.readRawMessage(v)
+	}
+	if t.Kind() == reflect.Ptr && t.Elem() == rawMessageType {
+		if v.IsNil() {
+			v.Set(reflect.New(rawMessageType))
+		}
+		return r.readRawMessage(v.Elem())
+	}
+	if decode := getDecodeFunc(t); decode != nil {
+		return decode(r, v)
+	}
+	if t.Kind() == reflect.Ptr {
+		if decode := getDecodeFunc(t.Elem()); decode != nil {
+			if v.IsNil() {
+				v.Set(reflect.New(t.Elem()))
+			}
+			return decode(r, v.Elem())
+		}
+	}
+	if ok, text := encodingUnmarshaler(v); ok {
+		return r.readEncoding(v, text)
+	}
 	switch t.Kind() {
 	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
 		return r.readInt64(v)
@@ -1965,6 +2046,9 @@ func (r *reader) readTime() (hour int, min int, sec int, nsec int, tag byte, err
 func (r *reader) readStringWithoutTag() (str string, err error) {
 	var length int
 	if length, err = r.ReadInteger(TagQuote); err == nil {
+		err = r.limits.checkLength(length)
+	}
+	if err == nil {
 		if str, err = r.readUTF8String(length); err == nil {
 			err = r.CheckTag(TagQuote)
 		}
@@ -2130,9 +2214,15 @@ func (r *reader) readSliceWithoutTag(v reflect.Value) error {
 		return errors.New("cannot convert slice to type " + t.String())
 	}
 	slicePointer := reflect.New(t)
-	r.setRef(slicePointer.Interface())
+	if err := r.setRef(slicePointer.Interface()); err != nil {
+		return err
+	}
+	if err := r.enter(); err != nil {
+		return err
+	}
+	defer r.leave()
 	slice := slicePointer.Elem()
-	length, err := r.ReadInteger(TagOpenbrace)
+	length, err := r.readCount()
 	if err == nil {
 		slice.Set(reflect.MakeSlice(t, length, length))
 		for i := 0; i < length; i++ {
@@ -2180,9 +2270,15 @@ func (r *reader) readSliceAsMap(v reflect.Value) error {
 		return errors.New("cannot convert slice to type " + t.String())
 	}
 	mPointer := reflect.New(t)
-	r.setRef(mPointer.Interface())
+	if err := r.setRef(mPointer.Interface()); err != nil {
+		return err
+	}
+	if err := r.enter(); err != nil {
+		return err
+	}
+	defer r.leave()
 	m := mPointer.Elem()
-	length, err := r.ReadInteger(TagOpenbrace)
+	length, err := r.readCount()
 	if err == nil {
 		m.Set(reflect.MakeMap(t))
 		for i := 0; i < length; i++ {
@@ -2277,9 +2373,15 @@ func (r *reader) readMapWithoutTag(v reflect.Value) error {
 		return errors.New("cannot convert map to type " + t.String())
 	}
 	mPointer := reflect.New(t)
-	r.setRef(mPointer.Interface())
+	if err := r.setRef(mPointer.Interface()); err != nil {
+		return err
+	}
+	if err := r.enter(); err != nil {
+		return err
+	}
+	defer r.leave()
 	m := mPointer.Elem()
-	length, err := r.ReadInteger(TagOpenbrace)
+	length, err := r.readCount()
 	if err == nil {
 		m.Set(reflect.MakeMap(t))
 		tk := t.Key()
@@ -2322,9 +2424,15 @@ func (r *reader) readMapAsObject(v reflect.Value) error {
 		t = t.Elem()
 	}
 	objPointer := reflect.New(t)
-	r.setRef(objPointer.Interface())
+	if err := r.setRef(objPointer.Interface()); err != nil {
+		return err
+	}
+	if err := r.enter(); err != nil {
+		return err
+	}
+	defer r.leave()
 	obj := objPointer.Elem()
-	count, err := r.ReadInteger(TagOpenbrace)
+	count, err := r.readCount()
 	if err == nil {
 		indexMap := getIndexCache(t)
 		for i := 0; i < count; i++ {
@@ -2401,7 +2509,13 @@ func (r *reader) readObject(v reflect.Value) error {
 func (r *reader) readObjectAsMap(v reflect.Value, index int) error {
 	t := soMapType
 	mPointer := reflect.New(t)
-	r.setRef(mPointer.Interface())
+	if err := r.setRef(mPointer.Interface()); err != nil {
+		return err
+	}
+	if err := r.enter(); err != nil {
+		return err
+	}
+	defer r.leave()
 	m := mPointer.Elem()
 	m.Set(reflect.MakeMap(t))
 	fields := r.fieldsref[index]
@@ -2444,6 +2558,9 @@ func (r *reader) readObjectWithoutTag(v reflect.Value) error {
 	if err != nil {
 		return err
 	}
+	if index < 0 || index >= len(r.classref) {
+		return badClassError
+	}
 	key := r.classref[index]
 	class, ok := key.(reflect.Type)
 	if !ok {
@@ -2470,7 +2587,13 @@ func (r *reader) readObjectWithoutTag(v reflect.Value) error {
 		return r.readObjectAsMap(v, index)
 	}
 	objPointer := reflect.New(class)
-	r.setRef(objPointer.Interface())
+	if err := r.setRef(objPointer.Interface()); err != nil {
+		return err
+	}
+	if err := r.enter(); err != nil {
+		return err
+	}
+	defer r.leave()
 	obj := objPointer.Elem()
 	fields := r.fieldsref[index]
 	indexMap := getIndexCache(class)
@@ -2519,7 +2642,7 @@ func (r *reader) readClass() error {
 	if err != nil {
 		return err
 	}
-	count, err := r.ReadInteger(TagOpenbrace)
+	count, err := r.readCount()
 	if err != nil {
 		return err
 	}
@@ -2543,6 +2666,7 @@ func (r *reader) readClass() error {
 	}
 	r.classref = append(r.classref, key)
 	r.fieldsref = append(r.fieldsref, fields)
+	r.classnames = append(r.classnames, className)
 	return nil
 }
 
@@ -2563,6 +2687,38 @@ func (r *reader) readPointer(v reflect.Value, readValue func() (interface{}, err
 	}
 }
 
+func (r *reader) readEncoding(v reflect.Value, text bool) (err error) {
+	var data []byte
+	if text {
+		var str string
+		str, err = r.ReadString()
+		data = []byte(str)
+	} else {
+		var b *[]byte
+		if b, err = r.ReadBytes(); b != nil {
+			data = *b
+		}
+	}
+	if err == NilError {
+		v.Set(reflect.Zero(v.Type()))
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+	} else {
+		v = v.Addr()
+	}
+	if text {
+		return v.Interface().(encoding.TextUnmarshaler).UnmarshalText(data)
+	}
+	return v.Interface().(encoding.BinaryUnmarshaler).UnmarshalBinary(data)
+}
+
 func (r *reader) readInt64Pointer(v reflect.Value) error {
 	return r.readPointer(v,
 		func() (interface{}, error) { return r.ReadInt64() },
@@ -2706,7 +2862,8 @@ func getIndexCache(class reflect.Type) map[string][]int {
 		}
 		indexMap = make(map[string][]int)
 		getFieldsFunc(class, func(f reflect.StructField) {
-			indexMap[strings.ToLower(f.Name)] = f.Index
+			name, _ := parseFieldTag(f)
+			indexMap[strings.ToLower(name)] = f.Index
 		})
 		indexCache.cache[class] = indexMap
 		indexCache.Unlock()
@@ -26,6 +26,7 @@ import (
 	. "hprose"
 	"math"
 	"math/big"
+	"net"
 	"reflect"
 	"testing"
 	"time"
@@ -1127,3 +1128,73 @@ func TestSimpleReaderObject(t *testing.T) {
 	}
 
 }
+
+func TestSimpleReaderObjectTag(t *testing.T) {
+	reader := NewSimpleReader(NewBufReader([]byte(
+		`c14"testTaggedUser"3{s9"user_name"s4"name"s8"password"}o0{s3"Tom"s5"Jerry"s6"secret"}` +
+			`m3{s9"USER_NAME"s3"Tom"s3"age"i18;s8"password"s6"secret"}`)))
+	var u testTaggedUser
+	if err := reader.Unserialize(&u); err != nil {
+		t.Error(err.Error())
+	}
+	if u != (testTaggedUser{"Tom", ""}) {
+		t.Error(u)
+	}
+	var p testTaggedPerson
+	if err := reader.Unserialize(&p); err != nil {
+		t.Error(err.Error())
+	}
+	if p != (testTaggedPerson{"Tom", 18, "", false}) {
+		t.Error(p)
+	}
+}
+
+func TestSimpleReaderEncodingUnmarshaler(t *testing.T) {
+	reader := NewSimpleReader(NewBufReader([]byte(`s8"10.0.0.1"` + "b2\"\x01\x02\"" +
+		`c8"testHost"2{s4"addr"s5"point"}o0{s3"::1"` + "b2\"\x03\x04\"}o0{nn}")))
+	var ip net.IP
+	if err := reader.Unserialize(&ip); err != nil || !ip.Equal(net.ParseIP("10.0.0.1")) {
+		t.Error(ip, err)
+	}
+	var p testPoint
+	if err := reader.Unserialize(&p); err != nil || p != (testPoint{1, 2}) {
+		t.Error(p, err)
+	}
+	var h testHost
+	if err := reader.Unserialize(&h); err != nil {
+		t.Error(err.Error())
+	}
+	if !h.Addr.Equal(net.IPv6loopback) || h.Point == nil || *h.Point != (testPoint{3, 4}) {
+		t.Error(h)
+	}
+	if err := reader.Unserialize(&h); err != nil {
+		t.Error(err.Error())
+	}
+	if h.Addr != nil || h.Point != nil {
+		t.Error(h)
+	}
+}
+
+func TestSimpleReaderUnmarshaler(t *testing.T) {
+	reader := NewSimpleReader(NewBufReader([]byte(`s5"12.34"i3;n` +
+		`c9"testOrder"3{s5"price"s5"color"s8"discount"}o0{s4"0.05"i2;s4"1.00"}`)))
+	var m testMoney
+	if err := reader.Unserialize(&m); err != nil || m != 1234 {
+		t.Error(m, err)
+	}
+	var c testColor
+	if err := reader.Unserialize(&c); err != nil || c != 3 {
+		t.Error(c, err)
+	}
+	p := new(testMoney)
+	if err := reader.Unserialize(&p); err != nil || p == nil || *p != 0 {
+		t.Error(p, err)
+	}
+	var o testOrder
+	if err := reader.Unserialize(&o); err != nil {
+		t.Error(err.Error())
+	}
+	if o.Price != 5 || o.Color != 2 || o.Discount == nil || *o.Discount != 100 {
+		t.Error(o)
+	}
+}
@@ -22,11 +22,13 @@ package hprose
 
 import (
 	"container/list"
+	"encoding"
 	"errors"
 	"math"
 	"math/big"
 	"reflect"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 	"unicode/utf8"
@@ -66,13 +68,15 @@ var serializeType = [...]bool{
 }
 
 type field struct {
-	Name  string
-	Index []int
+	Name      string
+	Index     []int
+	OmitEmpty bool
 }
 
 type cacheType struct {
 	fields            []field
 	hasAnonymousField bool
+	hasOmitEmptyField bool
 }
 
 var fieldCache struct {
@@ -267,9 +271,22 @@ func (w *writer) Reset() {
 // private methods
 
 func (w *writer) fastSerialize(v interface{}, rv reflect.Value, n int) error {
+	if m := hproseMarshaler(v, rv); m != nil {
+		if rv.Kind() == reflect.Ptr && rv.IsNil() {
+			return w.WriteNull()
+		}
+		return m.MarshalHprose(w)
+	}
 	switch v := v.(type) {
 	case nil:
 		return w.WriteNull()
+	case RawMessage:
+		return w.writeRawMessage(v)
+	case *RawMessage:
+		if v == nil {
+			return w.WriteNull()
+		}
+		return w.writeRawMessage(*v)
 	case int:
 		return w.WriteInt64(int64(v))
 	case *int:
@@ -419,7 +436,15 @@ func (w *writer) fastSerialize(v interface{}, rv reflect.Value, n int) error {
 }
 
 func (w *writer) slowSerialize(v interface{}, rv reflect.Value, n int) error {
+	if encode := getEncodeFunc(rv.Type()); encode != nil {
+		return encode(w, rv)
+	}
 	kind := rv.Type().Kind()
+	if kind != reflect.Ptr && kind != reflect.Interface {
+		if m := encodingMarshaler(rv); m != nil {
+			return w.writeEncoding(m)
+		}
+	}
 	switch kind {
 	case reflect.Ptr, reflect.Interface:
 		if rv.IsNil() {
@@ -484,6 +509,21 @@ func (w *writer) slowSerialize(v interface{}, rv reflect.Value, n int) error {
 	}
 }
 
+func (w *writer) writeEncoding(m interface{}) error {
+	if m, ok := m.(encoding.TextMarshaler); ok {
+		text, err := m.MarshalText()
+		if err != nil {
+			return err
+		}
+		return w.WriteStringWithRef(string(text))
+	}
+	data, err := m.(encoding.BinaryMarshaler).MarshalBinary()
+	if err != nil {
+		return err
+	}
+	return w.WriteBytesWithRef(data)
+}
+
 func (w *writer) writeTime(v interface{}, t time.Time) (err error) {
 	w.setRef(v)
 	s := w.stream
@@ -1225,6 +1265,9 @@ NEXT:
 				e = reflect.Indirect(e).Field(f.Index[j])
 			}
 		}
+		if f.OmitEmpty && isEmptyValue(e) {
+			continue
+		}
 		elements = append(elements, e)
 		names = append(names, f.Name)
 	}
@@ -1259,44 +1302,34 @@ func (w *writer) writeObject(v interface{}, rv reflect.Value) (err error) {
 		classname = t.Name()
 		ClassManager.Register(t, classname)
 	}
+	cache := getFieldCache(t)
+	fields := cache.fields
+	// the objects with the anonymous fields are written as maps, because
+	// their fields may be nil.
+	if cache.hasAnonymousField {
+		w.setRef(v)
+		return w.writeObjectAsMap(rv, fields)
+	}
+	key := classname
+	// the objects with the omitempty fields define a class for every set
+	// of the nonempty fields.
+	if cache.hasOmitEmptyField {
+		fields, key = nonemptyFields(rv, fields, classname)
+	}
 	if w.classref == nil {
 		w.classref = make(map[string]int)
 		w.fieldsref = make([][]field, 0)
 	}
-	index, found := w.classref[classname]
-	var fields []field
+	index, found := w.classref[key]
 	if found {
-		fields = w.fieldsref[index]
-	} else {
-		fieldCache.RLock()
-		cache, found := fieldCache.cache[t]
-		fieldCache.RUnlock()
-		if !found {
-			fieldCache.Lock()
-			if fieldCache.cache == nil {
-				fieldCache.cache = make(map[reflect.Type]cacheType)
-			}
-			fields = make([]field, 0)
-			hasAnonymousField := false
-			getFieldsFunc(t, func(f reflect.StructField) {
-				if len(f.Index) > 1 {
-					hasAnonymousField = true
-				}
-				fields = append(fields, field{firstLetterToLower(f.Name), f.Index})
-			})
-			cache = cacheType{fields, hasAnonymousField}
-			fieldCache.cache[t] = cache
-			fieldCache.Unlock()
-		} else {
-			fields = cache.fields
-		}
-		if !cache.hasAnonymousField {
-			if index, err = w.writeClass(classname, fields); err != nil {
-				return err
-			}
-		} else {
-			w.setRef(v)
-			return w.writeObjectAsMap(rv, fields)
+		// the classes defined by an Encoder or a RawMessage have no
+		// field indexes, so the struct defines its class again.
+		f := w.fieldsref[index]
+		found = len(f) == 0 || f[0].Index != nil
+	}
+	if !found {
+		if index, err = w.writeClassAs(key, classname, fields); err != nil {
+			return err
 		}
 	}
 	w.setRef(v)
@@ -1315,6 +1348,60 @@ func (w *writer) writeObject(v interface{}, rv reflect.Value) (err error) {
 	return err
 }
 
+func getFieldCache(t reflect.Type) cacheType {
+	fieldCache.RLock()
+	cache, found := fieldCache.cache[t]
+	fieldCache.RUnlock()
+	if found {
+		return cache
+	}
+	fieldCache.Lock()
+	defer fieldCache.Unlock()
+	if fieldCache.cache == nil {
+		fieldCache.cache = make(map[reflect.Type]cacheType)
+	}
+	fields := make([]field, 0)
+	hasAnonymousField := false
+	hasOmitEmptyField := false
+	getFieldsFunc(t, func(f reflect.StructField) {
+		if len(f.Index) > 1 {
+			hasAnonymousField = true
+		}
+		name, omitEmpty := parseFieldTag(f)
+		if omitEmpty {
+			hasOmitEmptyField = true
+		}
+		fields = append(fields, field{name, f.Index, omitEmpty})
+	})
+	cache = cacheType{fields, hasAnonymousField, hasOmitEmptyField}
+	fieldCache.cache[t] = cache
+	return cache
+}
+
+// nonemptyFields returns the fields of v without the empty omitempty fields,
+// and the key of the class defined by them. The key is the classname when no
+// field is omitted.
+func nonemptyFields(v reflect.Value, fields []field, classname string) ([]field, string) {
+	var nonempty []field
+	var mask []byte
+	for i, f := range fields {
+		if f.OmitEmpty && isEmptyValue(v.FieldByIndex(f.Index)) {
+			if mask == nil {
+				nonempty = append(make([]field, 0, len(fields)), fields[:i]...)
+				mask = append(make([]byte, 0, len(fields)), strings.Repeat("1", i)...)
+			}
+			mask = append(mask, '0')
+		} else if mask != nil {
+			nonempty = append(nonempty, f)
+			mask = append(mask, '1')
+		}
+	}
+	if mask == nil {
+		return fields, classname
+	}
+	return nonempty, classname + "\x00" + string(mask)
+}
+
 func (w *writer) writeObjectWithRef(v interface{}, rv reflect.Value) error {
 	if success, err := w.writeRef(w, v); err == nil && !success {
 		return w.writeObject(v, rv)
@@ -1324,6 +1411,11 @@ func (w *writer) writeObjectWithRef(v interface{}, rv reflect.Value) error {
 }
 
 func (w *writer) writeClass(classname string, fields []field) (index int, err error) {
+	return w.writeClassAs(classname, classname, fields)
+}
+
+// writeClassAs writes the class and remembers it by key.
+func (w *writer) writeClassAs(key string, classname string, fields []field) (index int, err error) {
 	s := w.stream
 	count := len(fields)
 	if err = s.WriteByte(TagClass); err != nil {
@@ -1365,7 +1457,7 @@ func (w *writer) writeClass(classname string, fields []field) (index int, err er
 		}
 	}
 	index = len(w.fieldsref)
-	w.classref[classname] = index
+	w.classref[key] = index
 	w.fieldsref = append(w.fieldsref, fields)
 	return index, nil
 }
@@ -1493,10 +1585,50 @@ func firstLetterToLower(s string) string {
 	return string(b)
 }
 
+// parseFieldTag returns the name of the field on the wire and whether the
+// field is omitted when it is empty. The name is specified by the hprose tag,
+// such as `hprose:"name,omitempty"`, the default name is the field name with
+// the first letter in lower case.
+func parseFieldTag(f reflect.StructField) (name string, omitEmpty bool) {
+	tag := f.Tag.Get("hprose")
+	if i := strings.IndexByte(tag, ','); i >= 0 {
+		for _, option := range strings.Split(tag[i+1:], ",") {
+			if option == "omitempty" {
+				omitEmpty = true
+			}
+		}
+		tag = tag[:i]
+	}
+	if tag == "" {
+		return firstLetterToLower(f.Name), omitEmpty
+	}
+	return tag, omitEmpty
+}
+
+func isEmptyValue(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Array, reflect.Map, reflect.Slice, reflect.String:
+		return v.Len() == 0
+	case reflect.Bool:
+		return !v.Bool()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int() == 0
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return v.Uint() == 0
+	case reflect.Float32, reflect.Float64:
+		return v.Float() == 0
+	case reflect.Interface, reflect.Ptr:
+		return v.IsNil()
+	}
+	return false
+}
+
+// getFieldsFunc calls set with every serializable field of class, the fields
+// with the `hprose:"-"` tag are ignored.
 func getFieldsFunc(class reflect.Type, set func(reflect.StructField)) {
 	count := class.NumField()
 	for i := 0; i < count; i++ {
-		if f := class.Field(i); serializeType[f.Type.Kind()] {
+		if f := class.Field(i); serializeType[f.Type.Kind()] && f.Tag.Get("hprose") != "-" {
 			if !f.Anonymous {
 				b := f.Name[0]
 				if 'A' <= b && b <= 'Z' {
@@ -1518,7 +1650,7 @@ func getFieldsFunc(class reflect.Type, set func(reflect.StructField)) {
 func getAnonymousFieldsFunc(class reflect.Type, index []int, set func(reflect.StructField)) {
 	count := class.NumField()
 	for i := 0; i < count; i++ {
-		if f := class.Field(i); serializeType[f.Type.Kind()] {
+		if f := class.Field(i); serializeType[f.Type.Kind()] && f.Tag.Get("hprose") != "-" {
 			f.Index = append(index, f.Index[0])
 			if !f.Anonymous {
 				b := f.Name[0]
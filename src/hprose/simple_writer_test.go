@@ -23,9 +23,11 @@ package hprose_test
 import (
 	"bytes"
 	"container/list"
+	"fmt"
 	. "hprose"
 	"math"
 	"math/big"
+	"net"
 	"strings"
 	"testing"
 	"time"
@@ -389,3 +391,167 @@ func TestSimpleWriterObject(t *testing.T) {
 		t.Error(b.String())
 	}
 }
+
+type testTaggedPerson struct {
+	Name     string `hprose:"user_name"`
+	Age      int    `hprose:",omitempty"`
+	Password string `hprose:"-"`
+	Male     bool
+}
+
+type testTaggedUser struct {
+	Name     string `hprose:"user_name"`
+	Password string `hprose:"-"`
+}
+
+type testMoney int64
+
+func (m testMoney) MarshalHprose(writer Writer) error {
+	return writer.WriteString(fmt.Sprintf("%d.%02d", m/100, m%100))
+}
+
+func (m *testMoney) UnmarshalHprose(reader Reader) error {
+	s, err := reader.ReadString()
+	if err == NilError {
+		*m = 0
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var yuan, fen int64
+	if _, err = fmt.Sscanf(s, "%d.%d", &yuan, &fen); err == nil {
+		*m = testMoney(yuan*100 + fen)
+	}
+	return err
+}
+
+type testColor uint8
+
+func (c *testColor) MarshalHprose(writer Writer) error {
+	_, err := writer.Stream().Write([]byte{'i', '0' + byte(*c), ';'})
+	return err
+}
+
+func (c *testColor) UnmarshalHprose(reader Reader) error {
+	raw, err := reader.ReadRaw()
+	if err == nil {
+		if len(raw) != 3 || raw[0] != 'i' || raw[2] != ';' {
+			return fmt.Errorf("bad color: %s", raw)
+		}
+		*c = testColor(raw[1] - '0')
+	}
+	return err
+}
+
+type testPoint struct {
+	X, Y byte
+}
+
+func (p testPoint) MarshalBinary() ([]byte, error) {
+	return []byte{p.X, p.Y}, nil
+}
+
+func (p *testPoint) UnmarshalBinary(data []byte) error {
+	if len(data) != 2 {
+		return fmt.Errorf("bad point: %v", data)
+	}
+	p.X, p.Y = data[0], data[1]
+	return nil
+}
+
+type testHost struct {
+	Addr  net.IP
+	Point *testPoint
+}
+
+type testOrder struct {
+	Price    testMoney
+	Color    testColor
+	Discount *testMoney
+}
+
+func TestSimpleWriterObjectTag(t *testing.T) {
+	b := new(bytes.Buffer)
+	writer := NewSimpleWriter(b)
+	if err := writer.Serialize(testTaggedUser{"Tom", "secret"}); err != nil {
+		t.Error(err.Error())
+	}
+	if err := writer.Serialize(testTaggedPerson{"Tom", 18, "secret", true}); err != nil {
+		t.Error(err.Error())
+	}
+	if err := writer.Serialize(testTaggedPerson{"Jerry", 0, "secret", false}); err != nil {
+		t.Error(err.Error())
+	}
+	if err := writer.Serialize(testTaggedPerson{"Spike", 0, "secret", true}); err != nil {
+		t.Error(err.Error())
+	}
+	s := `c14"testTaggedUser"1{s9"user_name"}o0{s3"Tom"}` +
+		`c16"testTaggedPerson"3{s9"user_name"s3"age"s4"male"}o1{s3"Tom"i18;t}` +
+		`c16"testTaggedPerson"2{s9"user_name"s4"male"}o2{s5"Jerry"f}o2{s5"Spike"t}`
+	if b.String() != s {
+		t.Error(b.String())
+	}
+	reader := NewSimpleReader(NewBufReader(b.Bytes()))
+	var u testTaggedUser
+	if err := reader.Unserialize(&u); err != nil || u != (testTaggedUser{"Tom", ""}) {
+		t.Error(u, err)
+	}
+	var p interface{}
+	if err := reader.Unserialize(&p); err != nil {
+		t.Error(err.Error())
+	} else if p, ok := p.(*testTaggedPerson); !ok || *p != (testTaggedPerson{"Tom", 18, "", true}) {
+		t.Error(p)
+	}
+	if err := reader.Unserialize(&p); err != nil {
+		t.Error(err.Error())
+	} else if p, ok := p.(*testTaggedPerson); !ok || *p != (testTaggedPerson{"Jerry", 0, "", false}) {
+		t.Error(p)
+	}
+	var q testTaggedPerson
+	if err := reader.Unserialize(&q); err != nil || q != (testTaggedPerson{"Spike", 0, "", true}) {
+		t.Error(q, err)
+	}
+}
+
+func TestSimpleWriterEncodingMarshaler(t *testing.T) {
+	b := new(bytes.Buffer)
+	writer := NewSimpleWriter(b)
+	if err := writer.Serialize(net.ParseIP("10.0.0.1")); err != nil {
+		t.Error(err.Error())
+	}
+	if err := writer.Serialize(testPoint{1, 2}); err != nil {
+		t.Error(err.Error())
+	}
+	if err := writer.Serialize(testHost{net.ParseIP("::1"), nil}); err != nil {
+		t.Error(err.Error())
+	}
+	s := `s8"10.0.0.1"` + "b2\"\x01\x02\"" +
+		`c8"testHost"2{s4"addr"s5"point"}o0{s3"::1"n}`
+	if b.String() != s {
+		t.Error(b.String())
+	}
+}
+
+func TestSimpleWriterMarshaler(t *testing.T) {
+	b := new(bytes.Buffer)
+	writer := NewSimpleWriter(b)
+	if err := writer.Serialize(testMoney(1234)); err != nil {
+		t.Error(err.Error())
+	}
+	color := testColor(3)
+	if err := writer.Serialize(&color); err != nil {
+		t.Error(err.Error())
+	}
+	if err := writer.Serialize((*testMoney)(nil)); err != nil {
+		t.Error(err.Error())
+	}
+	if err := writer.Serialize(&testOrder{Price: 5, Color: 2}); err != nil {
+		t.Error(err.Error())
+	}
+	s := `s5"12.34"i3;n` +
+		`c9"testOrder"3{s5"price"s5"color"s8"discount"}o0{s4"0.05"i2;n}`
+	if b.String() != s {
+		t.Error(b.String())
+	}
+}
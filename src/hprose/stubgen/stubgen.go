@@ -0,0 +1,386 @@
+/**********************************************************\
+|                                                          |
+|                          hprose                          |
+|                                                          |
+| Official WebSite: http://www.hprose.com/                 |
+|                   http://www.hprose.net/                 |
+|                   http://www.hprose.org/                 |
+|                                                          |
+\**********************************************************/
+/**********************************************************\
+ *                                                        *
+ * hprose/stubgen/stubgen.go                              *
+ *                                                        *
+ * hprose stub generator for Go.                          *
+ *                                                        *
+\**********************************************************/
+
+// Package stubgen generates the remote object structs used by
+// Client.UseService from the functions of a service.
+//
+// The functions are described by a Descriptor, which is read from a
+// running service, or exported by the service with Describe. A service
+// only sends the names of its functions, so the stubs of a running service
+// take and return interface{} values, while an exported descriptor has the
+// Go types of the parameters and the results.
+package stubgen
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"go/format"
+	"hprose"
+	"io"
+	"path"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Function describes a function of a service. Params and Results are Go
+// type expressions. Params is nil when the types are unknown, and the last
+// param is a slice when Variadic is true.
+type Function struct {
+	Name     string   `json:"name"`
+	Params   []string `json:"params"`
+	Results  []string `json:"results"`
+	Variadic bool     `json:"variadic,omitempty"`
+}
+
+// Import is a package imported by the types of a descriptor. Name is the
+// name the types refer to it by when it is not the name of the package.
+type Import struct {
+	Name string `json:"name,omitempty"`
+	Path string `json:"path"`
+}
+
+// Descriptor describes the functions of a service, and the packages
+// imported by their types.
+type Descriptor struct {
+	Imports   []Import   `json:"imports,omitempty"`
+	Functions []Function `json:"functions"`
+}
+
+// Options of the generated code.
+type Options struct {
+	// Package is the name of the package of the generated file.
+	Package string
+	// Type is the name of the remote object struct.
+	Type string
+	// Context adds a context.Context parameter to the error returning and
+	// async variants.
+	Context bool
+}
+
+var (
+	contextType        = reflect.TypeOf((*context.Context)(nil)).Elem()
+	serviceContextType = reflect.TypeOf((*hprose.ServiceContext)(nil))
+	errorType          = reflect.TypeOf((*error)(nil)).Elem()
+)
+
+// Describe returns the descriptor of the functions in methods, with their
+// types. The context parameters and the error results are left out, like
+// they are on the wire. The types which cannot be imported, such as the
+// ones declared in package main or in an internal package, are described
+// as interface{}, and the packages with the same name are renamed.
+func Describe(methods *hprose.Methods) *Descriptor {
+	d := new(Descriptor)
+	imports := &importSet{make(map[string]string), make(map[string]string), make(map[string]string)}
+	for _, name := range methods.MethodNames {
+		m := methods.RemoteMethods[strings.ToLower(name)]
+		if name == "*" || m == nil {
+			continue
+		}
+		t := m.Function.Type()
+		f := Function{Name: name, Params: make([]string, 0), Results: make([]string, 0), Variadic: t.IsVariadic()}
+		for i := 0; i < t.NumIn(); i++ {
+			in := t.In(i)
+			if i == 0 && (in == contextType || in == serviceContextType) {
+				continue
+			}
+			f.Params = append(f.Params, typeString(in, imports))
+		}
+		n := t.NumOut()
+		if n > 0 && t.Out(n-1).Implements(errorType) {
+			n--
+		}
+		for i := 0; i < n; i++ {
+			if m.ResultMode != hprose.Normal {
+				// the raw results are sent as they are.
+				f.Results = append(f.Results, "interface{}")
+			} else {
+				f.Results = append(f.Results, typeString(t.Out(i), imports))
+			}
+		}
+		d.Functions = append(d.Functions, f)
+	}
+	for path, name := range imports.names {
+		i := Import{Path: path}
+		if name != imports.packages[path] {
+			i.Name = name
+		}
+		d.Imports = append(d.Imports, i)
+	}
+	sort.Slice(d.Imports, func(i, j int) bool {
+		return d.Imports[i].Path < d.Imports[j].Path
+	})
+	return d
+}
+
+// importSet holds the packages imported by the types. It maps the paths
+// to the names the types refer to them by and to the package names, and
+// the names back to the paths.
+type importSet struct {
+	names    map[string]string
+	packages map[string]string
+	paths    map[string]string
+}
+
+// add returns the name of the package at path, which is renamed when
+// another package has the same name.
+func (s *importSet) add(path string, pkg string) string {
+	if name, ok := s.names[path]; ok {
+		return name
+	}
+	name := pkg
+	for i := 2; s.paths[name] != ""; i++ {
+		name = pkg + strconv.Itoa(i)
+	}
+	s.names[path], s.paths[name], s.packages[path] = name, path, pkg
+	return name
+}
+
+// importable reports whether the package at path can be imported by the
+// generated code.
+func importable(path string) bool {
+	return path != "main" && path != "internal" &&
+		!strings.HasPrefix(path, "internal/") &&
+		!strings.HasSuffix(path, "/internal") &&
+		!strings.Contains(path, "/internal/")
+}
+
+// typeString returns the Go expression of t, and adds the packages it
+// needs to imports.
+func typeString(t reflect.Type, imports *importSet) string {
+	if t.Name() != "" {
+		path := t.PkgPath()
+		if path == "" {
+			return t.String()
+		}
+		// the instances of the generic types are not described.
+		if !importable(path) || strings.Contains(t.Name(), "[") {
+			return "interface{}"
+		}
+		s := t.String()
+		i := strings.IndexByte(s, '.')
+		return imports.add(path, s[:i]) + s[i:]
+	}
+	switch t.Kind() {
+	case reflect.Ptr:
+		return "*" + typeString(t.Elem(), imports)
+	case reflect.Slice:
+		return "[]" + typeString(t.Elem(), imports)
+	case reflect.Array:
+		return "[" + strconv.Itoa(t.Len()) + "]" + typeString(t.Elem(), imports)
+	case reflect.Map:
+		return "map[" + typeString(t.Key(), imports) + "]" + typeString(t.Elem(), imports)
+	}
+	return "interface{}"
+}
+
+// FromService returns the descriptor of the functions published by the
+// service of client, which has no types. The client must implement
+// hprose.FunctionLister.
+func FromService(ctx context.Context, client hprose.Client) (*Descriptor, error) {
+	lister, ok := client.(hprose.FunctionLister)
+	if !ok {
+		return nil, errors.New("the client can't list the functions of the service")
+	}
+	names, err := lister.FunctionList(ctx)
+	if err != nil {
+		return nil, err
+	}
+	d := new(Descriptor)
+	for _, name := range names {
+		if name != "*" {
+			d.Functions = append(d.Functions, Function{Name: name})
+		}
+	}
+	return d, nil
+}
+
+// ReadDescriptor reads a descriptor written by WriteDescriptor.
+func ReadDescriptor(r io.Reader) (*Descriptor, error) {
+	d := new(Descriptor)
+	if err := json.NewDecoder(r).Decode(d); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// WriteDescriptor writes d as JSON.
+func WriteDescriptor(w io.Writer, d *Descriptor) error {
+	data, err := json.MarshalIndent(d, "", "\t")
+	if err == nil {
+		_, err = w.Write(append(data, '\n'))
+	}
+	return err
+}
+
+// Generate returns the formatted source of a file declaring the remote
+// object struct of the functions in d. Every function has three fields,
+// all tagged with its name:
+//
+//	Hello      func(string) string                          // panics on errors
+//	HelloErr   func(string) (string, error)
+//	HelloAsync func(string) (<-chan string, <-chan error)
+func Generate(d *Descriptor, options Options) ([]byte, error) {
+	if options.Package == "" {
+		options.Package = "main"
+	}
+	if options.Type == "" {
+		options.Type = "Service"
+	}
+	buf := new(bytes.Buffer)
+	buf.WriteString("// Code generated by hprose-stubgen. DO NOT EDIT.\n\n")
+	buf.WriteString("package " + options.Package + "\n\n")
+	imports := append([]Import(nil), d.Imports...)
+	contextName := "context"
+	if options.Context && len(d.Functions) > 0 {
+		contextName = addContextImport(&imports)
+	}
+	sort.Slice(imports, func(i, j int) bool {
+		return imports[i].Path < imports[j].Path
+	})
+	switch len(imports) {
+	case 0:
+	case 1:
+		buf.WriteString("import " + importSpec(imports[0]) + "\n")
+	default:
+		buf.WriteString("import (\n")
+		for _, i := range imports {
+			buf.WriteString("\t" + importSpec(i) + "\n")
+		}
+		buf.WriteString(")\n")
+	}
+	buf.WriteString("\n// " + options.Type + " is the remote object of the service, for Client.UseService.\n")
+	buf.WriteString("type " + options.Type + " struct {\n")
+	used := make(map[string]bool)
+	for _, f := range d.Functions {
+		name := fieldName(f.Name, used)
+		if name == "" {
+			return nil, errors.New("no Go name for function " + f.Name)
+		}
+		tag := " `name:" + strconv.Quote(f.Name) + "`\n"
+		params := paramList(f)
+		results := f.Results
+		if f.Params == nil {
+			results = []string{"interface{}"}
+		}
+		ctxParams := params
+		if options.Context {
+			ctxParams = append([]string{contextName + ".Context"}, params...)
+		}
+		async := make([]string, len(results)+1)
+		for i, r := range results {
+			async[i] = "<-chan " + r
+		}
+		async[len(results)] = "<-chan error"
+		buf.WriteString("\t" + name + " func(" + strings.Join(params, ", ") + ")" + resultList(results) + tag)
+		buf.WriteString("\t" + name + "Err func(" + strings.Join(ctxParams, ", ") + ")" +
+			resultList(append(append([]string(nil), results...), "error")) + tag)
+		buf.WriteString("\t" + name + "Async func(" + strings.Join(ctxParams, ", ") + ")" + resultList(async) + tag)
+	}
+	buf.WriteString("}\n")
+	return format.Source(buf.Bytes())
+}
+
+// addContextImport adds the context package to imports, and returns the
+// name it is imported by, which is renamed when another package has the
+// name context.
+func addContextImport(imports *[]Import) string {
+	used := make(map[string]bool)
+	for _, i := range *imports {
+		name := i.Name
+		if name == "" {
+			name = path.Base(i.Path)
+		}
+		if i.Path == "context" {
+			return name
+		}
+		used[name] = true
+	}
+	i := Import{Path: "context"}
+	name := "context"
+	for n := 2; used[name]; n++ {
+		name = "context" + strconv.Itoa(n)
+		i.Name = name
+	}
+	*imports = append(*imports, i)
+	return name
+}
+
+func importSpec(i Import) string {
+	if i.Name == "" {
+		return strconv.Quote(i.Path)
+	}
+	return i.Name + " " + strconv.Quote(i.Path)
+}
+
+func paramList(f Function) []string {
+	if f.Params == nil {
+		return []string{"...interface{}"}
+	}
+	params := append([]string(nil), f.Params...)
+	if n := len(params); f.Variadic && n > 0 {
+		params[n-1] = "..." + strings.TrimPrefix(params[n-1], "[]")
+	}
+	return params
+}
+
+func resultList(results []string) string {
+	switch len(results) {
+	case 0:
+		return ""
+	case 1:
+		return " " + results[0]
+	}
+	return " (" + strings.Join(results, ", ") + ")"
+}
+
+// fieldName returns an exported Go name for the function name, which is
+// not in used with the suffixes of the variants.
+func fieldName(name string, used map[string]bool) string {
+	var buf bytes.Buffer
+	upper := true
+	for _, r := range name {
+		switch {
+		case unicode.IsLetter(r) || unicode.IsDigit(r) && buf.Len() > 0:
+			if upper {
+				r = unicode.ToUpper(r)
+				upper = false
+			}
+			buf.WriteRune(r)
+		default:
+			upper = true
+		}
+	}
+	base := buf.String()
+	if base == "" {
+		return ""
+	}
+	if r := []rune(base)[0]; !unicode.IsUpper(r) {
+		// the letters without cases can't start an exported name.
+		base = "F" + base
+	}
+	field := base
+	for i := 2; used[field] || used[field+"Err"] || used[field+"Async"]; i++ {
+		field = base + strconv.Itoa(i)
+	}
+	used[field], used[field+"Err"], used[field+"Async"] = true, true, true
+	return field
+}
@@ -0,0 +1,299 @@
+/**********************************************************\
+|                                                          |
+|                          hprose                          |
+|                                                          |
+| Official WebSite: http://www.hprose.com/                 |
+|                   http://www.hprose.net/                 |
+|                   http://www.hprose.org/                 |
+|                                                          |
+\**********************************************************/
+/**********************************************************\
+ *                                                        *
+ * hprose/stubgen/stubgen_test.go                         *
+ *                                                        *
+ * hprose stub generator Test for Go.                     *
+ *                                                        *
+\**********************************************************/
+
+package stubgen_test
+
+import (
+	"bytes"
+	"context"
+	"go/build"
+	"hprose"
+	"hprose/stubgen"
+	htemplate "html/template"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	ttemplate "text/template"
+	"time"
+)
+
+// sameCode compares the code without the spaces aligning the fields.
+func sameCode(a, b string) bool {
+	return strings.Join(strings.Fields(a), " ") == strings.Join(strings.Fields(b), " ")
+}
+
+func testMethods() *hprose.Methods {
+	methods := hprose.NewMethods()
+	methods.AddFunction("hello", func(name string) (string, error) { return "Hello " + name, nil })
+	methods.AddFunction("sum", func(a ...int) int { return len(a) })
+	methods.AddFunction("now", func(context *hprose.ServiceContext) time.Time { return time.Now() })
+	methods.AddFunction("swap", func(a, b map[string][]*int) (map[string][]*int, map[string][]*int) { return b, a })
+	methods.AddFunction("get_user", func(id [2]byte) interface{} { return nil })
+	return methods
+}
+
+func TestDescribe(t *testing.T) {
+	d := stubgen.Describe(testMethods())
+	expected := &stubgen.Descriptor{
+		Imports: []stubgen.Import{{Path: "time"}},
+		Functions: []stubgen.Function{
+			{Name: "hello", Params: []string{"string"}, Results: []string{"string"}},
+			{Name: "sum", Params: []string{"[]int"}, Results: []string{"int"}, Variadic: true},
+			{Name: "now", Params: []string{}, Results: []string{"time.Time"}},
+			{Name: "swap", Params: []string{"map[string][]*int", "map[string][]*int"},
+				Results: []string{"map[string][]*int", "map[string][]*int"}},
+			{Name: "get_user", Params: []string{"[2]uint8"}, Results: []string{"interface{}"}},
+		},
+	}
+	if !reflect.DeepEqual(d, expected) {
+		t.Errorf("%#v", d)
+	}
+	buf := new(bytes.Buffer)
+	if err := stubgen.WriteDescriptor(buf, d); err != nil {
+		t.Fatal(err.Error())
+	}
+	if d, err := stubgen.ReadDescriptor(buf); err != nil || !reflect.DeepEqual(d, expected) {
+		t.Errorf("%#v %v", d, err)
+	}
+}
+
+func TestGenerate(t *testing.T) {
+	src, err := stubgen.Generate(stubgen.Describe(testMethods()), stubgen.Options{Package: "stub", Context: true})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	expected := "// Code generated by hprose-stubgen. DO NOT EDIT.\n" + `
+package stub
+
+import (
+	"context"
+	"time"
+)
+
+// Service is the remote object of the service, for Client.UseService.
+type Service struct {
+	Hello func(string) string ` + "`name:\"hello\"`" + `
+	HelloErr func(context.Context, string) (string, error) ` + "`name:\"hello\"`" + `
+	HelloAsync func(context.Context, string) (<-chan string, <-chan error) ` + "`name:\"hello\"`" + `
+	Sum func(...int) int ` + "`name:\"sum\"`" + `
+	SumErr func(context.Context, ...int) (int, error) ` + "`name:\"sum\"`" + `
+	SumAsync func(context.Context, ...int) (<-chan int, <-chan error) ` + "`name:\"sum\"`" + `
+	Now func() time.Time ` + "`name:\"now\"`" + `
+	NowErr func(context.Context) (time.Time, error) ` + "`name:\"now\"`" + `
+	NowAsync func(context.Context) (<-chan time.Time, <-chan error) ` + "`name:\"now\"`" + `
+	Swap func(map[string][]*int, map[string][]*int) (map[string][]*int, map[string][]*int) ` + "`name:\"swap\"`" + `
+	SwapErr func(context.Context, map[string][]*int, map[string][]*int) (map[string][]*int, map[string][]*int, error) ` + "`name:\"swap\"`" + `
+	SwapAsync func(context.Context, map[string][]*int, map[string][]*int) (<-chan map[string][]*int, <-chan map[string][]*int, <-chan error) ` + "`name:\"swap\"`" + `
+	GetUser func([2]uint8) interface{} ` + "`name:\"get_user\"`" + `
+	GetUserErr func(context.Context, [2]uint8) (interface{}, error) ` + "`name:\"get_user\"`" + `
+	GetUserAsync func(context.Context, [2]uint8) (<-chan interface{}, <-chan error) ` + "`name:\"get_user\"`" + `
+}
+`
+	if !sameCode(string(src), expected) {
+		t.Error(string(src))
+	}
+}
+
+func TestGenerateImports(t *testing.T) {
+	methods := hprose.NewMethods()
+	methods.AddFunction("parse", func(t *ttemplate.Template, h *htemplate.Template) *htemplate.Template { return h })
+	d := stubgen.Describe(methods)
+	expected := &stubgen.Descriptor{
+		Imports: []stubgen.Import{{Name: "template2", Path: "html/template"}, {Path: "text/template"}},
+		Functions: []stubgen.Function{
+			{Name: "parse", Params: []string{"*template.Template", "*template2.Template"},
+				Results: []string{"*template2.Template"}},
+		},
+	}
+	if !reflect.DeepEqual(d, expected) {
+		t.Errorf("%#v", d)
+	}
+	src, err := stubgen.Generate(d, stubgen.Options{Package: "stub"})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if !strings.Contains(string(src), "import (\n\ttemplate2 \"html/template\"\n\t\"text/template\"\n)") {
+		t.Error(string(src))
+	}
+	d.Imports = append(d.Imports, stubgen.Import{Name: "context", Path: "example.com/context"})
+	src, err = stubgen.Generate(d, stubgen.Options{Package: "stub", Context: true})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if !strings.Contains(string(src), "\tcontext2 \"context\"\n") ||
+		!strings.Contains(string(src), "func(context2.Context, *template.Template, *template2.Template)") {
+		t.Error(string(src))
+	}
+}
+
+func TestFromService(t *testing.T) {
+	service := hprose.NewHttpService()
+	service.AddFunction("hello", func(name string) string { return "Hello " + name })
+	service.AddFunction("Hello", func(name string) string { return "Hello " + name })
+	server := httptest.NewServer(service)
+	defer server.Close()
+	d, err := stubgen.FromService(context.Background(), hprose.NewClient(server.URL))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	src, err := stubgen.Generate(d, stubgen.Options{Type: "Hello"})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	expected := "// Code generated by hprose-stubgen. DO NOT EDIT.\n" + `
+package main
+
+// Hello is the remote object of the service, for Client.UseService.
+type Hello struct {
+	Hello func(...interface{}) interface{} ` + "`name:\"hello\"`" + `
+	HelloErr func(...interface{}) (interface{}, error) ` + "`name:\"hello\"`" + `
+	HelloAsync func(...interface{}) (<-chan interface{}, <-chan error) ` + "`name:\"hello\"`" + `
+	Hello2 func(...interface{}) interface{} ` + "`name:\"Hello\"`" + `
+	Hello2Err func(...interface{}) (interface{}, error) ` + "`name:\"Hello\"`" + `
+	Hello2Async func(...interface{}) (<-chan interface{}, <-chan error) ` + "`name:\"Hello\"`" + `
+}
+`
+	if !sameCode(string(src), expected) {
+		t.Error(string(src))
+	}
+}
+
+var testStubFiles = map[string]string{
+	"internal/geo/geo.go": `package geo
+
+type Point struct {
+	X, Y int
+}
+`,
+	"service/service.go": `package service
+
+import (
+	"errors"
+	"hprose"
+	"stubtest/internal/geo"
+)
+
+func Methods() *hprose.Methods {
+	methods := hprose.NewMethods()
+	methods.AddFunction("hello", func(name string) string { return "Hello " + name })
+	methods.AddFunction("div", func(a, b int) (int, error) {
+		if b == 0 {
+			return 0, errors.New("division by zero")
+		}
+		return a / b, nil
+	})
+	methods.AddFunction("move", func(p geo.Point, d int) geo.Point { return geo.Point{X: p.X + d, Y: p.Y + d} })
+	return methods
+}
+`,
+	"gen/main.go": `package main
+
+import (
+	"hprose/stubgen"
+	"os"
+	"stubtest/service"
+)
+
+func main() {
+	d := stubgen.Describe(service.Methods())
+	src, err := stubgen.Generate(d, stubgen.Options{Type: "Stub", Context: true})
+	if err != nil {
+		panic(err)
+	}
+	os.Stdout.Write(src)
+}
+`,
+	"client/main.go": `package main
+
+import (
+	"context"
+	"fmt"
+	"hprose"
+	"net/http/httptest"
+	"stubtest/service"
+)
+
+func main() {
+	svc := hprose.NewHttpService()
+	svc.Methods = service.Methods()
+	server := httptest.NewServer(svc)
+	defer server.Close()
+	var stub *Stub
+	hprose.NewClient(server.URL).UseService(&stub)
+	ctx := context.Background()
+	fmt.Println(stub.Hello("World"))
+	fmt.Println(stub.DivErr(ctx, 7, 2))
+	fmt.Println(stub.DivErr(ctx, 1, 0))
+	p, err := stub.MoveAsync(ctx, &map[string]int{"x": 1, "y": 2}, 1)
+	fmt.Println(<-p, <-err)
+}
+`,
+}
+
+// goRun runs the package stubtest/pkg in the GOPATH of the test extended
+// by dir.
+func goRun(t *testing.T, dir string, pkg string) string {
+	gopath := os.Getenv("GOPATH")
+	if gopath == "" {
+		gopath = build.Default.GOPATH
+	}
+	cmd := exec.Command("go", "run", "stubtest/"+pkg)
+	cmd.Env = append(os.Environ(), "GOPATH="+dir+string(filepath.ListSeparator)+gopath, "GO111MODULE=off", "GOFLAGS=")
+	out, err := cmd.Output()
+	if err != nil {
+		if e, ok := err.(*exec.ExitError); ok {
+			t.Fatalf("%s: %v\n%s", pkg, err, e.Stderr)
+		}
+		t.Fatalf("%s: %v", pkg, err)
+	}
+	return string(out)
+}
+
+func TestGeneratedStub(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping the build of a generated stub in short mode")
+	}
+	if _, err := exec.LookPath("go"); err != nil {
+		t.Skip("the go command is not found")
+	}
+	dir := t.TempDir()
+	for name, src := range testStubFiles {
+		file := filepath.Join(dir, "src", "stubtest", filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+			t.Fatal(err.Error())
+		}
+		if err := ioutil.WriteFile(file, []byte(src), 0644); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	stub := goRun(t, dir, "gen")
+	if !strings.Contains(strings.Join(strings.Fields(stub), " "), "Move func(interface{}, int) interface{}") {
+		t.Error(stub)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "src", "stubtest", "client", "stub.go"), []byte(stub), 0644); err != nil {
+		t.Fatal(err.Error())
+	}
+	expected := "Hello World\n3 <nil>\n0 division by zero\n&{2 3} <nil>\n"
+	if out := goRun(t, dir, "client"); out != expected {
+		t.Error(out)
+	}
+}
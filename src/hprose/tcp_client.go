@@ -22,10 +22,12 @@ package hprose
 
 import (
 	"bufio"
-	"bytes"
+	"context"
 	"crypto/tls"
+	"errors"
 	"net"
 	"net/url"
+	"sync"
 	"time"
 )
 
@@ -41,26 +43,77 @@ type TcpClient struct {
 	writerBuffer    interface{}
 	writerDeadline  interface{}
 	config          *tls.Config
+	maxPoolSize     int
+	idleTimeout     time.Duration
+	fullDuplex      bool
+	framed          bool
 }
 
+// TcpTransporter keeps a pool of connections, every invoking takes one
+// connection from the pool and puts it back when the invoking is ended,
+// so a TcpClient can be shared by many goroutines.
+//
+// In full duplex mode all invokings share one connection, the requests and
+// responses are sent in frames with a request id, so the responses may come
+// back out of order. When the server doesn't support the full duplex mode,
+// the transporter falls back to the pool.
 type TcpTransporter struct {
-	net.Conn
-	uri     string
-	istream *bufio.Reader
 	*TcpClient
+	mutex     sync.Mutex
+	uri       string
+	idle      []*tcpConn
+	count     int
+	notify    chan struct{}
+	dialMutex sync.Mutex
+	duplex    *tcpDuplexConn
+	legacy    bool
+	idleTimer *time.Timer
 }
 
 type TcpContext struct {
-	buf *bytes.Buffer
+	conn     *tcpConn
+	stop     func() bool
+	duplex   *tcpDuplexConn
+	id       uint32
+	response chan duplexResponse
+	ctx      context.Context
+}
+
+type tcpConn struct {
+	net.Conn
+	uri      string
+	istream  *bufio.Reader
+	lastUsed time.Time
+	framed   bool
+}
+
+type tcpDuplexConn struct {
+	*tcpConn
+	duplexCalls
+	writing chan struct{}
 }
 
+// aLongTimeAgo is used as the deadline of a connection to abort a blocked
+// read or write when the invoke context is cancelled.
+var aLongTimeAgo = time.Unix(1, 0)
+
 func NewTcpClient(uri string) Client {
-	client := &TcpClient{BaseClient: NewBaseClient(new(TcpTransporter))}
-	client.Transporter.(*TcpTransporter).TcpClient = client
+	client := newTcpClient()
 	client.SetUri(uri)
 	return client
 }
 
+func newTcpClient() *TcpClient {
+	trans := &TcpTransporter{notify: make(chan struct{}, 1)}
+	client := &TcpClient{
+		BaseClient:  NewBaseClient(trans),
+		maxPoolSize: 16,
+		idleTimeout: 30 * time.Second,
+	}
+	trans.TcpClient = client
+	return client
+}
+
 func (client *TcpClient) SetUri(uri string) {
 	if u, err := url.Parse(uri); err == nil {
 		if u.Scheme != "tcp" && u.Scheme != "tcp4" && u.Scheme != "tcp6" {
@@ -70,12 +123,16 @@ func (client *TcpClient) SetUri(uri string) {
 	client.BaseClient.SetUri(uri)
 }
 
+// Close closes the idle connections in the pool and the full duplex
+// connection. The connections in use will be closed when their invoking is
+// ended.
 func (client *TcpClient) Close() {
-	conn := client.Transporter.(*TcpTransporter).Conn
-	if conn != nil {
-		conn.Close()
-		client.Transporter.(*TcpTransporter).Conn = nil
-	}
+	t := client.Transporter.(*TcpTransporter)
+	t.mutex.Lock()
+	t.closeIdleConns()
+	t.closeDuplexConn()
+	t.mutex.Unlock()
+	t.signal()
 }
 
 func (client *TcpClient) SetDeadline(t time.Time) {
@@ -118,100 +175,559 @@ func (client *TcpClient) SetTLSConfig(config *tls.Config) {
 	client.config = config
 }
 
+// MaxPoolSize returns the maximum number of connections the client opens
+// at the same time. Zero means no limit.
+func (client *TcpClient) MaxPoolSize() int {
+	t := client.Transporter.(*TcpTransporter)
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return client.maxPoolSize
+}
+
+// SetMaxPoolSize sets the maximum number of connections the client opens at
+// the same time. When all of them are in use, an invoking waits until one of
+// them is put back. Zero means no limit.
+func (client *TcpClient) SetMaxPoolSize(size int) {
+	t := client.Transporter.(*TcpTransporter)
+	t.mutex.Lock()
+	client.maxPoolSize = size
+	t.mutex.Unlock()
+	t.signal()
+}
+
+// IdleTimeout returns how long an idle connection is kept in the pool.
+func (client *TcpClient) IdleTimeout() time.Duration {
+	t := client.Transporter.(*TcpTransporter)
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return client.idleTimeout
+}
+
+// SetIdleTimeout sets how long an idle connection is kept in the pool, it
+// is closed by a timer even if the client isn't used any more. Zero means
+// idle connections are never closed by the client.
+func (client *TcpClient) SetIdleTimeout(timeout time.Duration) {
+	t := client.Transporter.(*TcpTransporter)
+	t.mutex.Lock()
+	client.idleTimeout = timeout
+	t.mutex.Unlock()
+}
+
+// FullDuplex reports whether the client sends all invokings on one full
+// duplex connection.
+func (client *TcpClient) FullDuplex() bool {
+	t := client.Transporter.(*TcpTransporter)
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return client.fullDuplex
+}
+
+// SetFullDuplex sets whether the client sends all invokings on one full
+// duplex connection. The full duplex mode is negotiated with the server
+// when the connection is opened, if the server doesn't support it, the
+// client uses the connection pool as usual.
+func (client *TcpClient) SetFullDuplex(fullDuplex bool) {
+	t := client.Transporter.(*TcpTransporter)
+	t.mutex.Lock()
+	client.fullDuplex = fullDuplex
+	t.mutex.Unlock()
+}
+
+// Framed reports whether the client sends every request in a frame.
+func (client *TcpClient) Framed() bool {
+	t := client.Transporter.(*TcpTransporter)
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return client.framed
+}
+
+// SetFramed sets whether the client sends every request in a frame with a
+// 4 bytes length header, and reads every response in the same way. A
+// malformed message can't break the connection in the framed mode. The
+// framed mode is negotiated with the server when the connection is opened,
+// if the server doesn't support it, the connection is used without frames.
+// The full duplex mode is always framed.
+func (client *TcpClient) SetFramed(framed bool) {
+	t := client.Transporter.(*TcpTransporter)
+	t.mutex.Lock()
+	client.framed = framed
+	t.mutex.Unlock()
+}
+
+// setOptions sets the options of the connection, the keep alive, linger and
+// no delay options are only for the tcp connections.
+func (client *TcpClient) setOptions(conn net.Conn) (err error) {
+	if conn, ok := conn.(*net.TCPConn); ok {
+		if client.keepAlive != nil {
+			if err = conn.SetKeepAlive(client.keepAlive.(bool)); err != nil {
+				return err
+			}
+		}
+		if client.keepAlivePeriod != nil {
+			if err = conn.SetKeepAlivePeriod(client.keepAlivePeriod.(time.Duration)); err != nil {
+				return err
+			}
+		}
+		if client.linger != nil {
+			if err = conn.SetLinger(client.linger.(int)); err != nil {
+				return err
+			}
+		}
+		if client.noDelay != nil {
+			if err = conn.SetNoDelay(client.noDelay.(bool)); err != nil {
+				return err
+			}
+		}
+	}
+	if conn, ok := conn.(socketConn); ok {
+		if client.readBuffer != nil {
+			if err = conn.SetReadBuffer(client.readBuffer.(int)); err != nil {
+				return err
+			}
+		}
+		if client.writerBuffer != nil {
+			if err = conn.SetWriteBuffer(client.writerBuffer.(int)); err != nil {
+				return err
+			}
+		}
+	}
+	if client.deadline != nil {
+		if err = conn.SetDeadline(client.deadline.(time.Time)); err != nil {
+			return err
+		}
+	}
+	if client.readDeadline != nil {
+		if err = conn.SetReadDeadline(client.readDeadline.(time.Time)); err != nil {
+			return err
+		}
+	}
+	if client.writerDeadline != nil {
+		if err = conn.SetWriteDeadline(client.writerDeadline.(time.Time)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (client *TcpClient) writeDeadlineTime() time.Time {
+	if client.writerDeadline != nil {
+		return client.writerDeadline.(time.Time)
+	}
+	if client.deadline != nil {
+		return client.deadline.(time.Time)
+	}
+	return time.Time{}
+}
+
+func (client *TcpClient) readDeadlineTime() time.Time {
+	if client.readDeadline != nil {
+		return client.readDeadline.(time.Time)
+	}
+	if client.deadline != nil {
+		return client.deadline.(time.Time)
+	}
+	return time.Time{}
+}
+
 func (t *TcpTransporter) GetInvokeContext(uri string) (interface{}, error) {
-	if t.uri != uri {
-		t.uri = uri
-		if t.Conn != nil {
-			t.Conn.Close()
-			t.Conn = nil
-		}
-	}
-	if t.Conn == nil {
-		if u, err := url.Parse(uri); err == nil {
-			if tcpaddr, err := net.ResolveTCPAddr(u.Scheme, u.Host); err == nil {
-				if conn, err := net.DialTCP("tcp", nil, tcpaddr); err == nil {
-					if t.keepAlive != nil {
-						if err := conn.SetKeepAlive(t.keepAlive.(bool)); err != nil {
-							return nil, err
-						}
-					}
-					if t.keepAlivePeriod != nil {
-						if err := conn.SetKeepAlivePeriod(t.keepAlivePeriod.(time.Duration)); err != nil {
-							return nil, err
-						}
-					}
-					if t.linger != nil {
-						if err := conn.SetLinger(t.linger.(int)); err != nil {
-							return nil, err
-						}
-					}
-					if t.noDelay != nil {
-						if err := conn.SetNoDelay(t.noDelay.(bool)); err != nil {
-							return nil, err
-						}
-					}
-					if t.readBuffer != nil {
-						if err := conn.SetReadBuffer(t.readBuffer.(int)); err != nil {
-							return nil, err
-						}
-					}
-					if t.writerBuffer != nil {
-						if err := conn.SetWriteBuffer(t.writerBuffer.(int)); err != nil {
-							return nil, err
-						}
-					}
-					if t.deadline != nil {
-						if err := conn.SetDeadline(t.deadline.(time.Time)); err != nil {
-							return nil, err
-						}
-					}
-					if t.readDeadline != nil {
-						if err := conn.SetReadDeadline(t.readDeadline.(time.Time)); err != nil {
-							return nil, err
-						}
-					}
-					if t.writerDeadline != nil {
-						if err := conn.SetWriteDeadline(t.writerDeadline.(time.Time)); err != nil {
-							return nil, err
-						}
-					}
-					if t.config != nil {
-						t.Conn = tls.Client(conn, t.config)
-					} else {
-						t.Conn = conn
-					}
-					t.istream = bufio.NewReader(t.Conn)
-				} else {
-					return nil, err
-				}
-			} else {
+	return t.GetInvokeContextWithContext(context.Background(), uri)
+}
+
+func (t *TcpTransporter) GetInvokeContextWithContext(ctx context.Context, uri string) (interface{}, error) {
+	if t.FullDuplex() {
+		dc, err := t.getDuplexConn(ctx, uri)
+		if err != nil {
+			return nil, err
+		}
+		if dc != nil {
+			id, response, err := dc.register()
+			if err != nil {
 				return nil, err
 			}
-		} else {
-			return nil, err
+			return &TcpContext{duplex: dc, id: id, response: response, ctx: ctx}, nil
 		}
 	}
-	return new(TcpContext), nil
+	conn, err := t.getConn(ctx, uri)
+	if err != nil {
+		return nil, err
+	}
+	stop := context.AfterFunc(ctx, func() {
+		conn.SetDeadline(aLongTimeAgo)
+	})
+	return &TcpContext{conn: conn, stop: stop}, nil
 }
 
 func (t *TcpTransporter) SendData(context interface{}, data []byte, success bool) (err error) {
 	if success {
-		if _, err = t.Conn.Write(data); err != nil {
-			t.Conn.Close()
-			t.Conn = nil
+		c := context.(*TcpContext)
+		if c.duplex != nil {
+			err = c.duplex.write(c.ctx, data, c.id, t.writeDeadlineTime())
+		} else if c.conn.framed {
+			err = writeTcpFrame(c.conn, data, 0, false)
+		} else {
+			_, err = c.conn.Write(data)
 		}
 	}
 	return err
 }
 
 func (t *TcpTransporter) GetInputStream(context interface{}) (BufReader, error) {
-	return t.istream, nil
+	c := context.(*TcpContext)
+	if c.duplex != nil {
+		return waitResponse(c.ctx, c.response)
+	}
+	if c.conn.framed {
+		data, _, duplex, err := readTcpFrame(c.conn.istream, t.Limits.MaxMessageSize)
+		if err == nil && duplex {
+			err = errors.New("Wrong Response: unexpected request id.")
+		}
+		if err != nil {
+			return nil, err
+		}
+		return NewBufReader(data), nil
+	}
+	return c.conn.istream, nil
 }
 
 func (t *TcpTransporter) EndInvoke(context interface{}, success bool) error {
-	if !success {
-		t.Conn.Close()
-		t.Conn = nil
+	c := context.(*TcpContext)
+	if c.duplex != nil {
+		c.duplex.unregister(c.id)
+		return nil
+	}
+	if !c.stop() {
+		// the deadline of the connection has been reset by the cancellation
+		success = false
 	}
+	t.putConn(c.conn, success)
 	return nil
 }
+
+// private methods
+
+func (t *TcpTransporter) getConn(ctx context.Context, uri string) (*tcpConn, error) {
+	for {
+		t.mutex.Lock()
+		t.changeUri(uri)
+		if n := len(t.idle); n > 0 {
+			conn := t.idle[n-1]
+			t.idle = t.idle[:n-1]
+			if n > 1 {
+				t.signal()
+			}
+			t.mutex.Unlock()
+			if t.checkConn(conn) {
+				return conn, nil
+			}
+			t.putConn(conn, false)
+			continue
+		}
+		if t.maxPoolSize <= 0 || t.count < t.maxPoolSize {
+			t.count++
+			if t.maxPoolSize <= 0 || t.count < t.maxPoolSize {
+				t.signal()
+			}
+			t.mutex.Unlock()
+			conn, err := t.dial(ctx, uri)
+			if err != nil {
+				t.mutex.Lock()
+				t.count--
+				t.mutex.Unlock()
+				t.signal()
+				return nil, err
+			}
+			return conn, nil
+		}
+		t.mutex.Unlock()
+		select {
+		case <-t.notify:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+func (t *TcpTransporter) putConn(conn *tcpConn, reuse bool) {
+	t.mutex.Lock()
+	now := time.Now()
+	t.closeExpiredConns(now)
+	if reuse && conn.uri == t.uri {
+		conn.lastUsed = now
+		t.idle = append(t.idle, conn)
+		if t.idleTimeout > 0 && t.idleTimer == nil {
+			t.idleTimer = time.AfterFunc(t.idleTimeout, t.expireIdleConns)
+		}
+	} else {
+		conn.Close()
+		t.count--
+	}
+	t.mutex.Unlock()
+	t.signal()
+}
+
+// closeExpiredConns closes the idle connections unused for longer than the
+// idle timeout, the oldest ones are at the front. It must be called with
+// the mutex locked.
+func (t *TcpTransporter) closeExpiredConns(now time.Time) {
+	if t.idleTimeout <= 0 {
+		return
+	}
+	n := 0
+	for n < len(t.idle) && now.Sub(t.idle[n].lastUsed) > t.idleTimeout {
+		t.idle[n].Close()
+		t.count--
+		n++
+	}
+	t.idle = t.idle[n:]
+}
+
+// expireIdleConns is called by the idle timer, so the idle connections are
+// closed even if the client isn't used any more. The timer is restarted
+// for the oldest remaining idle connection.
+func (t *TcpTransporter) expireIdleConns() {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	now := time.Now()
+	t.closeExpiredConns(now)
+	t.idleTimer = nil
+	if len(t.idle) > 0 && t.idleTimeout > 0 {
+		d := t.idleTimeout - now.Sub(t.idle[0].lastUsed) + time.Millisecond
+		t.idleTimer = time.AfterFunc(d, t.expireIdleConns)
+	}
+}
+
+// checkConn reports whether an idle connection can be used again. A healthy
+// idle connection has nothing to read, the socket is read without blocking
+// when it is possible, otherwise it is read with a short deadline which
+// must expire.
+func (t *TcpTransporter) checkConn(conn *tcpConn) bool {
+	t.mutex.Lock()
+	idleTimeout := t.idleTimeout
+	t.mutex.Unlock()
+	if idleTimeout > 0 && time.Since(conn.lastUsed) > idleTimeout {
+		return false
+	}
+	if conn.istream.Buffered() > 0 {
+		return false
+	}
+	if alive, checked := peekIdleConn(conn.Conn); checked {
+		return alive
+	}
+	// an expired deadline fails the read before the socket is read
+	if err := conn.SetReadDeadline(time.Now().Add(time.Millisecond)); err != nil {
+		return false
+	}
+	if _, err := conn.istream.Peek(1); err != nil {
+		if e, ok := err.(net.Error); !ok || !e.Timeout() {
+			return false
+		}
+	} else {
+		return false
+	}
+	return conn.SetReadDeadline(t.readDeadlineTime()) == nil
+}
+
+func (t *TcpTransporter) getDuplexConn(ctx context.Context, uri string) (*tcpDuplexConn, error) {
+	t.dialMutex.Lock()
+	defer t.dialMutex.Unlock()
+	t.mutex.Lock()
+	t.changeUri(uri)
+	dc, legacy := t.duplex, t.legacy
+	t.mutex.Unlock()
+	if legacy {
+		return nil, nil
+	}
+	if dc != nil && dc.alive() {
+		return dc, nil
+	}
+	conn, err := t.dial(ctx, uri)
+	if err != nil {
+		return nil, err
+	}
+	if legacy, err = t.handshake(ctx, conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if conn.uri != t.uri {
+		conn.Close()
+		return nil, errors.New("The uri of the client has been changed.")
+	}
+	if legacy {
+		// the connection is still usable for the old protocol
+		t.legacy = true
+		if t.maxPoolSize <= 0 || t.count < t.maxPoolSize {
+			t.count++
+			conn.lastUsed = time.Now()
+			t.idle = append(t.idle, conn)
+			t.signal()
+		} else {
+			conn.Close()
+		}
+		return nil, nil
+	}
+	dc = &tcpDuplexConn{tcpConn: conn, writing: make(chan struct{}, 1)}
+	t.duplex = dc
+	go dc.receive(t.Limits.MaxMessageSize)
+	return dc, nil
+}
+
+// handshake asks the server to use the full duplex mode. An old server
+// answers it with an error message, then legacy is true.
+func (t *TcpTransporter) handshake(ctx context.Context, conn *tcpConn) (legacy bool, err error) {
+	stop := context.AfterFunc(ctx, func() {
+		conn.SetDeadline(aLongTimeAgo)
+	})
+	defer func() {
+		if !stop() && err == nil {
+			err = ctx.Err()
+		}
+	}()
+	if _, err = conn.Write([]byte{tcpHandshake}); err != nil {
+		return false, err
+	}
+	var tag byte
+	if tag, err = conn.istream.ReadByte(); err != nil {
+		return false, err
+	}
+	switch tag {
+	case tcpHandshake:
+		return false, nil
+	case TagError:
+		reader := NewReader(conn.istream)
+		if _, err = reader.ReadString(); err == nil {
+			err = reader.CheckTag(TagEnd)
+		}
+		return err == nil, err
+	}
+	return false, errors.New("Wrong Response: \r\n" + string([]byte{tag}))
+}
+
+func (t *TcpTransporter) changeUri(uri string) {
+	if t.uri != uri {
+		t.uri = uri
+		t.legacy = false
+		t.closeIdleConns()
+		t.closeDuplexConn()
+	}
+}
+
+func (t *TcpTransporter) closeDuplexConn() {
+	if t.duplex != nil {
+		t.duplex.Close()
+		t.duplex = nil
+	}
+}
+
+func (t *TcpTransporter) closeIdleConns() {
+	for _, conn := range t.idle {
+		conn.Close()
+		t.count--
+	}
+	t.idle = nil
+}
+
+func (t *TcpTransporter) signal() {
+	select {
+	case t.notify <- struct{}{}:
+	default:
+	}
+}
+
+func (t *TcpTransporter) dial(ctx context.Context, uri string) (*tcpConn, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return nil, err
+	}
+	address := u.Host
+	if u.Scheme == "unix" {
+		address = unixPath(u)
+	}
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, u.Scheme, address)
+	if err != nil {
+		return nil, err
+	}
+	if err = t.setOptions(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if t.config != nil {
+		config := t.config
+		if config.ServerName == "" && !config.InsecureSkipVerify && u.Scheme != "unix" {
+			config = config.Clone()
+			config.ServerName = u.Hostname()
+		}
+		conn = tls.Client(conn, config)
+	}
+	c := &tcpConn{Conn: conn, uri: uri, istream: bufio.NewReader(conn)}
+	if t.Framed() && !t.FullDuplex() {
+		var legacy bool
+		if legacy, err = t.handshake(ctx, c); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		c.framed = !legacy
+	}
+	return c, nil
+}
+
+// write sends a request frame on the shared connection. The frames are
+// written one by one, a caller waiting for a stalled write gives up when
+// ctx is done. The write is aborted when ctx is done, and then ctx.Err() is
+// returned, or when deadline is exceeded. A frame which is not written
+// completely breaks the stream, so the connection is closed on a write
+// error.
+func (dc *tcpDuplexConn) write(ctx context.Context, data []byte, id uint32, deadline time.Time) (err error) {
+	select {
+	case dc.writing <- struct{}{}:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	defer func() {
+		<-dc.writing
+	}()
+	if err = dc.SetWriteDeadline(deadline); err != nil {
+		return err
+	}
+	aborted := make(chan struct{})
+	stop := context.AfterFunc(ctx, func() {
+		dc.SetWriteDeadline(aLongTimeAgo)
+		close(aborted)
+	})
+	err = writeTcpFrame(dc, data, id, true)
+	if !stop() {
+		// wait for the deadline to be set, so it can't abort the next write
+		<-aborted
+		if err != nil {
+			err = ctx.Err()
+		}
+	}
+	if err != nil {
+		dc.fail(err)
+		dc.Close()
+	}
+	return err
+}
+
+// receive dispatches the responses to the invokings by the request id until
+// the connection is broken, then all waiting invokings get the error.
+func (dc *tcpDuplexConn) receive(maxSize int) {
+	for {
+		data, id, duplex, err := readTcpFrame(dc.istream, maxSize)
+		if err == nil && !duplex {
+			err = errors.New("Wrong Response: the frame has no request id.")
+		}
+		if err == ErrMessageTooLarge && duplex {
+			dc.dispatch(id, duplexResponse{err: err})
+			continue
+		}
+		if err != nil {
+			dc.fail(err)
+			dc.Close()
+			return
+		}
+		dc.dispatch(id, duplexResponse{data: data})
+	}
+}
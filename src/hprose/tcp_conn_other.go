@@ -0,0 +1,28 @@
+//go:build !unix
+
+/**********************************************************\
+|                                                          |
+|                          hprose                          |
+|                                                          |
+| Official WebSite: http://www.hprose.com/                 |
+|                   http://www.hprose.net/                 |
+|                   http://www.hprose.org/                 |
+|                                                          |
+\**********************************************************/
+/**********************************************************\
+ *                                                        *
+ * hprose/tcp_conn_other.go                               *
+ *                                                        *
+ * hprose tcp connection check for Go.                    *
+ *                                                        *
+\**********************************************************/
+
+package hprose
+
+import "net"
+
+// peekIdleConn can't read from the socket without blocking on this
+// platform, the read with a short deadline is used instead.
+func peekIdleConn(conn net.Conn) (alive bool, checked bool) {
+	return false, false
+}
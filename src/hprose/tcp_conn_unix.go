@@ -0,0 +1,55 @@
+//go:build unix
+
+/**********************************************************\
+|                                                          |
+|                          hprose                          |
+|                                                          |
+| Official WebSite: http://www.hprose.com/                 |
+|                   http://www.hprose.net/                 |
+|                   http://www.hprose.org/                 |
+|                                                          |
+\**********************************************************/
+/**********************************************************\
+ *                                                        *
+ * hprose/tcp_conn_unix.go                                *
+ *                                                        *
+ * hprose tcp connection check for Go.                    *
+ *                                                        *
+\**********************************************************/
+
+package hprose
+
+import (
+	"net"
+	"syscall"
+)
+
+// peekIdleConn reads from the socket of an idle connection without
+// blocking. A healthy idle connection has nothing to read, so the read
+// fails with EAGAIN. Any byte, EOF or error means the connection can't be
+// used again, so the byte consumed by the read doesn't matter. checked is
+// false when the socket can't be accessed.
+func peekIdleConn(conn net.Conn) (alive bool, checked bool) {
+	if c, ok := conn.(interface{ NetConn() net.Conn }); ok {
+		conn = c.NetConn()
+	}
+	sc, ok := conn.(syscall.Conn)
+	if !ok {
+		return false, false
+	}
+	raw, err := sc.SyscallConn()
+	if err != nil {
+		return false, true
+	}
+	var n int
+	var e error
+	err = raw.Read(func(fd uintptr) bool {
+		var buf [1]byte
+		n, e = syscall.Read(int(fd), buf[:])
+		return true
+	})
+	if err != nil {
+		return false, true
+	}
+	return n < 0 && (e == syscall.EAGAIN || e == syscall.EWOULDBLOCK), true
+}
@@ -0,0 +1,90 @@
+/**********************************************************\
+|                                                          |
+|                          hprose                          |
+|                                                          |
+| Official WebSite: http://www.hprose.com/                 |
+|                   http://www.hprose.net/                 |
+|                   http://www.hprose.org/                 |
+|                                                          |
+\**********************************************************/
+/**********************************************************\
+ *                                                        *
+ * hprose/tcp_frame.go                                    *
+ *                                                        *
+ * hprose tcp frame for Go.                               *
+ *                                                        *
+\**********************************************************/
+
+package hprose
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// The client sends tcpHandshake before the first framed message on a
+// connection. A server which supports framed messages answers it with the
+// same byte, an old server answers it with an error message.
+const tcpHandshake byte = '!'
+
+// The header of a frame is the 4 bytes big endian length of the message. The
+// header of a full duplex frame has this bit set and is followed by the 4
+// bytes request id.
+const tcpDuplexFlag = 0x80000000
+
+// ErrMessageTooLarge is returned when the length of a frame exceeds the
+// maximum message size. The frame is skipped, so the connection is still in
+// sync with the frames.
+var ErrMessageTooLarge = errors.New("The message is too large.")
+
+// readTcpFrame reads a frame, the message is never allocated when its length
+// exceeds maxSize. Zero maxSize means no limit.
+func readTcpFrame(istream *bufio.Reader, maxSize int) (data []byte, id uint32, duplex bool, err error) {
+	var header [8]byte
+	if _, err = io.ReadFull(istream, header[:4]); err != nil {
+		return nil, 0, false, err
+	}
+	length := binary.BigEndian.Uint32(header[:4])
+	if duplex = length&tcpDuplexFlag != 0; duplex {
+		length &^= tcpDuplexFlag
+		if _, err = io.ReadFull(istream, header[4:]); err != nil {
+			return nil, 0, duplex, err
+		}
+		id = binary.BigEndian.Uint32(header[4:])
+	}
+	if maxSize > 0 && int64(length) > int64(maxSize) {
+		if _, err = istream.Discard(int(length)); err == nil {
+			err = ErrMessageTooLarge
+		}
+		return nil, id, duplex, err
+	}
+	data = make([]byte, length)
+	if _, err = io.ReadFull(istream, data); err != nil {
+		return nil, id, duplex, err
+	}
+	return data, id, duplex, nil
+}
+
+// writeTcpFrame writes the frame with one Write call, so the frames written
+// by different goroutines never interleave.
+func writeTcpFrame(ostream io.Writer, data []byte, id uint32, duplex bool) error {
+	if int64(len(data)) >= tcpDuplexFlag {
+		return ErrMessageTooLarge
+	}
+	n := 4
+	if duplex {
+		n = 8
+	}
+	buf := make([]byte, n+len(data))
+	if duplex {
+		binary.BigEndian.PutUint32(buf, uint32(len(data))|tcpDuplexFlag)
+		binary.BigEndian.PutUint32(buf[4:], id)
+	} else {
+		binary.BigEndian.PutUint32(buf, uint32(len(data)))
+	}
+	copy(buf[n:], data)
+	_, err := ostream.Write(buf)
+	return err
+}
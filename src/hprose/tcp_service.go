@@ -22,49 +22,413 @@ package hprose
 
 import (
 	"bufio"
+	"bytes"
+	"context"
 	"crypto/tls"
+	"crypto/x509"
+	"errors"
 	"net"
 	"net/url"
+	"sync"
 	"time"
 )
 
+type TcpServiceEvent interface {
+	ServiceEvent
+	// OnAccept is called when a connection is accepted and the TLS handshake
+	// is done, the connection is closed when it returns an error.
+	OnAccept(context *ServiceContext) error
+}
+
 type TcpService struct {
 	*BaseService
+	// MaxConcurrentRequests is the maximum number of the full duplex
+	// requests handled at the same time on one connection, the next frame
+	// isn't read until one of them is done. Zero means no limit.
+	MaxConcurrentRequests int
+	mutex                 sync.Mutex
+	conns                 map[*tcpServiceConn]struct{}
+	closed                bool
 }
 
+// tcpServiceConn is a connection served by the TcpService, active is the
+// number of the requests being read or handled on it. The connection is
+// idle when active is zero, then its read can be interrupted by shutdown.
+type tcpServiceConn struct {
+	net.Conn
+	active      int
+	interrupted bool
+}
+
+// ErrServerClosed is returned by the Start method of the servers after the
+// server is shut down or closed.
+var ErrServerClosed = errors.New("The server has been closed.")
+
+// DefaultMaxConcurrentRequests is the MaxConcurrentRequests of the services
+// created by NewTcpService and NewWebSocketService.
+const DefaultMaxConcurrentRequests = 64
+
 func NewTcpService() *TcpService {
-	return &TcpService{NewBaseService()}
+	return &TcpService{
+		BaseService:           NewBaseService(),
+		MaxConcurrentRequests: DefaultMaxConcurrentRequests,
+		conns:                 make(map[*tcpServiceConn]struct{}),
+	}
 }
 
 func (service *TcpService) ServeTCP(conn net.Conn) {
-	istream := bufio.NewReader(conn)
-	ostream := conn
 	go func() {
-		for {
-			service.Handle(istream, ostream)
-			if service.IOError != nil {
-				service.IOError = nil
-				conn.Close()
-				break
+		c := service.trackConn(conn)
+		if c == nil {
+			conn.Close()
+			return
+		}
+		defer service.untrackConn(c)
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		if tlsConn, ok := conn.(*tls.Conn); ok {
+			if err := tlsConn.HandshakeContext(ctx); err != nil {
+				return
+			}
+		}
+		serviceContext := &ServiceContext{Context: ctx, Conn: conn}
+		if event, ok := service.ServiceEvent.(TcpServiceEvent); ok {
+			if err := event.OnAccept(serviceContext); err != nil {
+				return
+			}
+		}
+		istream := bufio.NewReader(conn)
+		for service.beginRequest(c, istream) {
+			if tag, _ := istream.Peek(1); tag[0] == tcpHandshake {
+				istream.ReadByte()
+				_, err := conn.Write([]byte{tcpHandshake})
+				service.endRequest(c)
+				if err == nil {
+					service.serveFramed(c, istream, serviceContext)
+				}
+				return
+			}
+			err := service.handle(&serviceSession{
+				istream: istream,
+				ostream: conn,
+				context: serviceContext,
+			})
+			service.endRequest(c)
+			if err != nil {
+				return
 			}
 		}
 	}()
 }
 
+// serveFramed handles the frames after the handshake. A request in a half
+// duplex frame is handled before the next frame is read. A request in a full
+// duplex frame is handled in its own goroutine and its response is sent back
+// with the same request id as soon as it is ready, at most
+// MaxConcurrentRequests of them are handled at the same time.
+func (service *TcpService) serveFramed(conn *tcpServiceConn, istream *bufio.Reader, context *ServiceContext) {
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	var sem chan struct{}
+	if service.MaxConcurrentRequests > 0 {
+		sem = make(chan struct{}, service.MaxConcurrentRequests)
+	}
+	for service.beginRequest(conn, istream) {
+		data, id, duplex, err := readTcpFrame(istream, service.Limits.MaxMessageSize)
+		if err == nil && len(data) == 0 {
+			err = errors.New("Empty Request")
+		} else if err != nil && err != ErrMessageTooLarge {
+			service.endRequest(conn)
+			return
+		}
+		if err != nil {
+			buf := new(bytes.Buffer)
+			service.sendError(&serviceSession{ostream: buf}, err)
+			err = writeTcpFrame(conn, buf.Bytes(), id, duplex)
+			service.endRequest(conn)
+			if err != nil {
+				return
+			}
+			continue
+		}
+		if !duplex {
+			err = service.handleFrame(conn, data, id, duplex, context)
+			service.endRequest(conn)
+			if err != nil {
+				return
+			}
+			continue
+		}
+		if sem != nil {
+			sem <- struct{}{}
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			service.handleFrame(conn, data, id, duplex, context)
+			service.endRequest(conn)
+			if sem != nil {
+				<-sem
+			}
+		}()
+	}
+}
+
+func (service *TcpService) handleFrame(conn *tcpServiceConn, data []byte, id uint32, duplex bool, context *ServiceContext) error {
+	buf := new(bytes.Buffer)
+	service.handle(&serviceSession{istream: NewBufReader(data), ostream: buf, context: context})
+	return writeTcpFrame(conn, buf.Bytes(), id, duplex)
+}
+
+func (service *TcpService) trackConn(conn net.Conn) *tcpServiceConn {
+	service.mutex.Lock()
+	defer service.mutex.Unlock()
+	if service.closed {
+		return nil
+	}
+	if service.conns == nil {
+		service.conns = make(map[*tcpServiceConn]struct{})
+	}
+	c := &tcpServiceConn{Conn: conn}
+	service.conns[c] = struct{}{}
+	return c
+}
+
+func (service *TcpService) untrackConn(c *tcpServiceConn) {
+	service.mutex.Lock()
+	delete(service.conns, c)
+	service.mutex.Unlock()
+	c.Close()
+}
+
+// beginRequest waits for the first byte of the next request, and marks the
+// connection active as soon as it arrives. It returns false when the
+// connection is broken or the wait is interrupted by shutdown. A request
+// whose bytes arrived before the interruption is still served, the read
+// deadline set by the interruption is cleared for it.
+func (service *TcpService) beginRequest(c *tcpServiceConn, istream *bufio.Reader) bool {
+	if _, err := istream.Peek(1); err != nil {
+		return false
+	}
+	service.mutex.Lock()
+	c.active++
+	interrupted := c.interrupted
+	c.interrupted = false
+	service.mutex.Unlock()
+	if interrupted {
+		c.SetReadDeadline(time.Time{})
+	}
+	return true
+}
+
+// endRequest interrupts the read of the next request when the service is
+// shutting down and no request is being handled on the connection.
+func (service *TcpService) endRequest(c *tcpServiceConn) {
+	service.mutex.Lock()
+	c.active--
+	if service.closed && c.active == 0 {
+		c.interrupt()
+	}
+	service.mutex.Unlock()
+}
+
+// interrupt aborts the blocked read of an idle connection, so the goroutine
+// serving it closes it. It must be called with the mutex of the service
+// locked.
+func (c *tcpServiceConn) interrupt() {
+	c.interrupted = true
+	c.SetReadDeadline(aLongTimeAgo)
+}
+
+func (service *TcpService) isClosed() bool {
+	service.mutex.Lock()
+	defer service.mutex.Unlock()
+	return service.closed
+}
+
+// shutdown makes the service refuse the new connections.
+func (service *TcpService) shutdown() {
+	service.mutex.Lock()
+	service.closed = true
+	service.mutex.Unlock()
+}
+
+// closeIdleConns interrupts the connections without the requests being
+// read or handled on them, they are closed by their serving goroutines. It
+// returns the number of the connections not closed yet.
+func (service *TcpService) closeIdleConns() int {
+	service.mutex.Lock()
+	defer service.mutex.Unlock()
+	for c := range service.conns {
+		if c.active == 0 {
+			c.interrupt()
+		}
+	}
+	return len(service.conns)
+}
+
+func (service *TcpService) closeConns() {
+	service.mutex.Lock()
+	defer service.mutex.Unlock()
+	for c := range service.conns {
+		c.Close()
+	}
+}
+
+// waitConns closes the idle connections until all connections are closed or
+// ctx is done.
+func (service *TcpService) waitConns(ctx context.Context) error {
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+	for service.closeIdleConns() > 0 {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+	return nil
+}
+
+// socketServerOptions holds the connection options and the TLS settings
+// shared by TcpServer and UnixServer.
+type socketServerOptions struct {
+	deadline       interface{}
+	readBuffer     interface{}
+	readDeadline   interface{}
+	writerBuffer   interface{}
+	writerDeadline interface{}
+	config         *tls.Config
+	clientAuth     tls.ClientAuthType
+	clientCAs      *x509.CertPool
+}
+
+// socketConn is implemented by *net.TCPConn and *net.UnixConn.
+type socketConn interface {
+	net.Conn
+	SetReadBuffer(bytes int) error
+	SetWriteBuffer(bytes int) error
+}
+
+func (options *socketServerOptions) SetReadBuffer(bytes int) {
+	options.readBuffer = bytes
+}
+
+func (options *socketServerOptions) SetReadDeadline(t time.Time) {
+	options.readDeadline = t
+}
+
+func (options *socketServerOptions) SetWriteBuffer(bytes int) {
+	options.writerBuffer = bytes
+}
+
+func (options *socketServerOptions) SetWriteDeadline(t time.Time) {
+	options.writerDeadline = t
+}
+
+func (options *socketServerOptions) SetTLSConfig(config *tls.Config) {
+	options.config = config
+}
+
+// SetClientAuth sets the policy and the certificate authorities to verify
+// the client certificates, it overrides the ClientAuth and ClientCAs of the
+// TLS config. The verified certificate chains of the client can be got from
+// ServiceContext.ConnectionState.
+func (options *socketServerOptions) SetClientAuth(clientAuth tls.ClientAuthType, clientCAs *x509.CertPool) {
+	options.clientAuth = clientAuth
+	options.clientCAs = clientCAs
+}
+
+func (options *socketServerOptions) tlsConfig() *tls.Config {
+	if options.config == nil || (options.clientAuth == tls.NoClientCert && options.clientCAs == nil) {
+		return options.config
+	}
+	config := options.config.Clone()
+	config.ClientAuth = options.clientAuth
+	config.ClientCAs = options.clientCAs
+	return config
+}
+
+func (options *socketServerOptions) setConnOptions(conn socketConn) error {
+	if options.readBuffer != nil {
+		if err := conn.SetReadBuffer(options.readBuffer.(int)); err != nil {
+			return err
+		}
+	}
+	if options.writerBuffer != nil {
+		if err := conn.SetWriteBuffer(options.writerBuffer.(int)); err != nil {
+			return err
+		}
+	}
+	if options.deadline != nil {
+		if err := conn.SetDeadline(options.deadline.(time.Time)); err != nil {
+			return err
+		}
+	}
+	if options.readDeadline != nil {
+		if err := conn.SetReadDeadline(options.readDeadline.(time.Time)); err != nil {
+			return err
+		}
+	}
+	if options.writerDeadline != nil {
+		if err := conn.SetWriteDeadline(options.writerDeadline.(time.Time)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// serve accepts the connections on listener until it is closed, setup is
+// called on every accepted connection before it is served.
+func (service *TcpService) serve(listener net.Listener, config *tls.Config, setup func(conn net.Conn) error) error {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if service.isClosed() {
+				return ErrServerClosed
+			}
+			return err
+		}
+		if err = setup(conn); err != nil {
+			return err
+		}
+		if config != nil {
+			service.ServeTCP(tls.Server(conn, config))
+		} else {
+			service.ServeTCP(conn)
+		}
+	}
+}
+
+// shutdownListener stops accepting the new connections on listener, and
+// closes every connection when the requests being handled on it are done.
+func (service *TcpService) shutdownListener(ctx context.Context, listener net.Listener) error {
+	service.shutdown()
+	err := listener.Close()
+	if e := service.waitConns(ctx); e != nil {
+		return e
+	}
+	return err
+}
+
+// closeListener stops accepting the new connections on listener and closes
+// all connections immediately.
+func (service *TcpService) closeListener(listener net.Listener) error {
+	service.shutdown()
+	err := listener.Close()
+	service.closeConns()
+	return err
+}
+
 type TcpServer struct {
 	*TcpService
 	URL string
 	*net.TCPListener
-	deadline        interface{}
+	socketServerOptions
 	keepAlive       interface{}
 	keepAlivePeriod interface{}
 	linger          interface{}
 	noDelay         interface{}
-	readBuffer      interface{}
-	readDeadline    interface{}
-	writerBuffer    interface{}
-	writerDeadline  interface{}
-	config          *tls.Config
 }
 
 func NewTcpServer(uri string) *TcpServer {
@@ -111,81 +475,44 @@ func (server *TcpServer) SetNoDelay(noDelay bool) {
 	server.noDelay = noDelay
 }
 
-func (server *TcpServer) SetReadBuffer(bytes int) {
-	server.readBuffer = bytes
-}
-
-func (server *TcpServer) SetReadDeadline(t time.Time) {
-	server.readDeadline = t
+// Shutdown stops accepting the new connections, and closes every connection
+// when the requests being handled on it are done. It returns when all
+// connections are closed or ctx is done.
+func (server *TcpServer) Shutdown(ctx context.Context) error {
+	return server.shutdownListener(ctx, server.TCPListener)
 }
 
-func (server *TcpServer) SetWriteBuffer(bytes int) {
-	server.writerBuffer = bytes
+// Close stops accepting the new connections and closes all connections
+// immediately.
+func (server *TcpServer) Close() error {
+	return server.closeListener(server.TCPListener)
 }
 
-func (server *TcpServer) SetWriteDeadline(t time.Time) {
-	server.writerDeadline = t
+func (server *TcpServer) Start() error {
+	return server.serve(server.TCPListener, server.tlsConfig(), server.setup)
 }
 
-func (server *TcpServer) SetTLSConfig(config *tls.Config) {
-	server.config = config
-}
-
-func (server *TcpServer) Start() (err error) {
-	for {
-		var conn *net.TCPConn
-		if conn, err = server.TCPListener.AcceptTCP(); err != nil {
+func (server *TcpServer) setup(c net.Conn) error {
+	conn := c.(*net.TCPConn)
+	if server.keepAlive != nil {
+		if err := conn.SetKeepAlive(server.keepAlive.(bool)); err != nil {
 			return err
 		}
-		if server.keepAlive != nil {
-			if err := conn.SetKeepAlive(server.keepAlive.(bool)); err != nil {
-				return err
-			}
-		}
-		if server.keepAlivePeriod != nil {
-			if err := conn.SetKeepAlivePeriod(server.keepAlivePeriod.(time.Duration)); err != nil {
-				return err
-			}
-		}
-		if server.linger != nil {
-			if err := conn.SetLinger(server.linger.(int)); err != nil {
-				return err
-			}
-		}
-		if server.noDelay != nil {
-			if err := conn.SetNoDelay(server.noDelay.(bool)); err != nil {
-				return err
-			}
-		}
-		if server.readBuffer != nil {
-			if err := conn.SetReadBuffer(server.readBuffer.(int)); err != nil {
-				return err
-			}
-		}
-		if server.writerBuffer != nil {
-			if err := conn.SetWriteBuffer(server.writerBuffer.(int)); err != nil {
-				return err
-			}
-		}
-		if server.deadline != nil {
-			if err := conn.SetDeadline(server.deadline.(time.Time)); err != nil {
-				return err
-			}
-		}
-		if server.readDeadline != nil {
-			if err := conn.SetReadDeadline(server.readDeadline.(time.Time)); err != nil {
-				return err
-			}
+	}
+	if server.keepAlivePeriod != nil {
+		if err := conn.SetKeepAlivePeriod(server.keepAlivePeriod.(time.Duration)); err != nil {
+			return err
 		}
-		if server.writerDeadline != nil {
-			if err := conn.SetWriteDeadline(server.writerDeadline.(time.Time)); err != nil {
-				return err
-			}
+	}
+	if server.linger != nil {
+		if err := conn.SetLinger(server.linger.(int)); err != nil {
+			return err
 		}
-		if server.config != nil {
-			server.ServeTCP(tls.Client(conn, server.config))
-		} else {
-			server.ServeTCP(conn)
+	}
+	if server.noDelay != nil {
+		if err := conn.SetNoDelay(server.noDelay.(bool)); err != nil {
+			return err
 		}
 	}
+	return server.setConnOptions(conn)
 }
@@ -0,0 +1,78 @@
+/**********************************************************\
+|                                                          |
+|                          hprose                          |
+|                                                          |
+| Official WebSite: http://www.hprose.com/                 |
+|                   http://www.hprose.net/                 |
+|                   http://www.hprose.org/                 |
+|                                                          |
+\**********************************************************/
+/**********************************************************\
+ *                                                        *
+ * hprose/type_codec.go                                   *
+ *                                                        *
+ * hprose TypeCodec for Go.                               *
+ *                                                        *
+\**********************************************************/
+
+package hprose
+
+import (
+	"reflect"
+	"sync"
+)
+
+// EncodeFunc writes v, a value of the registered type, to writer.
+type EncodeFunc func(writer Writer, v reflect.Value) error
+
+// DecodeFunc reads one value from reader and stores it in v, a settable
+// value of the registered type.
+type DecodeFunc func(reader Reader, v reflect.Value) error
+
+type typeCodec struct {
+	encode EncodeFunc
+	decode DecodeFunc
+}
+
+var typeCodecs struct {
+	sync.RWMutex
+	cache map[reflect.Type]typeCodec
+}
+
+// RegisterTypeCodec registers the functions used to serialize and
+// unserialize the values of type t, typically a type from another package
+// which cannot implement HproseMarshaler and HproseUnmarshaler.
+//
+// The codec is consulted after the marshaler interfaces and before the
+// reflection based rules. Either function may be nil, and registering nil
+// for both removes the codec of t. The types serialized natively, such as
+// int, string or []byte, are not affected by the encode function.
+//
+// A pointer to t is decoded by allocating a new value and passing it to
+// decode, so decode should handle the null value itself.
+func RegisterTypeCodec(t reflect.Type, encode EncodeFunc, decode DecodeFunc) {
+	typeCodecs.Lock()
+	if encode == nil && decode == nil {
+		delete(typeCodecs.cache, t)
+	} else {
+		if typeCodecs.cache == nil {
+			typeCodecs.cache = make(map[reflect.Type]typeCodec)
+		}
+		typeCodecs.cache[t] = typeCodec{encode, decode}
+	}
+	typeCodecs.Unlock()
+}
+
+func getEncodeFunc(t reflect.Type) EncodeFunc {
+	typeCodecs.RLock()
+	codec := typeCodecs.cache[t]
+	typeCodecs.RUnlock()
+	return codec.encode
+}
+
+func getDecodeFunc(t reflect.Type) DecodeFunc {
+	typeCodecs.RLock()
+	codec := typeCodecs.cache[t]
+	typeCodecs.RUnlock()
+	return codec.decode
+}
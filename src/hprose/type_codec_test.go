@@ -0,0 +1,111 @@
+/**********************************************************\
+|                                                          |
+|                          hprose                          |
+|                                                          |
+| Official WebSite: http://www.hprose.com/                 |
+|                   http://www.hprose.net/                 |
+|                   http://www.hprose.org/                 |
+|                                                          |
+\**********************************************************/
+/**********************************************************\
+ *                                                        *
+ * hprose/type_codec_test.go                              *
+ *                                                        *
+ * hprose TypeCodec Test for Go.                          *
+ *                                                        *
+\**********************************************************/
+
+package hprose_test
+
+import (
+	"bytes"
+	. "hprose"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+type testServer struct {
+	Addr    net.IP
+	Timeout time.Duration
+}
+
+func registerTestCodecs() {
+	RegisterTypeCodec(reflect.TypeOf(net.IP(nil)),
+		func(writer Writer, v reflect.Value) error {
+			return writer.WriteString(v.Interface().(net.IP).String())
+		},
+		func(reader Reader, v reflect.Value) error {
+			s, err := reader.ReadString()
+			if err == nil {
+				v.Set(reflect.ValueOf(net.ParseIP(s)))
+			}
+			return err
+		})
+	RegisterTypeCodec(reflect.TypeOf(time.Duration(0)),
+		func(writer Writer, v reflect.Value) error {
+			return writer.WriteString(v.Interface().(time.Duration).String())
+		},
+		func(reader Reader, v reflect.Value) error {
+			s, err := reader.ReadString()
+			if err == nil {
+				var d time.Duration
+				if d, err = time.ParseDuration(s); err == nil {
+					v.SetInt(int64(d))
+				}
+			}
+			return err
+		})
+}
+
+func unregisterTestCodecs() {
+	RegisterTypeCodec(reflect.TypeOf(net.IP(nil)), nil, nil)
+	RegisterTypeCodec(reflect.TypeOf(time.Duration(0)), nil, nil)
+}
+
+func TestTypeCodec(t *testing.T) {
+	registerTestCodecs()
+	defer unregisterTestCodecs()
+	b := new(bytes.Buffer)
+	writer := NewWriter(b)
+	server := testServer{net.ParseIP("10.0.0.1"), 3 * time.Second}
+	if err := writer.Serialize(&server); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := writer.Serialize(server.Timeout); err != nil {
+		t.Fatal(err.Error())
+	}
+	s := `c10"testServer"2{s4"addr"s7"timeout"}o0{s8"10.0.0.1"s2"3s"}s2"3s"`
+	if b.String() != s {
+		t.Error(b.String())
+	}
+	reader := NewReader(NewBufReader(b.Bytes()))
+	var server2 *testServer
+	if err := reader.Unserialize(&server2); err != nil {
+		t.Fatal(err.Error())
+	}
+	if !server2.Addr.Equal(server.Addr) || server2.Timeout != server.Timeout {
+		t.Error(server2)
+	}
+	var timeout *time.Duration
+	if err := reader.Unserialize(&timeout); err != nil {
+		t.Fatal(err.Error())
+	}
+	if timeout == nil || *timeout != 3*time.Second {
+		t.Error(timeout)
+	}
+}
+
+func TestTypeCodecUnregister(t *testing.T) {
+	registerTestCodecs()
+	unregisterTestCodecs()
+	b := new(bytes.Buffer)
+	writer := NewWriter(b)
+	if err := writer.Serialize(3 * time.Second); err != nil {
+		t.Fatal(err.Error())
+	}
+	if b.String() != "l3000000000;" {
+		t.Error(b.String())
+	}
+}
@@ -0,0 +1,53 @@
+/**********************************************************\
+|                                                          |
+|                          hprose                          |
+|                                                          |
+| Official WebSite: http://www.hprose.com/                 |
+|                   http://www.hprose.net/                 |
+|                   http://www.hprose.org/                 |
+|                                                          |
+\**********************************************************/
+/**********************************************************\
+ *                                                        *
+ * hprose/unix_client.go                                  *
+ *                                                        *
+ * hprose unix client for Go.                             *
+ *                                                        *
+\**********************************************************/
+
+package hprose
+
+import (
+	"net/url"
+)
+
+// UnixClient is a TcpClient on the unix domain socket, the uri looks like
+// unix:/var/run/hprose.sock. The keep alive, linger and no delay options
+// are ignored.
+type UnixClient struct {
+	*TcpClient
+}
+
+func NewUnixClient(uri string) Client {
+	client := &UnixClient{newTcpClient()}
+	client.SetUri(uri)
+	return client
+}
+
+func (client *UnixClient) SetUri(uri string) {
+	if u, err := url.Parse(uri); err == nil {
+		if u.Scheme != "unix" {
+			panic("This client desn't support " + u.Scheme + " scheme.")
+		}
+	}
+	client.BaseClient.SetUri(uri)
+}
+
+// unixPath returns the socket path of the uri, unix:/path, unix:///path,
+// unix:relative/path and unix://relative/path are supported.
+func unixPath(u *url.URL) string {
+	if u.Opaque != "" {
+		return u.Opaque
+	}
+	return u.Host + u.Path
+}
@@ -0,0 +1,148 @@
+/**********************************************************\
+|                                                          |
+|                          hprose                          |
+|                                                          |
+| Official WebSite: http://www.hprose.com/                 |
+|                   http://www.hprose.net/                 |
+|                   http://www.hprose.org/                 |
+|                                                          |
+\**********************************************************/
+/**********************************************************\
+ *                                                        *
+ * hprose/unix_service.go                                 *
+ *                                                        *
+ * hprose unix service for Go.                            *
+ *                                                        *
+\**********************************************************/
+
+package hprose
+
+import (
+	"context"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// UnixServer is a TcpService on the unix domain socket. The socket file is
+// removed when the server is closed.
+type UnixServer struct {
+	*TcpService
+	URL string
+	*net.UnixListener
+	socketServerOptions
+	addr *net.UnixAddr
+}
+
+func NewUnixServer(uri string) *UnixServer {
+	return newUnixServer(uri, nil)
+}
+
+// NewUnixServerWithMode is like NewUnixServer, but the permissions of the
+// socket file are set to mode before any peer can connect to it.
+func NewUnixServerWithMode(uri string, mode os.FileMode) *UnixServer {
+	return newUnixServer(uri, &mode)
+}
+
+func newUnixServer(uri string, mode *os.FileMode) *UnixServer {
+	var u *url.URL
+	var err error
+	if u, err = url.Parse(uri); err != nil {
+		panic(err.Error())
+	}
+	if u.Scheme != "unix" {
+		panic("This server desn't support " + u.Scheme + " scheme.")
+	}
+	var addr *net.UnixAddr
+	if addr, err = net.ResolveUnixAddr(u.Scheme, unixPath(u)); err != nil {
+		panic(err.Error())
+	}
+	var listener *net.UnixListener
+	if mode == nil {
+		listener, err = net.ListenUnix(u.Scheme, addr)
+	} else {
+		listener, err = listenUnixWithMode(addr, *mode)
+	}
+	if err != nil {
+		panic(err.Error())
+	}
+	return &UnixServer{
+		TcpService:   NewTcpService(),
+		URL:          u.Scheme + ":" + addr.Name,
+		UnixListener: listener,
+		addr:         addr,
+	}
+}
+
+// listenUnixWithMode creates the socket in a new directory which only the
+// owner can access, changes its mode, and then moves it to addr. The socket
+// file isn't removed by the listener, because it has been moved.
+func listenUnixWithMode(addr *net.UnixAddr, mode os.FileMode) (*net.UnixListener, error) {
+	dir, err := os.MkdirTemp(filepath.Dir(addr.Name), ".hprose-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "s")
+	listener, err := net.ListenUnix(addr.Net, &net.UnixAddr{Name: path, Net: addr.Net})
+	if err != nil {
+		return nil, err
+	}
+	listener.SetUnlinkOnClose(false)
+	if err = os.Chmod(path, mode); err == nil {
+		err = os.Rename(path, addr.Name)
+	}
+	if err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return listener, nil
+}
+
+// Addr returns the address of the socket file.
+func (server *UnixServer) Addr() net.Addr {
+	return server.addr
+}
+
+// SetFileMode changes the permissions of the socket file. The socket has
+// been listening since the server was created, so a peer may connect to it
+// before its permissions are changed. Use NewUnixServerWithMode to create
+// the socket with the permissions instead.
+func (server *UnixServer) SetFileMode(mode os.FileMode) error {
+	return os.Chmod(server.addr.Name, mode)
+}
+
+func (server *UnixServer) SetDeadline(t time.Time) {
+	server.deadline = t
+}
+
+// Shutdown stops accepting the new connections, and closes every connection
+// when the requests being handled on it are done. It returns when all
+// connections are closed or ctx is done.
+func (server *UnixServer) Shutdown(ctx context.Context) error {
+	defer server.removeSocket()
+	return server.shutdownListener(ctx, server.UnixListener)
+}
+
+// Close stops accepting the new connections and closes all connections
+// immediately.
+func (server *UnixServer) Close() error {
+	defer server.removeSocket()
+	return server.closeListener(server.UnixListener)
+}
+
+// removeSocket removes the socket file which was moved by
+// NewUnixServerWithMode, the other socket files are removed by the listener.
+func (server *UnixServer) removeSocket() {
+	if server.UnixListener.Addr().String() != server.addr.Name {
+		os.Remove(server.addr.Name)
+	}
+}
+
+func (server *UnixServer) Start() error {
+	return server.serve(server.UnixListener, server.tlsConfig(), func(conn net.Conn) error {
+		return server.setConnOptions(conn.(*net.UnixConn))
+	})
+}
@@ -0,0 +1,421 @@
+/**********************************************************\
+|                                                          |
+|                          hprose                          |
+|                                                          |
+| Official WebSite: http://www.hprose.com/                 |
+|                   http://www.hprose.net/                 |
+|                   http://www.hprose.org/                 |
+|                                                          |
+\**********************************************************/
+/**********************************************************\
+ *                                                        *
+ * hprose/value.go                                        *
+ *                                                        *
+ * hprose Value tree for Go.                              *
+ *                                                        *
+\**********************************************************/
+
+package hprose
+
+import (
+	"errors"
+	"io"
+	"math/big"
+	"reflect"
+	"time"
+	"uuid"
+)
+
+// Value is a node of a hprose value tree. Unlike the values read into
+// interface{}, a tree keeps the class names, the order of the map entries
+// and the references, so it can be modified and written back without
+// losing anything.
+//
+// String, Bytes, Date, Guid, List, Map and Object nodes are used through
+// pointers, which are the targets of the Ref nodes. All the nodes implement
+// HproseMarshaler, so a tree can be serialized by any writer, alone or
+// inside other values.
+type Value interface {
+	Kind() TokenKind
+}
+
+type Null struct{}
+
+type Bool bool
+
+type Int int64
+
+type BigInt struct {
+	Value *big.Int
+}
+
+type Double float64
+
+type String struct {
+	Value string
+}
+
+type Bytes struct {
+	Value []byte
+}
+
+type Date struct {
+	Value time.Time
+}
+
+type Guid struct {
+	Value uuid.UUID
+}
+
+type List struct {
+	Items []Value
+}
+
+type Map struct {
+	Entries []MapEntry
+}
+
+type MapEntry struct {
+	Key   Value
+	Value Value
+}
+
+// Object is an object of a class. Its fields are written in order, and
+// their names define the class.
+type Object struct {
+	Class  string
+	Fields []ObjectField
+}
+
+type ObjectField struct {
+	Name  string
+	Value Value
+}
+
+// Ref is a reference to a String, Bytes, Date, Guid, List, Map or Object
+// node written before it.
+type Ref struct {
+	Target Value
+}
+
+var unwrittenRefError = errors.New("the target of the Ref is not written before it")
+
+func (Null) Kind() TokenKind    { return NullToken }
+func (Bool) Kind() TokenKind    { return BoolToken }
+func (Int) Kind() TokenKind     { return IntToken }
+func (BigInt) Kind() TokenKind  { return LongToken }
+func (Double) Kind() TokenKind  { return DoubleToken }
+func (*String) Kind() TokenKind { return StringToken }
+func (*Bytes) Kind() TokenKind  { return BytesToken }
+func (*Date) Kind() TokenKind   { return DateToken }
+func (*Guid) Kind() TokenKind   { return GuidToken }
+func (*List) Kind() TokenKind   { return ListToken }
+func (*Map) Kind() TokenKind    { return MapToken }
+func (*Object) Kind() TokenKind { return ObjectToken }
+func (Ref) Kind() TokenKind     { return RefToken }
+
+func (v Null) MarshalHprose(w Writer) error    { return marshalValue(w, v) }
+func (v Bool) MarshalHprose(w Writer) error    { return marshalValue(w, v) }
+func (v Int) MarshalHprose(w Writer) error     { return marshalValue(w, v) }
+func (v BigInt) MarshalHprose(w Writer) error  { return marshalValue(w, v) }
+func (v Double) MarshalHprose(w Writer) error  { return marshalValue(w, v) }
+func (v *String) MarshalHprose(w Writer) error { return marshalValue(w, v) }
+func (v *Bytes) MarshalHprose(w Writer) error  { return marshalValue(w, v) }
+func (v *Date) MarshalHprose(w Writer) error   { return marshalValue(w, v) }
+func (v *Guid) MarshalHprose(w Writer) error   { return marshalValue(w, v) }
+func (v *List) MarshalHprose(w Writer) error   { return marshalValue(w, v) }
+func (v *Map) MarshalHprose(w Writer) error    { return marshalValue(w, v) }
+func (v *Object) MarshalHprose(w Writer) error { return marshalValue(w, v) }
+func (v Ref) MarshalHprose(w Writer) error     { return marshalValue(w, v) }
+
+// Walk calls fn for v and, while fn returns true, for the items of a List,
+// the keys and values of a Map and the field values of an Object. The
+// target of a Ref is not walked again.
+func Walk(v Value, fn func(Value) bool) {
+	if !fn(v) {
+		return
+	}
+	switch v := v.(type) {
+	case *List:
+		for _, item := range v.Items {
+			Walk(item, fn)
+		}
+	case *Map:
+		for _, entry := range v.Entries {
+			Walk(entry.Key, fn)
+			Walk(entry.Value, fn)
+		}
+	case *Object:
+		for _, field := range v.Fields {
+			Walk(field.Value, fn)
+		}
+	}
+}
+
+// UnserializeValue reads the first value in b as a Value tree.
+func UnserializeValue(b []byte) (Value, error) {
+	return NewDecoder(NewBufReader(b)).Value()
+}
+
+// valueFrame is a collection being read by Decoder.Value, with the number
+// of the elements read into it.
+type valueFrame struct {
+	value Value
+	n     int
+}
+
+// Value reads the next value as a Value tree. The references are resolved
+// to the nodes read by Value before, in this call or in the previous ones
+// since the last reset.
+func (d *Decoder) Value() (Value, error) {
+	if !d.More() {
+		return nil, badEndError
+	}
+	var stack []valueFrame
+	for started := false; ; started = true {
+		refs := d.refs
+		token, err := d.Token()
+		if err == io.EOF && started {
+			// the stream ends after a class defined for the value.
+			err = io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return nil, err
+		}
+		v := scalarValue(token)
+		switch token.Kind {
+		case ClassToken:
+			// the field names are referenced like the other strings.
+			if d.refs-refs == len(token.Fields) {
+				for i, name := range token.Fields {
+					d.setValue(refs+i, &String{name})
+				}
+			}
+			continue
+		case NullToken, BoolToken, IntToken, LongToken, DoubleToken,
+			StringToken, BytesToken, DateToken, GuidToken:
+		case ListToken:
+			v = &List{make([]Value, token.Count)}
+		case MapToken:
+			v = &Map{make([]MapEntry, token.Count)}
+		case ObjectToken:
+			fields := make([]ObjectField, token.Count)
+			for i, name := range token.Fields {
+				fields[i].Name = name
+			}
+			v = &Object{token.Class, fields}
+		case RefToken:
+			if token.Ref >= len(d.values) || d.values[token.Ref] == nil {
+				return nil, errors.New("reference to a value not read by Decoder.Value")
+			}
+			v = Ref{d.values[token.Ref]}
+		case EndToken:
+			n := len(stack) - 1
+			v = stack[n].value
+			stack = stack[:n]
+		default:
+			return nil, errors.New("unexpected " + token.Kind.String() + " token")
+		}
+		if token.Ref >= 0 && token.Kind != RefToken {
+			d.setValue(token.Ref, v)
+		}
+		switch token.Kind {
+		case ListToken, MapToken, ObjectToken:
+			stack = append(stack, valueFrame{v, 0})
+			continue
+		}
+		n := len(stack) - 1
+		if n < 0 {
+			return v, nil
+		}
+		frame := &stack[n]
+		switch c := frame.value.(type) {
+		case *List:
+			c.Items[frame.n] = v
+		case *Map:
+			if frame.n%2 == 0 {
+				c.Entries[frame.n/2].Key = v
+			} else {
+				c.Entries[frame.n/2].Value = v
+			}
+		case *Object:
+			c.Fields[frame.n].Value = v
+		}
+		frame.n++
+	}
+}
+
+// scalarValue returns the node of a token which is not a collection, or
+// nil for the other tokens.
+func scalarValue(token Token) Value {
+	switch token.Kind {
+	case NullToken:
+		return Null{}
+	case BoolToken:
+		return Bool(token.Value.(bool))
+	case IntToken:
+		return Int(token.Value.(int64))
+	case LongToken:
+		return BigInt{token.Value.(*big.Int)}
+	case DoubleToken:
+		return Double(token.Value.(float64))
+	case StringToken:
+		return &String{token.Value.(string)}
+	case BytesToken:
+		return &Bytes{token.Value.([]byte)}
+	case DateToken:
+		return &Date{token.Value.(time.Time)}
+	case GuidToken:
+		return &Guid{token.Value.(uuid.UUID)}
+	}
+	return nil
+}
+
+func (d *Decoder) setValue(ref int, v Value) {
+	for len(d.values) <= ref {
+		d.values = append(d.values, nil)
+	}
+	d.values[ref] = v
+}
+
+func marshalValue(w Writer, v Value) error {
+	vw, ok := w.(*writer)
+	if !ok {
+		return errors.New("a Value needs a writer returned by NewWriter or NewSimpleWriter")
+	}
+	return vw.writeNode(v, refTargets(v))
+}
+
+// refTargets returns the short strings in v which are the targets of its
+// Refs. A writer writes the other short strings without references, like
+// WriteStringWithRef.
+func refTargets(v Value) map[*String]bool {
+	var targets map[*String]bool
+	Walk(v, func(v Value) bool {
+		if ref, ok := v.(Ref); ok {
+			if s, ok := ref.Target.(*String); ok && shortString(s.Value) {
+				if targets == nil {
+					targets = make(map[*String]bool)
+				}
+				targets[s] = true
+			}
+		}
+		return true
+	})
+	return targets
+}
+
+func (w *writer) writeNode(v Value, targets map[*String]bool) error {
+	switch v := v.(type) {
+	case nil, Null:
+		return w.WriteNull()
+	case Bool:
+		return w.WriteBool(bool(v))
+	case Int:
+		return w.WriteInt64(int64(v))
+	case BigInt:
+		if v.Value == nil {
+			return w.WriteNull()
+		}
+		return w.WriteBigInt(v.Value)
+	case Double:
+		return w.WriteFloat64(float64(v))
+	case *String:
+		if shortString(v.Value) && !targets[v] {
+			return w.WriteStringWithRef(v.Value)
+		}
+		return w.writeString(v, v.Value)
+	case *Bytes:
+		return w.writeBytes(v, v.Value)
+	case *Date:
+		return w.writeTime(v, v.Value)
+	case *Guid:
+		return w.writeUUID(v, v.Value)
+	case *List:
+		if err := w.beginNode(v, TagList, len(v.Items)); err != nil {
+			return err
+		}
+		for _, item := range v.Items {
+			if err := w.writeNode(item, targets); err != nil {
+				return err
+			}
+		}
+	case *Map:
+		if err := w.beginNode(v, TagMap, len(v.Entries)); err != nil {
+			return err
+		}
+		for _, entry := range v.Entries {
+			if err := w.writeNode(entry.Key, targets); err != nil {
+				return err
+			}
+			if err := w.writeNode(entry.Value, targets); err != nil {
+				return err
+			}
+		}
+	case *Object:
+		if err := w.writeObjectNode(v); err != nil {
+			return err
+		}
+		for _, field := range v.Fields {
+			if err := w.writeNode(field.Value, targets); err != nil {
+				return err
+			}
+		}
+	case Ref:
+		success, err := w.writeRef(w, v.Target)
+		if s, ok := v.Target.(*String); ok && err == nil && !success {
+			// a field name of a class is registered by its value.
+			success, err = w.writeRef(w, s.Value)
+		}
+		if err == nil && !success {
+			err = unwrittenRefError
+		}
+		return err
+	default:
+		return errors.New("unsupported Value type " + reflect.TypeOf(v).String())
+	}
+	return w.stream.WriteByte(TagClosebrace)
+}
+
+func (w *writer) beginNode(v Value, tag byte, count int) (err error) {
+	w.setRef(v)
+	s := w.stream
+	if err = s.WriteByte(tag); err == nil {
+		if count > 0 {
+			err = w.writeInt(count)
+		}
+		if err == nil {
+			err = s.WriteByte(TagOpenbrace)
+		}
+	}
+	return err
+}
+
+func (w *writer) writeObjectNode(o *Object) (err error) {
+	if w.classref == nil {
+		w.classref = make(map[string]int)
+		w.fieldsref = make([][]field, 0)
+	}
+	names := make([]string, len(o.Fields))
+	for i, f := range o.Fields {
+		names[i] = f.Name
+	}
+	index, found := w.classref[o.Class]
+	if !found || !sameFieldNames(w.fieldsref[index], names) {
+		fields := make([]field, len(names))
+		for i, name := range names {
+			fields[i].Name = name
+		}
+		if index, err = w.writeClass(o.Class, fields); err != nil {
+			return err
+		}
+	}
+	w.setRef(o)
+	s := w.stream
+	if err = s.WriteByte(TagObject); err == nil {
+		if err = w.writeInt(index); err == nil {
+			err = s.WriteByte(TagOpenbrace)
+		}
+	}
+	return err
+}
@@ -0,0 +1,184 @@
+/**********************************************************\
+|                                                          |
+|                          hprose                          |
+|                                                          |
+| Official WebSite: http://www.hprose.com/                 |
+|                   http://www.hprose.net/                 |
+|                   http://www.hprose.org/                 |
+|                                                          |
+\**********************************************************/
+/**********************************************************\
+ *                                                        *
+ * hprose/value_test.go                                   *
+ *                                                        *
+ * hprose Value tree Test for Go.                         *
+ *                                                        *
+\**********************************************************/
+
+package hprose_test
+
+import (
+	"bytes"
+	. "hprose"
+	"math/big"
+	"testing"
+	"time"
+)
+
+func TestValueRoundTrip(t *testing.T) {
+	date := time.Date(2026, 10, 16, 12, 30, 0, 0, time.UTC)
+	data, err := Serialize([]interface{}{nil, true, 12, big.NewInt(-1), 3.5, "", "a",
+		"hello", "hello", []byte("xy"), date, map[string]int{"a": 1},
+		testTaggedUser{"Tom", ""}, testTaggedUser{"Jerry", ""}}, false)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	v, err := UnserializeValue(data)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	list, ok := v.(*List)
+	if !ok || len(list.Items) != 14 {
+		t.Fatal(v)
+	}
+	kinds := []TokenKind{NullToken, BoolToken, IntToken, LongToken, DoubleToken, StringToken,
+		StringToken, StringToken, RefToken, BytesToken, DateToken, MapToken, ObjectToken, ObjectToken}
+	for i, kind := range kinds {
+		if list.Items[i].Kind() != kind {
+			t.Errorf("item %d: %v", i, list.Items[i])
+		}
+	}
+	if ref := list.Items[8].(Ref); ref.Target != list.Items[7] {
+		t.Error(ref)
+	}
+	if o := list.Items[13].(*Object); o.Class != "testTaggedUser" ||
+		len(o.Fields) != 1 || o.Fields[0].Name != "user_name" || o.Fields[0].Value.(*String).Value != "Jerry" {
+		t.Error(o)
+	}
+	if d := list.Items[10].(*Date); !d.Value.Equal(date) {
+		t.Error(d.Value)
+	}
+	result, err := Serialize(v, false)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if !bytes.Equal(result, data) {
+		t.Errorf("%s\n%s", result, data)
+	}
+}
+
+func TestValueModify(t *testing.T) {
+	v, err := UnserializeValue([]byte(`a3{s3"Tom"r1;c14"testTaggedUser"1{s9"user_name"}o0{r1;}}`))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	Walk(v, func(v Value) bool {
+		if s, ok := v.(*String); ok && s.Value == "Tom" {
+			s.Value = "Jerry"
+		}
+		return true
+	})
+	list := v.(*List)
+	list.Items = append(list.Items, &Object{"testTaggedUser", []ObjectField{{"user_name", &String{"Ann"}}}})
+	data, err := Serialize(v, false)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	s := `a4{s5"Jerry"r1;c14"testTaggedUser"1{s9"user_name"}o0{r1;}o0{s3"Ann"}}`
+	if string(data) != s {
+		t.Error(string(data))
+	}
+	var values []interface{}
+	if err = Unserialize(data, &values, false); err != nil {
+		t.Fatal(err.Error())
+	}
+	if values[1] != "Jerry" || values[2].(*testTaggedUser).Name != "Jerry" || values[3].(*testTaggedUser).Name != "Ann" {
+		t.Error(values)
+	}
+}
+
+func TestValueNested(t *testing.T) {
+	data := []byte(`a1{r0;}`)
+	v, err := UnserializeValue(data)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if list := v.(*List); list.Items[0].(Ref).Target != v {
+		t.Error(list.Items)
+	}
+	count := 0
+	Walk(v, func(Value) bool {
+		count++
+		return true
+	})
+	if count != 2 {
+		t.Error(count)
+	}
+	result, err := Serialize(v, false)
+	if err != nil || !bytes.Equal(result, data) {
+		t.Error(string(result), err)
+	}
+}
+
+func TestValueFieldNameRef(t *testing.T) {
+	data := []byte(`c5"Point"1{s4"name"}a2{o0{s4"abcd"}r0;}`)
+	v, err := UnserializeValue(data)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	list := v.(*List)
+	if s, ok := list.Items[1].(Ref).Target.(*String); !ok || s.Value != "name" {
+		t.Error(list.Items[1])
+	}
+	// the writer defines the class where it is used first.
+	result, err := Serialize(v, false)
+	if err != nil || string(result) != `a2{c5"Point"1{s4"name"}o0{s4"abcd"}r1;}` {
+		t.Fatal(string(result), err)
+	}
+	if v, err = UnserializeValue(result); err != nil {
+		t.Fatal(err.Error())
+	}
+	if s, ok := v.(*List).Items[1].(Ref).Target.(*String); !ok || s.Value != "name" {
+		t.Error(v)
+	}
+}
+
+func TestDecoderValue(t *testing.T) {
+	decoder := NewDecoder(NewBufReader([]byte(`s5"hello"m1{ua1}r0;`)))
+	var values []Value
+	for i := 0; i < 3; i++ {
+		v, err := decoder.Value()
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		values = append(values, v)
+	}
+	if m := values[1].(*Map); len(m.Entries) != 1 || m.Entries[0].Key.(*String).Value != "a" || m.Entries[0].Value != Int(1) {
+		t.Error(m)
+	}
+	if ref := values[2].(Ref); ref.Target != values[0] {
+		t.Error(ref)
+	}
+}
+
+func TestValueErrors(t *testing.T) {
+	for _, data := range []string{`r0;`, `Rs3"abc"z`, `a2{1`} {
+		if _, err := UnserializeValue([]byte(data)); err == nil {
+			t.Error(data)
+		}
+	}
+	decoder := NewDecoder(NewBufReader([]byte(`s3"abc"r0;`)))
+	if err := decoder.Skip(); err != nil {
+		t.Fatal(err.Error())
+	}
+	if _, err := decoder.Value(); err == nil {
+		t.Error("a reference to a skipped value should fail")
+	}
+	if _, err := Serialize(Ref{&String{"abc"}}, false); err == nil {
+		t.Error("a Ref to a value not written should fail")
+	}
+	s := &String{"abc"}
+	if _, err := Serialize(&List{[]Value{s, Ref{s}}}, true); err == nil {
+		t.Error("a simple writer should not write a Ref")
+	}
+}
@@ -0,0 +1,244 @@
+/**********************************************************\
+|                                                          |
+|                          hprose                          |
+|                                                          |
+| Official WebSite: http://www.hprose.com/                 |
+|                   http://www.hprose.net/                 |
+|                   http://www.hprose.org/                 |
+|                                                          |
+\**********************************************************/
+/**********************************************************\
+ *                                                        *
+ * hprose/websocket.go                                    *
+ *                                                        *
+ * hprose websocket for Go.                               *
+ *                                                        *
+\**********************************************************/
+
+package hprose
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+)
+
+// The websocket opcodes defined by RFC 6455.
+const (
+	wsContinuation = 0x0
+	wsText         = 0x1
+	wsBinary       = 0x2
+	wsClose        = 0x8
+	wsPing         = 0x9
+	wsPong         = 0xA
+)
+
+const wsGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// wsConn reads and writes websocket messages. Every hprose message is sent
+// in a binary websocket message with a 4 bytes big endian request id before
+// it, so many invokings can share one websocket. The client side sets mask,
+// it masks the frames it sends and rejects the masked frames it receives.
+type wsConn struct {
+	net.Conn
+	istream *bufio.Reader
+	mask    bool
+	writing chan struct{}
+}
+
+func newWsConn(conn net.Conn, istream *bufio.Reader, mask bool) *wsConn {
+	return &wsConn{Conn: conn, istream: istream, mask: mask, writing: make(chan struct{}, 1)}
+}
+
+func wsAcceptKey(key string) string {
+	h := sha1.New()
+	io.WriteString(h, key+wsGUID)
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+func wsNewKey() (string, error) {
+	key := make([]byte, 16)
+	if _, err := rand.Read(key); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(key), nil
+}
+
+// readMessage reads a text or binary message, the control frames between
+// the fragments are handled here. The message is never allocated when its
+// length exceeds maxSize. Zero maxSize means no limit.
+func (c *wsConn) readMessage(maxSize int) (data []byte, err error) {
+	var message []byte
+	for {
+		var fin bool
+		var opcode byte
+		var payload []byte
+		limit := -1
+		if maxSize > 0 {
+			limit = maxSize - len(message)
+		}
+		if fin, opcode, payload, err = c.readFrame(limit); err != nil {
+			return nil, err
+		}
+		switch opcode {
+		case wsPing:
+			if err = c.writeFrame(wsPong, payload); err != nil {
+				return nil, err
+			}
+		case wsPong:
+		case wsClose:
+			c.writeFrame(wsClose, nil)
+			return nil, io.EOF
+		case wsText, wsBinary, wsContinuation:
+			if (opcode == wsContinuation) != (message != nil) {
+				return nil, errors.New("Wrong websocket frame.")
+			}
+			message = append(message, payload...)
+			if message == nil {
+				message = []byte{}
+			}
+			if fin {
+				return message, nil
+			}
+		default:
+			return nil, errors.New("Unknown websocket opcode.")
+		}
+	}
+}
+
+// readFrame reads a frame, a negative limit means the length of a data frame
+// is only limited to 2GB.
+func (c *wsConn) readFrame(limit int) (fin bool, opcode byte, payload []byte, err error) {
+	var header [14]byte
+	if _, err = io.ReadFull(c.istream, header[:2]); err != nil {
+		return
+	}
+	fin = header[0]&0x80 != 0
+	opcode = header[0] & 0x0F
+	masked := header[1]&0x80 != 0
+	if masked == c.mask {
+		// RFC 6455 5.1: the frames from the client must be masked, and the
+		// frames from the server must not be masked.
+		err = errors.New("Wrong websocket frame mask.")
+		return
+	}
+	length := uint64(header[1] & 0x7F)
+	n := 0
+	switch length {
+	case 126:
+		n = 2
+	case 127:
+		n = 8
+	}
+	if masked {
+		n += 4
+	}
+	if _, err = io.ReadFull(c.istream, header[2:2+n]); err != nil {
+		return
+	}
+	switch length {
+	case 126:
+		length = uint64(binary.BigEndian.Uint16(header[2:]))
+	case 127:
+		length = binary.BigEndian.Uint64(header[2:])
+	}
+	if opcode >= wsClose {
+		if !fin || length > 125 {
+			err = errors.New("Wrong websocket control frame.")
+			return
+		}
+	} else if (limit >= 0 && length > uint64(limit)) || length > 1<<31 {
+		err = ErrMessageTooLarge
+		return
+	}
+	payload = make([]byte, length)
+	if _, err = io.ReadFull(c.istream, payload); err != nil {
+		return
+	}
+	if masked {
+		key := header[2+n-4 : 2+n]
+		for i := range payload {
+			payload[i] ^= key[i&3]
+		}
+	}
+	return
+}
+
+// writeFrame writes a whole message in one frame with one Write call.
+func (c *wsConn) writeFrame(opcode byte, payload []byte) error {
+	return c.writeFrameContext(context.Background(), opcode, payload)
+}
+
+// writeFrameContext is like writeFrame, but a caller waiting for a stalled
+// write gives up when ctx is done, and the write is aborted when ctx is
+// done, then ctx.Err() is returned. A frame which is not written completely
+// breaks the stream, so the connection is closed on a write error.
+func (c *wsConn) writeFrameContext(ctx context.Context, opcode byte, payload []byte) (err error) {
+	length := len(payload)
+	frame := make([]byte, 14+length)
+	frame[0] = 0x80 | opcode
+	n := 2
+	switch {
+	case length < 126:
+		frame[1] = byte(length)
+	case length <= 0xFFFF:
+		frame[1] = 126
+		binary.BigEndian.PutUint16(frame[2:], uint16(length))
+		n += 2
+	default:
+		frame[1] = 127
+		binary.BigEndian.PutUint64(frame[2:], uint64(length))
+		n += 8
+	}
+	if c.mask {
+		frame[1] |= 0x80
+		key := frame[n : n+4]
+		if _, err := rand.Read(key); err != nil {
+			return err
+		}
+		n += 4
+		for i, b := range payload {
+			frame[n+i] = b ^ key[i&3]
+		}
+	} else {
+		copy(frame[n:], payload)
+	}
+	select {
+	case c.writing <- struct{}{}:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	defer func() {
+		<-c.writing
+	}()
+	aborted := make(chan struct{})
+	stop := context.AfterFunc(ctx, func() {
+		c.SetWriteDeadline(aLongTimeAgo)
+		close(aborted)
+	})
+	_, err = c.Write(frame[:n+length])
+	if !stop() {
+		<-aborted
+		if err != nil {
+			err = ctx.Err()
+		}
+	}
+	if err != nil {
+		c.Close()
+	}
+	return err
+}
+
+// writeMessage writes a hprose message with its request id.
+func (c *wsConn) writeMessage(ctx context.Context, id uint32, data []byte) error {
+	message := make([]byte, 4+len(data))
+	binary.BigEndian.PutUint32(message, id)
+	copy(message[4:], data)
+	return c.writeFrameContext(ctx, wsBinary, message)
+}
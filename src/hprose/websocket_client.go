@@ -0,0 +1,266 @@
+/**********************************************************\
+|                                                          |
+|                          hprose                          |
+|                                                          |
+| Official WebSite: http://www.hprose.com/                 |
+|                   http://www.hprose.net/                 |
+|                   http://www.hprose.org/                 |
+|                                                          |
+\**********************************************************/
+/**********************************************************\
+ *                                                        *
+ * hprose/websocket_client.go                             *
+ *                                                        *
+ * hprose websocket client for Go.                        *
+ *                                                        *
+\**********************************************************/
+
+package hprose
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+)
+
+type WebSocketClient struct {
+	*BaseClient
+	header http.Header
+	config *tls.Config
+}
+
+// WebSocketTransporter sends all invokings on one websocket, the responses
+// are dispatched to the invokings by the request id, so a WebSocketClient
+// can be shared by many goroutines.
+type WebSocketTransporter struct {
+	*WebSocketClient
+	mutex     sync.Mutex
+	dialMutex sync.Mutex
+	uri       string
+	conn      *wsDuplexConn
+}
+
+type WebSocketContext struct {
+	conn     *wsDuplexConn
+	id       uint32
+	response chan duplexResponse
+	ctx      context.Context
+}
+
+type wsDuplexConn struct {
+	*wsConn
+	duplexCalls
+}
+
+func NewWebSocketClient(uri string) Client {
+	trans := &WebSocketTransporter{}
+	client := &WebSocketClient{
+		BaseClient: NewBaseClient(trans),
+		header:     make(http.Header),
+	}
+	trans.WebSocketClient = client
+	client.SetUri(uri)
+	return client
+}
+
+func (client *WebSocketClient) SetUri(uri string) {
+	if u, err := url.Parse(uri); err == nil {
+		if u.Scheme != "ws" && u.Scheme != "wss" {
+			panic("This client desn't support " + u.Scheme + " scheme.")
+		}
+	}
+	client.BaseClient.SetUri(uri)
+}
+
+// Close closes the websocket, the waiting invokings get an error.
+func (client *WebSocketClient) Close() {
+	t := client.Transporter.(*WebSocketTransporter)
+	t.mutex.Lock()
+	t.closeConn()
+	t.mutex.Unlock()
+}
+
+// Header returns the http header sent with the opening handshake, such as
+// Origin or Cookie.
+func (client *WebSocketClient) Header() http.Header {
+	return client.header
+}
+
+func (client *WebSocketClient) TLSClientConfig() *tls.Config {
+	return client.config
+}
+
+func (client *WebSocketClient) SetTLSClientConfig(config *tls.Config) {
+	client.config = config
+}
+
+func (t *WebSocketTransporter) GetInvokeContext(uri string) (interface{}, error) {
+	return t.GetInvokeContextWithContext(context.Background(), uri)
+}
+
+func (t *WebSocketTransporter) GetInvokeContextWithContext(ctx context.Context, uri string) (interface{}, error) {
+	conn, err := t.getConn(ctx, uri)
+	if err != nil {
+		return nil, err
+	}
+	id, response, err := conn.register()
+	if err != nil {
+		return nil, err
+	}
+	return &WebSocketContext{conn: conn, id: id, response: response, ctx: ctx}, nil
+}
+
+func (t *WebSocketTransporter) SendData(context interface{}, data []byte, success bool) error {
+	if success {
+		c := context.(*WebSocketContext)
+		return c.conn.writeMessage(c.ctx, c.id, data)
+	}
+	return nil
+}
+
+func (t *WebSocketTransporter) GetInputStream(context interface{}) (BufReader, error) {
+	c := context.(*WebSocketContext)
+	return waitResponse(c.ctx, c.response)
+}
+
+func (t *WebSocketTransporter) EndInvoke(context interface{}, success bool) error {
+	c := context.(*WebSocketContext)
+	c.conn.unregister(c.id)
+	return nil
+}
+
+// private methods
+
+func (t *WebSocketTransporter) getConn(ctx context.Context, uri string) (*wsDuplexConn, error) {
+	t.dialMutex.Lock()
+	defer t.dialMutex.Unlock()
+	t.mutex.Lock()
+	if t.uri != uri {
+		t.uri = uri
+		t.closeConn()
+	}
+	conn := t.conn
+	t.mutex.Unlock()
+	if conn != nil && conn.alive() {
+		return conn, nil
+	}
+	c, err := t.dial(ctx, uri)
+	if err != nil {
+		return nil, err
+	}
+	conn = &wsDuplexConn{wsConn: c}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.uri != uri {
+		conn.Close()
+		return nil, errors.New("The uri of the client has been changed.")
+	}
+	t.conn = conn
+	go conn.receive(t.Limits.MaxMessageSize)
+	return conn, nil
+}
+
+func (t *WebSocketTransporter) closeConn() {
+	if t.conn != nil {
+		t.conn.writeFrame(wsClose, nil)
+		t.conn.Close()
+		t.conn = nil
+	}
+}
+
+func (t *WebSocketTransporter) dial(ctx context.Context, uri string) (c *wsConn, err error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return nil, err
+	}
+	host := u.Host
+	if u.Port() == "" {
+		if u.Scheme == "wss" {
+			host = net.JoinHostPort(u.Hostname(), "443")
+		} else {
+			host = net.JoinHostPort(u.Hostname(), "80")
+		}
+	}
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", host)
+	if err != nil {
+		return nil, err
+	}
+	stop := context.AfterFunc(ctx, func() {
+		conn.SetDeadline(aLongTimeAgo)
+	})
+	defer func() {
+		if !stop() && err == nil {
+			err = ctx.Err()
+		}
+		if err != nil {
+			conn.Close()
+			c = nil
+		}
+	}()
+	if u.Scheme == "wss" {
+		config := &tls.Config{}
+		if t.config != nil {
+			config = t.config.Clone()
+		}
+		if config.ServerName == "" {
+			config.ServerName = u.Hostname()
+		}
+		conn = tls.Client(conn, config)
+	}
+	key, err := wsNewKey()
+	if err != nil {
+		return nil, err
+	}
+	request := &http.Request{
+		Method:     "GET",
+		URL:        u,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     t.header.Clone(),
+		Host:       u.Host,
+	}
+	request.Header.Set("Upgrade", "websocket")
+	request.Header.Set("Connection", "Upgrade")
+	request.Header.Set("Sec-WebSocket-Key", key)
+	request.Header.Set("Sec-WebSocket-Version", "13")
+	if err = request.Write(conn); err != nil {
+		return nil, err
+	}
+	istream := bufio.NewReader(conn)
+	response, err := http.ReadResponse(istream, request)
+	if err != nil {
+		return nil, err
+	}
+	if response.StatusCode != http.StatusSwitchingProtocols {
+		return nil, errors.New("The websocket handshake failed: " + response.Status)
+	}
+	if response.Header.Get("Sec-WebSocket-Accept") != wsAcceptKey(key) {
+		return nil, errors.New("The websocket handshake failed: wrong Sec-WebSocket-Accept.")
+	}
+	return newWsConn(conn, istream, true), nil
+}
+
+// receive dispatches the responses to the invokings by the request id until
+// the websocket is closed, then all waiting invokings get the error.
+func (conn *wsDuplexConn) receive(maxSize int) {
+	for {
+		data, err := conn.readMessage(maxSize)
+		if err == nil && len(data) < 4 {
+			err = errors.New("Wrong Response: the message has no request id.")
+		}
+		if err != nil {
+			conn.fail(err)
+			conn.Close()
+			return
+		}
+		conn.dispatch(binary.BigEndian.Uint32(data), duplexResponse{data: data[4:]})
+	}
+}
@@ -0,0 +1,164 @@
+/**********************************************************\
+|                                                          |
+|                          hprose                          |
+|                                                          |
+| Official WebSite: http://www.hprose.com/                 |
+|                   http://www.hprose.net/                 |
+|                   http://www.hprose.org/                 |
+|                                                          |
+\**********************************************************/
+/**********************************************************\
+ *                                                        *
+ * hprose/websocket_service.go                            *
+ *                                                        *
+ * hprose websocket service for Go.                       *
+ *                                                        *
+\**********************************************************/
+
+package hprose
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// WebSocketService serves the websocket requests, the other requests are
+// served by the HttpService as usual.
+type WebSocketService struct {
+	*HttpService
+	// MaxConcurrentRequests is the maximum number of the requests handled at
+	// the same time on one websocket, the next message isn't read until one
+	// of them is done. Zero means no limit.
+	MaxConcurrentRequests int
+	// CheckOrigin reports whether the websocket requested from the Origin
+	// of the request is accepted, the others are rejected with 403. When it
+	// is nil, only the requests without Origin and the requests from the
+	// same host are accepted, so other web pages can't open a websocket.
+	CheckOrigin func(request *http.Request) bool
+}
+
+func NewWebSocketService() *WebSocketService {
+	return &WebSocketService{
+		HttpService:           NewHttpService(),
+		MaxConcurrentRequests: DefaultMaxConcurrentRequests,
+	}
+}
+
+func (service *WebSocketService) ServeHTTP(response http.ResponseWriter, request *http.Request) {
+	if !isWebSocketRequest(request) {
+		service.HttpService.ServeHTTP(response, request)
+		return
+	}
+	key := request.Header.Get("Sec-WebSocket-Key")
+	if request.Header.Get("Sec-WebSocket-Version") != "13" || key == "" {
+		response.Header().Set("Sec-WebSocket-Version", "13")
+		http.Error(response, "Bad WebSocket Request", http.StatusBadRequest)
+		return
+	}
+	checkOrigin := service.CheckOrigin
+	if checkOrigin == nil {
+		checkOrigin = isSameOrigin
+	}
+	if !checkOrigin(request) {
+		http.Error(response, "Forbidden Origin", http.StatusForbidden)
+		return
+	}
+	hijacker, ok := response.(http.Hijacker)
+	if !ok {
+		http.Error(response, "WebSocket Not Supported", http.StatusInternalServerError)
+		return
+	}
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		return
+	}
+	rw.WriteString("HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + wsAcceptKey(key) + "\r\n\r\n")
+	if err = rw.Flush(); err != nil {
+		conn.Close()
+		return
+	}
+	service.serveWebSocket(newWsConn(conn, rw.Reader, false), &ServiceContext{
+		Context: request.Context(),
+		Request: request,
+		Conn:    conn,
+	})
+}
+
+// serveWebSocket handles every request in its own goroutine, and sends its
+// response back with the same request id as soon as it is ready. At most
+// MaxConcurrentRequests of them are handled at the same time.
+func (service *WebSocketService) serveWebSocket(conn *wsConn, context *ServiceContext) {
+	var wg sync.WaitGroup
+	defer func() {
+		wg.Wait()
+		conn.Close()
+	}()
+	var sem chan struct{}
+	if service.MaxConcurrentRequests > 0 {
+		sem = make(chan struct{}, service.MaxConcurrentRequests)
+	}
+	for {
+		data, err := conn.readMessage(service.Limits.MaxMessageSize)
+		if err == nil && len(data) < 4 {
+			err = errors.New("Wrong Request: the message has no request id.")
+		}
+		if err != nil {
+			code := 1002
+			if err == ErrMessageTooLarge {
+				code = 1009
+			}
+			conn.writeFrame(wsClose, []byte{byte(code >> 8), byte(code)})
+			return
+		}
+		if sem != nil {
+			sem <- struct{}{}
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if sem != nil {
+				defer func() {
+					<-sem
+				}()
+			}
+			buf := new(bytes.Buffer)
+			if len(data) == 4 {
+				service.sendError(&serviceSession{ostream: buf}, errors.New("Empty Request"))
+			} else {
+				service.handle(&serviceSession{istream: NewBufReader(data[4:]), ostream: buf, context: context})
+			}
+			conn.writeMessage(context, binary.BigEndian.Uint32(data), buf.Bytes())
+		}()
+	}
+}
+
+func isWebSocketRequest(request *http.Request) bool {
+	if request.Method != "GET" || !strings.EqualFold(request.Header.Get("Upgrade"), "websocket") {
+		return false
+	}
+	for _, value := range request.Header["Connection"] {
+		for _, token := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), "upgrade") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func isSameOrigin(request *http.Request) bool {
+	origin := request.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	return err == nil && strings.EqualFold(u.Host, request.Host)
+}
@@ -59,15 +59,19 @@ type writerRefer interface {
 }
 
 type realWriterRefer struct {
-	ref map[interface{}]int
+	ref   map[interface{}]int
+	count int
 }
 
+// setRef registers v with the next reference index. The index is counted
+// apart from the map, because a value written again without a reference,
+// like a field name of a class defined twice, still takes an index.
 func (r *realWriterRefer) setRef(v interface{}) {
 	if r.ref == nil {
 		r.ref = make(map[interface{}]int)
 	}
-	n := len(r.ref)
-	r.ref[v] = n
+	r.ref[v] = r.count
+	r.count++
 }
 
 func (r *realWriterRefer) writeRef(w *writer, v interface{}) (success bool, err error) {
@@ -87,6 +91,7 @@ func (r *realWriterRefer) resetRef() {
 	if r.ref != nil {
 		r.ref = nil
 	}
+	r.count = 0
 }
 
 func NewWriter(stream BufWriter) Writer {